@@ -0,0 +1,245 @@
+package sapi
+
+import (
+	"encoding/json"
+	"fmt"
+	gosync "sync"
+	"time"
+)
+
+var (
+	//batches of one tor in flight at a time
+	jobTorConcurrency = 1
+	//jobs in one batch at most
+	jobBatchMax = 100
+	//a batchable job waits this long for others to join its batch
+	jobBatchWindow = time.Millisecond * 200
+
+	//tor -> batches in flight, guarded by jobFlightMu
+	jobFlights  = make(map[string]*flight)
+	jobFlightMu gosync.Mutex
+)
+
+//flight is what a tor has in flight, a barrier job runs alone
+type flight struct {
+	batches int
+	barrier bool
+	keys    map[string]int
+}
+
+func newFlight() *flight {
+	return &flight{keys: make(map[string]int)}
+}
+
+func (f *flight) claim(batch []*SapiConfigJobs, barrier bool) {
+	f.batches++
+	f.barrier = barrier
+	for _, job := range batch {
+		keys, _ := jobKeys(job)
+		for _, key := range keys {
+			f.keys[key]++
+		}
+	}
+}
+
+func (f *flight) release(batch []*SapiConfigJobs) {
+	f.batches--
+	f.barrier = false
+	for _, job := range batch {
+		keys, _ := jobKeys(job)
+		for _, key := range keys {
+			if f.keys[key]--; f.keys[key] <= 0 {
+				delete(f.keys, key)
+			}
+		}
+	}
+}
+
+//SetJobBatching sets the batch window and size and how many batches a tor
+//may have in flight.
+func SetJobBatching(window time.Duration, max, torConcurrency int) {
+	if max < 1 {
+		max = 1
+	}
+	if torConcurrency < 1 {
+		torConcurrency = 1
+	}
+	jobBatchWindow, jobBatchMax, jobTorConcurrency = window, max, torConcurrency
+}
+
+func batchable(kind string) bool {
+	switch kind {
+	case JobVlanMap, JobVlanUnmap, JobTrunk, JobUntrunk:
+		return true
+	}
+	return false
+}
+
+//jobKeys returns what a batchable job changes on its tor and what it must
+//not share a batch or the flight with. Mappings of one vsi go together,
+//the removal of the vsi goes alone.
+func jobKeys(job *SapiConfigJobs) (keys, clashes []string) {
+	switch job.Kind {
+	case JobVlanMap:
+		var m VlanMap
+		json.Unmarshal([]byte(job.Payload), &m)
+		iface := fmt.Sprintf("if:%d/%d", m.Index, m.Vlan)
+		return []string{iface, fmt.Sprintf("vsi+:%d", m.Vxlan)},
+			[]string{iface, fmt.Sprintf("vsi-:%d", m.Vxlan)}
+	case JobVlanUnmap:
+		var m vlanUnmapJob
+		json.Unmarshal([]byte(job.Payload), &m)
+		iface := fmt.Sprintf("if:%d/%d", m.Index, m.Vlan)
+		if m.OnlyIndex {
+			return []string{iface}, []string{iface}
+		}
+		return []string{iface, fmt.Sprintf("vsi-:%d", m.Vxlan)},
+			[]string{iface, fmt.Sprintf("vsi+:%d", m.Vxlan), fmt.Sprintf("vsi-:%d", m.Vxlan)}
+	case JobTrunk, JobUntrunk:
+		var t Trunk
+		json.Unmarshal([]byte(job.Payload), &t)
+		key := fmt.Sprintf("trunk:%d/%d", t.Index, t.Vlan)
+		return []string{key}, []string{key}
+	}
+	return nil, nil
+}
+
+//nextBatches claims the batches of a tor that may start now from its
+//pending jobs in id order. Jobs never overtake an earlier job of the tor
+//that cannot start. wait tells when a batch still open may start.
+func nextBatches(pending []*SapiConfigJobs, f *flight, now time.Time) (batches [][]*SapiConfigJobs, wait time.Duration) {
+	for i := 0; i < len(pending); {
+		head := pending[i]
+		if f.batches >= jobTorConcurrency || f.barrier || head.NextRun.After(now) {
+			return
+		}
+		if !batchable(head.Kind) {
+			if f.batches == 0 {
+				batch := []*SapiConfigJobs{head}
+				f.claim(batch, true)
+				batches = append(batches, batch)
+			}
+			return
+		}
+		if age := now.Sub(head.Created); age < jobBatchWindow {
+			wait = jobBatchWindow - age
+			return
+		}
+
+		held := make(map[string]bool)
+		batch := []*SapiConfigJobs{}
+	collect:
+		for _, job := range pending[i:] {
+			if len(batch) >= jobBatchMax || !batchable(job.Kind) || job.NextRun.After(now) {
+				break
+			}
+			keys, clashes := jobKeys(job)
+			for _, key := range clashes {
+				if held[key] || f.keys[key] > 0 {
+					break collect
+				}
+			}
+			for _, key := range keys {
+				held[key] = true
+			}
+			batch = append(batch, job)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		f.claim(batch, false)
+		batches = append(batches, batch)
+		i += len(batch)
+	}
+	return
+}
+
+func releaseBatch(batch []*SapiConfigJobs) {
+	jobFlightMu.Lock()
+	defer jobFlightMu.Unlock()
+	tor := batch[0].TorIp
+	if f, ok := jobFlights[tor]; ok {
+		f.release(batch)
+		if f.batches <= 0 {
+			delete(jobFlights, tor)
+		}
+	}
+}
+
+//runBatch issues a batch in one driver transaction if the driver of the
+//tor batches, else job by job until one fails.
+func runBatch(batch []*SapiConfigJobs) {
+	defer wakeupJobs()
+	defer releaseBatch(batch)
+
+	for _, job := range batch {
+		job.BatchId = batch[0].Id
+	}
+	if len(batch) > 1 {
+		tor, err := torByIp(batch[0].TorIp)
+		if err == nil {
+			var d SwitchDriver
+			if d, err = driverFor(tor); err == nil {
+				if bd, ok := d.(BatchDriver); ok {
+					runTransaction(bd, tor, batch)
+					return
+				}
+			}
+		}
+	}
+	for _, job := range batch {
+		if !runJob(job) {
+			return
+		}
+	}
+}
+
+func batchChange(job *SapiConfigJobs, tunnelIds []int) (Change, error) {
+	c := Change{Kind: job.Kind}
+	var err error
+	switch job.Kind {
+	case JobVlanMap:
+		err = json.Unmarshal([]byte(job.Payload), &c.Map)
+		c.Map.TunnelIds = tunnelIds
+	case JobVlanUnmap:
+		var m vlanUnmapJob
+		err = json.Unmarshal([]byte(job.Payload), &m)
+		c.Map, c.OnlyIndex = m.VlanMap, m.OnlyIndex
+	case JobTrunk, JobUntrunk:
+		err = json.Unmarshal([]byte(job.Payload), &c.Trunk)
+	default:
+		err = fmt.Errorf("Job kind %s is not batchable", job.Kind)
+	}
+	return c, err
+}
+
+//runTransaction applies every job of a batch or none, the jobs share the
+//outcome.
+func runTransaction(bd BatchDriver, tor *SapiTor, batch []*SapiConfigJobs) {
+	for i, job := range batch {
+		if err := startJob(job); err != nil {
+			//the jobs started so far go back to pending, the batch is
+			//tried again as a whole
+			for _, started := range batch[:i] {
+				unstartJob(started)
+			}
+			return
+		}
+	}
+	tunnelIds := getTunnelIds(tor.TorIp)
+	changes := []Change{}
+	var err error
+	for _, job := range batch {
+		var c Change
+		if c, err = batchChange(job, tunnelIds); err != nil {
+			break
+		}
+		changes = append(changes, c)
+	}
+	if err == nil {
+		err = bd.ApplyBatch(tor, changes)
+	}
+	for _, job := range batch {
+		finishJob(job, "", err)
+	}
+}
@@ -0,0 +1,84 @@
+package sapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func batchJob(id int64, kind string, payload interface{}, created time.Time) *SapiConfigJobs {
+	b, _ := json.Marshal(payload)
+	return &SapiConfigJobs{Id: id, TorIp: "tor1", Kind: kind, Payload: string(b),
+		State: JobPending, NextRun: created, Created: created}
+}
+
+func batchIds(batches [][]*SapiConfigJobs) [][]int64 {
+	ids := [][]int64{}
+	for _, batch := range batches {
+		b := []int64{}
+		for _, job := range batch {
+			b = append(b, job.Id)
+		}
+		ids = append(ids, b)
+	}
+	return ids
+}
+
+func TestNextBatches(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-jobBatchWindow)
+	pending := []*SapiConfigJobs{
+		batchJob(1, JobVlanMap, VlanMap{Vlan: 2, Vxlan: 100, Index: 3}, old),
+		batchJob(2, JobVlanMap, VlanMap{Vlan: 2, Vxlan: 100, Index: 4}, old),
+		batchJob(3, JobTrunk, Trunk{Vlan: 30, Index: 5}, old),
+		//removes the vsi the mappings above use, waits for them
+		batchJob(4, JobVlanUnmap, vlanUnmapJob{VlanMap: VlanMap{Vlan: 2, Vxlan: 100, Index: 3}}, old),
+		batchJob(5, JobEnsure, struct{}{}, old),
+	}
+
+	f := newFlight()
+	batches, _ := nextBatches(pending, f, now)
+	if ids := batchIds(batches); len(ids) != 1 || len(ids[0]) != 3 {
+		t.Fatalf("Expected one batch of jobs 1-3, got %v", ids)
+	}
+	if batches, _ = nextBatches(pending[3:], f, now); len(batches) != 0 {
+		t.Errorf("Expected no batch while the tor is busy, got %v", batchIds(batches))
+	}
+
+	jobTorConcurrency = 2
+	defer func() { jobTorConcurrency = 1 }()
+	if batches, _ = nextBatches(pending[3:], f, now); len(batches) != 0 {
+		t.Errorf("Expected the vsi removal held back, got %v", batchIds(batches))
+	}
+	f.release(pending[:3])
+	batches, _ = nextBatches(pending[3:], f, now)
+	if ids := batchIds(batches); len(ids) != 1 || len(ids[0]) != 1 || ids[0][0] != 4 {
+		t.Fatalf("Expected job 4 alone, got %v", ids)
+	}
+	if batches, _ = nextBatches(pending[4:], f, now); len(batches) != 0 {
+		t.Errorf("Expected the ensure job to wait for an idle tor, got %v", batchIds(batches))
+	}
+	f.release(pending[3:4])
+	batches, _ = nextBatches(pending[4:], f, now)
+	if ids := batchIds(batches); len(ids) != 1 || ids[0][0] != 5 {
+		t.Fatalf("Expected job 5 alone, got %v", ids)
+	}
+	if !f.barrier {
+		t.Error("Expected the ensure job to hold the tor")
+	}
+}
+
+func TestBatchWindow(t *testing.T) {
+	now := time.Now()
+	pending := []*SapiConfigJobs{
+		batchJob(1, JobTrunk, Trunk{Vlan: 30, Index: 5}, now),
+	}
+	batches, wait := nextBatches(pending, newFlight(), now)
+	if len(batches) != 0 || wait != jobBatchWindow {
+		t.Errorf("Expected the batch open for %s, got %v %s", jobBatchWindow, batchIds(batches), wait)
+	}
+	batches, _ = nextBatches(pending, newFlight(), now.Add(jobBatchWindow))
+	if len(batches) != 1 {
+		t.Errorf("Expected the batch started after the window, got %v", batchIds(batches))
+	}
+}
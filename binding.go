@@ -0,0 +1,399 @@
+package sapi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	gosync "sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-xorm/xorm"
+)
+
+const (
+	NetTypeVxlan = "vxlan"
+	NetTypeVlan  = "vlan"
+	NetTypeFlat  = "flat"
+)
+
+var (
+	//tor vlan carrying flat networks, untagged on host interfaces
+	flatVlan = 1
+
+	//tor/vlan -> trunked provider vlan, see reserveProviderVlan
+	providerVlans = make(map[string]bool)
+	providerMu    gosync.Mutex
+
+	ErrorNoVlanId          = errors.New("No avaliable id to allocate")
+	ErrorProviderVlan      = errors.New("Invalid provider vlan")
+	ErrorProviderVlanInUse = errors.New("Provider vlan in use as local vlan")
+)
+
+//netType returns the binding type of a network, networks synced without
+//provider:network_type are vxlan.
+func netType(net *SapiProvisionedNets) string {
+	t := strings.ToLower(net.SegmentationType)
+	if t == "" {
+		return NetTypeVxlan
+	}
+	return t
+}
+
+//bindVxlan maps a local vlan to the network vni on every uplink of a port,
+//the local vlan is allocated on first use in the uplinks scope. The records
+//and the jobs are stored in one transaction.
+func bindVxlan(op, portId string, net *SapiProvisionedNets, uplinks []Uplink) (int, error) {
+	var vid uint32
+
+	allocTor, err := uplinkScope(uplinks, net.Shared)
+	if err != nil {
+		return 0, err
+	}
+	id := getId(allocTor, net.NetworkId, net.Shared)
+	vlansMu.Lock()
+	vlanId, allocated := tplvCache[id]
+	if !allocated {
+		if !allocateVlanId(allocTor, &vid, net.Shared) {
+			vlansMu.Unlock()
+			return 0, ErrorNoVlanId
+		}
+		vlanId = int(vid)
+		tplvCache[id] = vlanId
+	}
+	vlansMu.Unlock()
+
+	err = queueJobs(func(s *xorm.Session) error {
+		if !allocated {
+			//add corrsponding records in database
+			if err := addNewSva(s, net.NetworkId, allocTor, vlanId, net.Shared); err != nil {
+				return err
+			}
+			Log().WithFields(logrus.Fields{
+				"Tor":   allocTor,
+				"Vlan":  vlanId,
+				"Vxlan": net.SegmentationId,
+			}).Info("makeLocalvlanMap: New SapiVlanAllocations.")
+		}
+		for _, uplink := range uplinks {
+			bound, err := (&SapiPortVlanMapping{NetworkId: net.NetworkId, TorIp: uplink.Tor}).count(s)
+			if err != nil {
+				return err
+			}
+			if bound == 0 {
+				created, err := acquireVsi(s, uplink.Tor, net.SegmentationId)
+				if err != nil {
+					return err
+				}
+				if created {
+					Log().WithFields(logrus.Fields{
+						"Tor": uplink.Tor,
+						"Vsi": net.SegmentationId,
+					}).Info("makeLocalvlanMap: New SapiTorVsis.")
+				}
+			}
+			if err := addNewPvm(s, portId, net.NetworkId, uplink.Tor, vlanId, uplink.Index); err != nil {
+				return err
+			}
+			Log().WithFields(logrus.Fields{
+				"Tor":   uplink.Tor,
+				"Vxlan": net.SegmentationId,
+				"Vlan":  vlanId,
+				"Port":  portId,
+				"Index": uplink.Index,
+			}).Info("makeLocalvlanMap: New SapiPortVlanMapping.")
+
+			//config tor
+			if err := goVlanMap(s, op, uplink.Tor, vlanId, net.SegmentationId, uplink.Index); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		//the vlan allocated for the request is not recorded, give it back
+		if !allocated {
+			vlansMu.Lock()
+			releaseVlanId(allocTor, uint32(vlanId), net.Shared)
+			delete(tplvCache, id)
+			vlansMu.Unlock()
+		}
+		return 0, err
+	}
+	return vlanId, nil
+}
+
+//unbindVxlan removes the uplink mappings of a port, the network releases
+//the vsi with its last port on a tor and the vsi goes with the last network
+//using it. The local vlan goes with the last port in the allocation scope,
+//its pools are released once the transaction is committed.
+func unbindVxlan(op string, net *SapiProvisionedNets, pvms []*SapiPortVlanMapping) error {
+	allocTor := allocationTor(pvms[0].TorIp, net.Shared)
+	released := false
+	err := queueJobs(func(s *xorm.Session) error {
+		for _, pvm := range pvms {
+			var onlyIndex = true
+			bound, err := pvm.count(s)
+			if err != nil {
+				return err
+			}
+			if bound == 1 {
+				removed, err := releaseVsi(s, pvm.TorIp, net.SegmentationId)
+				if err != nil {
+					return err
+				}
+				if removed {
+					onlyIndex = false
+					Log().WithFields(logrus.Fields{
+						"Tor": pvm.TorIp,
+						"Vsi": net.SegmentationId,
+					}).Info("deleteLocalvlanMap: release SapiTorVsis.")
+				}
+			}
+			//delete port mapping record of this uplink
+			if _, err := s.Delete(pvm); err != nil {
+				return err
+			}
+			if err := goVlanUnmap(s, op, pvm.TorIp, pvm.VlanId, net.SegmentationId, pvm.Index, onlyIndex); err != nil {
+				return err
+			}
+		}
+
+		pvm := pvms[0]
+		left, err := pvm.countByTors(s, scopeTors(allocTor))
+		if err != nil || left > 0 {
+			return err
+		}
+		//delete corrsponding record in database
+		released = true
+		return deleteSva(s, pvm.NetworkId, allocTor, pvm.VlanId, net.Shared)
+	})
+	if err != nil || !released {
+		return err
+	}
+
+	pvm := pvms[0]
+	//release this vlan id
+	vlansMu.Lock()
+	releaseVlanId(allocTor, uint32(pvm.VlanId), net.Shared)
+	//delete key in tplvCache
+	delete(tplvCache, getId(allocTor, pvm.NetworkId, net.Shared))
+	vlansMu.Unlock()
+	Log().WithFields(logrus.Fields{
+		"Tor":   allocTor,
+		"Vxlan": net.SegmentationId,
+		"Vlan":  pvm.VlanId,
+	}).Info("deleteLocalvlanMap: release SapiVlanAllocations.")
+	return nil
+}
+
+//providerVlan returns the vlan a provider network is carried in on the
+//host interface and whether it is tagged, vlan 0 means untagged to the host.
+func providerVlan(net *SapiProvisionedNets) (vlan int, untagged bool, err error) {
+	if netType(net) == NetTypeFlat {
+		return flatVlan, true, nil
+	}
+	if net.SegmentationId < 1 || net.SegmentationId > 4094 {
+		return 0, false, ErrorProviderVlan
+	}
+	return net.SegmentationId, false, nil
+}
+
+//localVlanInUse reports whether vid is handed out from the local vlan pools
+//of a tor.
+func localVlanInUse(tor string, vid uint32) bool {
+	lv, ok := torPools(tor)
+	if !ok {
+		return false
+	}
+	for _, pool := range []*BitMap{lv.Shared, lv.Unshared} {
+		if vid >= pool.Min && vid <= pool.Max && pool.bitOn(vid) {
+			return true
+		}
+	}
+	return false
+}
+
+//reserveProviderVlan takes a trunked provider vlan out of the local vlan
+//pools of a tor, local vlans must not reuse it on the tor or its scopes.
+func reserveProviderVlan(tor string, vid uint32) {
+	providerMu.Lock()
+	providerVlans[tor+"/"+fmt.Sprint(vid)] = true
+	providerMu.Unlock()
+	if lv, ok := torPools(tor); ok {
+		lv.Shared.Setbit(vid)
+		lv.Unshared.Setbit(vid)
+	}
+}
+
+func providerReserved(tor string, vid uint32) bool {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	return providerVlans[tor+"/"+fmt.Sprint(vid)]
+}
+
+//releaseProviderVlan gives a provider vlan back to the pools of a tor once
+//no port mapping on the tor uses it.
+func releaseProviderVlan(tor string, vid uint32) {
+	if (&SapiPortVlanMapping{TorIp: tor, VlanId: int(vid)}).countByVlan() > 0 {
+		return
+	}
+	providerMu.Lock()
+	delete(providerVlans, tor+"/"+fmt.Sprint(vid))
+	providerMu.Unlock()
+	if lv, ok := torPools(tor); ok {
+		lv.Shared.UnsetBit(vid)
+		lv.Unshared.UnsetBit(vid)
+	}
+}
+
+//reserveProviderVlans reserves the vlans of every stored provider mapping
+func reserveProviderVlans() error {
+	nets := make([]*SapiProvisionedNets, 0)
+	if err := DB().Find(&nets); err != nil {
+		return err
+	}
+	ids := []string{}
+	for _, net := range nets {
+		if netType(net) == NetTypeVlan {
+			ids = append(ids, net.NetworkId)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	pvms := make([]*SapiPortVlanMapping, 0)
+	if err := DB().In("network_id", ids).Find(&pvms); err != nil {
+		return err
+	}
+	for _, pvm := range pvms {
+		reserveProviderVlan(pvm.TorIp, uint32(pvm.VlanId))
+	}
+	return nil
+}
+
+//bindProvider trunks a vlan or flat provider network onto every uplink of a
+//port, no local vlan or vsi is involved. A tagged vlan is reserved in the
+//local vlan pools of the uplink tors.
+func bindProvider(op, portId string, net *SapiProvisionedNets, uplinks []Uplink) (int, error) {
+	vlan, untagged, err := providerVlan(net)
+	if err != nil {
+		return 0, err
+	}
+	if !untagged {
+		vlansMu.Lock()
+		for _, uplink := range uplinks {
+			if localVlanInUse(uplink.Tor, uint32(vlan)) && !providerReserved(uplink.Tor, uint32(vlan)) {
+				vlansMu.Unlock()
+				return 0, ErrorProviderVlanInUse
+			}
+		}
+		for _, uplink := range uplinks {
+			reserveProviderVlan(uplink.Tor, uint32(vlan))
+		}
+		vlansMu.Unlock()
+	}
+
+	err = queueJobs(func(s *xorm.Session) error {
+		for _, uplink := range uplinks {
+			pvm := &SapiPortVlanMapping{NetworkId: net.NetworkId, TorIp: uplink.Tor, Index: uplink.Index}
+			trunked, err := pvm.countByIndex(s)
+			if err != nil {
+				return err
+			}
+			if err := addNewPvm(s, portId, net.NetworkId, uplink.Tor, vlan, uplink.Index); err != nil {
+				return err
+			}
+			Log().WithFields(logrus.Fields{
+				"Tor":      uplink.Tor,
+				"Vlan":     vlan,
+				"Untagged": untagged,
+				"Port":     portId,
+				"Index":    uplink.Index,
+			}).Info("makeLocalvlanMap: New provider SapiPortVlanMapping.")
+			if trunked == 0 {
+				if err := goTrunk(s, op, uplink.Tor, vlan, uplink.Index, untagged); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		//nothing was recorded, the reservations go unless other ports hold
+		//them
+		if !untagged {
+			vlansMu.Lock()
+			for _, uplink := range uplinks {
+				releaseProviderVlan(uplink.Tor, uint32(vlan))
+			}
+			vlansMu.Unlock()
+		}
+		return 0, err
+	}
+
+	if untagged {
+		return 0, nil
+	}
+	return vlan, nil
+}
+
+//unbindProvider removes the uplink mappings of a port, the vlan leaves the
+//interface with the last port of the network on it and the local vlan pools
+//with the last port on the tor.
+func unbindProvider(op string, net *SapiProvisionedNets, pvms []*SapiPortVlanMapping) error {
+	_, untagged, _ := providerVlan(net)
+	err := queueJobs(func(s *xorm.Session) error {
+		for _, pvm := range pvms {
+			trunked, err := pvm.countByIndex(s)
+			if err != nil {
+				return err
+			}
+			if _, err := s.Delete(pvm); err != nil {
+				return err
+			}
+			if trunked == 1 {
+				if err := goUntrunk(s, op, pvm.TorIp, pvm.VlanId, pvm.Index, untagged); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !untagged {
+		vlansMu.Lock()
+		for _, pvm := range pvms {
+			releaseProviderVlan(pvm.TorIp, uint32(pvm.VlanId))
+		}
+		vlansMu.Unlock()
+	}
+	return nil
+}
+
+func goTrunk(s *xorm.Session, op, tor string, vlanId, index int, untagged bool) error {
+	Log().WithFields(logrus.Fields{
+		"Tor":      tor,
+		"Vlan":     vlanId,
+		"Index":    index,
+		"Untagged": untagged,
+	}).Info("makeLocalvlanMap: queue trunk")
+	return enqueueJob(s, op, tor, JobTrunk, Trunk{
+		Vlan:     vlanId,
+		Index:    index,
+		Untagged: untagged})
+}
+
+func goUntrunk(s *xorm.Session, op, tor string, vlanId, index int, untagged bool) error {
+	Log().WithFields(logrus.Fields{
+		"Tor":      tor,
+		"Vlan":     vlanId,
+		"Index":    index,
+		"Untagged": untagged,
+	}).Info("deleteLocalvlanMap: queue trunk removal")
+	return enqueueJob(s, op, tor, JobUntrunk, Trunk{
+		Vlan:     vlanId,
+		Index:    index,
+		Untagged: untagged})
+}
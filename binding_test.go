@@ -0,0 +1,76 @@
+package sapi
+
+import (
+	"testing"
+)
+
+func TestNetType(t *testing.T) {
+	cases := map[string]string{
+		"":      NetTypeVxlan,
+		"vxlan": NetTypeVxlan,
+		"VLAN":  NetTypeVlan,
+		"flat":  NetTypeFlat,
+		"gre":   "gre",
+	}
+	for in, expected := range cases {
+		net := &SapiProvisionedNets{SegmentationType: in}
+		if got := netType(net); got != expected {
+			t.Errorf("Expected type %q for %q, got %q", expected, in, got)
+		}
+	}
+}
+
+func TestProviderVlan(t *testing.T) {
+	vlan, untagged, err := providerVlan(&SapiProvisionedNets{SegmentationType: "vlan", SegmentationId: 100})
+	if err != nil || vlan != 100 || untagged {
+		t.Errorf("Expected tagged vlan %d, got %d untagged %v (%v)", 100, vlan, untagged, err)
+	}
+	vlan, untagged, err = providerVlan(&SapiProvisionedNets{SegmentationType: "flat"})
+	if err != nil || vlan != flatVlan || !untagged {
+		t.Errorf("Expected untagged vlan %d, got %d untagged %v (%v)", flatVlan, vlan, untagged, err)
+	}
+	if _, _, err = providerVlan(&SapiProvisionedNets{SegmentationType: "vlan", SegmentationId: 5000}); err != ErrorProviderVlan {
+		t.Errorf("Expected error %s, got %v", ErrorProviderVlan, err)
+	}
+}
+
+func TestLocalVlanInUse(t *testing.T) {
+	saved := tplv
+	defer func() { tplv = saved }()
+	tplv = map[string]*LocalVlan{
+		"tor1": &LocalVlan{
+			Shared:   NewBitmap(uint32(vlanSharedMin), uint32(vlanSharedMax)),
+			Unshared: NewBitmap(uint32(vlanVpcMin), uint32(vlanVpcMax))},
+	}
+	tplv["tor1"].Unshared.Setbit(100)
+
+	if !localVlanInUse("tor1", 100) {
+		t.Errorf("Expected vlan %d in use", 100)
+	}
+	if localVlanInUse("tor1", 101) || localVlanInUse("tor1", 4001) || localVlanInUse("tor2", 100) {
+		t.Errorf("Unexpected vlan in use")
+	}
+}
+
+func TestReserveProviderVlan(t *testing.T) {
+	saved := tplv
+	defer func() { tplv = saved }()
+	tplv = map[string]*LocalVlan{
+		"tor1": &LocalVlan{
+			Shared:   NewBitmap(uint32(vlanSharedMin), uint32(vlanSharedMax)),
+			Unshared: NewBitmap(uint32(vlanVpcMin), uint32(vlanVpcMax))},
+	}
+
+	reserveProviderVlan("tor1", 100)
+	defer delete(providerVlans, "tor1/100")
+	if !localVlanInUse("tor1", 100) || !providerReserved("tor1", 100) {
+		t.Errorf("Expected provider vlan %d reserved", 100)
+	}
+	var vid uint32
+	if !allocateVlanId("tor1", &vid, false) || vid == 100 {
+		t.Errorf("Expected a local vlan other than %d, got %d", 100, vid)
+	}
+	if providerReserved("tor1", uint32(vid)) {
+		t.Errorf("Unexpected provider vlan %d", vid)
+	}
+}
@@ -47,10 +47,21 @@ func main() {
 			new(neutron.SapiTor),
 			new(neutron.SapiTorTunnels),
 			new(neutron.SapiTorVsis),
-			new(neutron.SapiVlanAllocations))
+			new(neutron.SapiTorSnmp),
+			new(neutron.SapiVlanAllocations),
+			new(neutron.SapiConfigJobs),
+			new(neutron.SapiOperations),
+			new(neutron.SapiTopologyEvents),
+			new(neutron.SapiTopologyLinks),
+			new(neutron.SapiHostRules),
+			new(neutron.SapiTunnelEndpoints))
 	}
 
 	if *create {
+		//one vsi row per tor and vni before its unique index is built,
+		//the server recounts the references on start
+		engine.Exec("DELETE v1 FROM sapi_tor_vsis v1 JOIN sapi_tor_vsis v2 " +
+			"ON v1.tor_ip = v2.tor_ip AND v1.vxlan = v2.vxlan AND v1.id > v2.id")
 		engine.Sync2(
 			new(neutron.SapiProvisionedNets),
 			new(neutron.SapiProvisionedSubnets),
@@ -60,6 +71,13 @@ func main() {
 			new(neutron.SapiTor),
 			new(neutron.SapiTorTunnels),
 			new(neutron.SapiTorVsis),
-			new(neutron.SapiVlanAllocations))
+			new(neutron.SapiTorSnmp),
+			new(neutron.SapiVlanAllocations),
+			new(neutron.SapiConfigJobs),
+			new(neutron.SapiOperations),
+			new(neutron.SapiTopologyEvents),
+			new(neutron.SapiTopologyLinks),
+			new(neutron.SapiHostRules),
+			new(neutron.SapiTunnelEndpoints))
 	}
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/wangtaoX/sapi/faketorconf"
+)
+
+//faketorconf serves the in-process torconf on its own for development,
+//point the sapi server at it with -torconf.
+func main() {
+	endpoints := flag.String("endpoints", "", "tunnel endpoints of switches outside sapi, ip[,ip]")
+	flag.Parse()
+
+	fake := faketorconf.NewServer()
+	defer fake.Close()
+	for _, ip := range strings.Split(*endpoints, ",") {
+		if ip != "" {
+			fake.AddEndpoint(ip)
+		}
+	}
+	fmt.Printf("Serving torconf on %s\n", fake.URL)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	<-stop
+}
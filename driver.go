@@ -0,0 +1,115 @@
+package sapi
+
+import (
+	"errors"
+	"fmt"
+	gosync "sync"
+)
+
+var (
+	//switch type -> driver, see RegisterDriver
+	drivers = make(map[string]SwitchDriver)
+	//driver of the switch types without one of their own
+	defaultDriver SwitchDriver
+	driversMu     gosync.RWMutex
+
+	ErrorNoDriver = errors.New("No driver for switch type")
+)
+
+//Tunnel is a vxlan tunnel configured on a switch
+type Tunnel struct {
+	Id  int    `json:"tunnel_id"`
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+//VlanMap maps a local vlan to a vni on one switch interface
+type VlanMap struct {
+	Vlan      int   `json:"vlan"`
+	Vxlan     int   `json:"vxlan"`
+	Index     int   `json:"index"`
+	TunnelIds []int `json:"tunnel_ids,omitempty"`
+}
+
+//Trunk carries a provider vlan on one switch interface
+type Trunk struct {
+	Vlan     int  `json:"vlan"`
+	Index    int  `json:"index"`
+	Untagged bool `json:"untagged"`
+}
+
+//SwitchConfig is what a driver reads back from a switch
+type SwitchConfig struct {
+	Tunnels  []Tunnel  `json:"tunnels"`
+	Vsis     []int     `json:"vsis"`
+	Mappings []VlanMap `json:"mappings"`
+	Trunks   []Trunk   `json:"trunks"`
+}
+
+//SwitchDriver configures one kind of switch, the driver of a tor is chosen
+//by SapiTor.Type.
+type SwitchDriver interface {
+	//TunnelEndpoints returns the vxlan tunnel sources the switch knows of
+	TunnelEndpoints(tor *SapiTor) ([]string, error)
+	//CreateTunnel builds a vxlan tunnel and returns its id on the switch
+	CreateTunnel(tor *SapiTor, src, dst string) (int, error)
+	DeleteTunnel(tor *SapiTor, id int) error
+	//EnsureVsi makes every vsi in vxlans use every tunnel in tunnels
+	EnsureVsi(tor *SapiTor, vxlans, tunnels []int) error
+	MapVlan(tor *SapiTor, m VlanMap) error
+	//UnmapVlan removes the mapping on the interface, and the vlan and vsi
+	//as well unless onlyIndex
+	UnmapVlan(tor *SapiTor, m VlanMap, onlyIndex bool) error
+	Trunk(tor *SapiTor, t Trunk) error
+	Untrunk(tor *SapiTor, t Trunk) error
+	ReadConfig(tor *SapiTor) (*SwitchConfig, error)
+}
+
+//Change is one mapping change of a batch, Kind is the job kind
+type Change struct {
+	Kind      string
+	Map       VlanMap
+	OnlyIndex bool
+	Trunk     Trunk
+}
+
+//BatchDriver is a driver that applies several mapping changes in one
+//transaction, all of them or none.
+type BatchDriver interface {
+	ApplyBatch(tor *SapiTor, changes []Change) error
+}
+
+//RegisterDriver makes a driver available for tors of switchType.
+func RegisterDriver(switchType string, d SwitchDriver) {
+	driversMu.Lock()
+	drivers[switchType] = d
+	driversMu.Unlock()
+}
+
+//RegisterDefaultDriver makes d serve the switch types no driver was
+//registered for.
+func RegisterDefaultDriver(d SwitchDriver) {
+	driversMu.Lock()
+	defaultDriver = d
+	driversMu.Unlock()
+}
+
+func hasDriver(switchType string) bool {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	_, ok := drivers[switchType]
+	return ok || defaultDriver != nil
+}
+
+func driverFor(tor *SapiTor) (SwitchDriver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	d, ok := drivers[tor.Type]
+	if !ok {
+		d = defaultDriver
+	}
+	if d == nil {
+		return nil, fmt.Errorf("%s: %s", ErrorNoDriver, tor.Type)
+	}
+	return d, nil
+}
@@ -0,0 +1,331 @@
+package sapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+//EventHostMoved is a host attached to other tors or interfaces, the vlan
+//mappings of its ports need rework.
+const (
+	EventHostAppeared    = "host_appeared"
+	EventHostDisappeared = "host_disappeared"
+	EventHostMoved       = "host_moved"
+	EventTorUnreachable  = "tor_unreachable"
+	EventTorReachable    = "tor_reachable"
+)
+
+var (
+	eventsPath = "/topology/events"
+	//history older than this is pruned
+	eventRetention = time.Hour * 24 * 7
+
+	webhooks        = []string{}
+	webhookAttempts = 5
+	webhookBackoff  = time.Second * 2
+	webhookTimeout  = time.Second * 10
+	//events waiting for delivery, events beyond are dropped
+	webhookQueue = make(chan *TopologyEvent, 1000)
+)
+
+//Attachment is a host interface behind a tor interface
+type Attachment struct {
+	Tor       string `json:"tor"`
+	Index     string `json:"index"`
+	Interface string `json:"interface,omitempty"`
+}
+
+//SapiTopologyEvents is the history of topology changes, From and To are
+//json lists of attachments.
+type SapiTopologyEvents struct {
+	Id      int64     `xorm:"pk autoincr"`
+	Kind    string    `xorm:"index varchar(32)"`
+	Host    string    `xorm:"index varchar(255)"`
+	Tor     string    `xorm:"index varchar(45)"`
+	From    string    `xorm:"'attached_from' text"`
+	To      string    `xorm:"'attached_to' text"`
+	Error   string    `xorm:"text"`
+	Created time.Time `xorm:"index created"`
+}
+
+//TopologyEvent is a topology change as logged, listed and delivered
+type TopologyEvent struct {
+	Id      int64        `json:"id"`
+	Kind    string       `json:"kind"`
+	Host    string       `json:"host,omitempty"`
+	Tor     string       `json:"tor,omitempty"`
+	From    []Attachment `json:"from,omitempty"`
+	To      []Attachment `json:"to,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Created time.Time    `json:"created"`
+}
+
+func (e *TopologyEvent) row() *SapiTopologyEvents {
+	from, _ := json.Marshal(e.From)
+	to, _ := json.Marshal(e.To)
+	return &SapiTopologyEvents{Kind: e.Kind, Host: e.Host, Tor: e.Tor,
+		From: string(from), To: string(to), Error: e.Error}
+}
+
+func (this *SapiTopologyEvents) event() *TopologyEvent {
+	e := &TopologyEvent{Id: this.Id, Kind: this.Kind, Host: this.Host, Tor: this.Tor,
+		Error: this.Error, Created: this.Created}
+	json.Unmarshal([]byte(this.From), &e.From)
+	json.Unmarshal([]byte(this.To), &e.To)
+	return e
+}
+
+//SetWebhooks sets the urls topology events are posted to and the attempts
+//of one delivery.
+func SetWebhooks(urls []string, attempts int, retention time.Duration) {
+	webhooks = []string{}
+	for _, url := range urls {
+		if url = strings.TrimSpace(url); url != "" {
+			webhooks = append(webhooks, url)
+		}
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	webhookAttempts = attempts
+	eventRetention = retention
+}
+
+//attachments returns the attachments of every host in the snapshot
+func attachments() map[string][]Attachment {
+	tpMu.RLock()
+	defer tpMu.RUnlock()
+	hosts := make(map[string][]Attachment)
+	for tor, items := range tp {
+		for _, item := range items {
+			if item.Host == "" {
+				continue
+			}
+			hosts[item.Host] = append(hosts[item.Host],
+				Attachment{Tor: tor, Index: item.Index, Interface: item.HostInterface})
+		}
+	}
+	for _, list := range hosts {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Tor != list[j].Tor {
+				return list[i].Tor < list[j].Tor
+			}
+			return list[i].Index < list[j].Index
+		})
+	}
+	return hosts
+}
+
+func sameAttachments(a, b []Attachment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Tor != b[i].Tor || a[i].Index != b[i].Index {
+			return false
+		}
+	}
+	return true
+}
+
+//diffTopology returns the host events between two snapshots in host order
+func diffTopology(before, after map[string][]Attachment) []*TopologyEvent {
+	names := []string{}
+	for host := range before {
+		names = append(names, host)
+	}
+	for host := range after {
+		if _, ok := before[host]; !ok {
+			names = append(names, host)
+		}
+	}
+	sort.Strings(names)
+
+	events := []*TopologyEvent{}
+	for _, host := range names {
+		from, to := before[host], after[host]
+		e := &TopologyEvent{Host: host, From: from, To: to}
+		switch {
+		case len(from) == 0:
+			e.Kind = EventHostAppeared
+		case len(to) == 0:
+			e.Kind = EventHostDisappeared
+		case !sameAttachments(from, to):
+			e.Kind = EventHostMoved
+		default:
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+//emitEvents logs, records and queues the events for the webhooks
+func emitEvents(events []*TopologyEvent) {
+	for _, e := range events {
+		row := e.row()
+		if _, err := DB().Insert(row); err != nil {
+			Log().WithFields(logrus.Fields{"Error": err}).Error("emitEvents: insert error")
+		}
+		e.Id, e.Created = row.Id, row.Created
+		if e.Created.IsZero() {
+			e.Created = time.Now()
+		}
+		Log().WithFields(logrus.Fields{
+			"Event": e.Kind,
+			"Host":  e.Host,
+			"Tor":   e.Tor,
+			"From":  e.From,
+			"To":    e.To,
+		}).Info("topology event")
+		if len(webhooks) == 0 {
+			continue
+		}
+		select {
+		case webhookQueue <- e:
+		default:
+			Log().WithFields(logrus.Fields{"Event": e.Id}).Error("emitEvents: webhook queue full, event not delivered")
+		}
+	}
+}
+
+//deliver posts an event to a webhook, failures are retried with a doubling
+//delay.
+func deliver(url string, e *TopologyEvent) error {
+	var err error
+	delay := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		var resp *http.Response
+		resp, _, err = NewHttpAgent().Timeout(webhookTimeout).Post(url).ReqData(e).Issue()
+		if err == nil && resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("webhook %s: %s", url, resp.Status)
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+//GoWebhooks delivers queued events to every webhook, a slow webhook holds
+//back only its own deliveries.
+func GoWebhooks(done chan struct{}) {
+	if len(webhooks) == 0 {
+		return
+	}
+	queues := make(map[string]chan *TopologyEvent)
+	for _, url := range webhooks {
+		queue := make(chan *TopologyEvent, cap(webhookQueue))
+		queues[url] = queue
+		go func(url string, queue chan *TopologyEvent) {
+			for {
+				select {
+				case e := <-queue:
+					if err := deliver(url, e); err != nil {
+						Log().WithFields(logrus.Fields{
+							"Webhook": url,
+							"Event":   e.Id,
+							"Error":   err,
+						}).Error("GoWebhooks: event not delivered")
+					}
+				case <-done:
+					return
+				}
+			}
+		}(url, queue)
+	}
+	go func() {
+		for {
+			select {
+			case e := <-webhookQueue:
+				for url, queue := range queues {
+					select {
+					case queue <- e:
+					default:
+						Log().WithFields(logrus.Fields{
+							"Webhook": url,
+							"Event":   e.Id,
+						}).Error("GoWebhooks: webhook queue full, event not delivered")
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+//pruneEvents drops the history older than eventRetention
+func pruneEvents() {
+	if eventRetention <= 0 {
+		return
+	}
+	before := time.Now().Add(-eventRetention)
+	if _, err := DB().Where("created<?", before).Delete(new(SapiTopologyEvents)); err != nil {
+		Log().WithFields(logrus.Fields{"Error": err}).Error("pruneEvents: delete error")
+	}
+}
+
+//listEvents queries the event history, newest first. Filters: kind, host,
+//tor, since (RFC 3339) and limit.
+func listEvents(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	session := DB().Where("1=1")
+	if kind := q.Get("kind"); kind != "" {
+		session = session.And("kind=?", kind)
+	}
+	if host := q.Get("host"); host != "" {
+		session = session.And("host=?", host)
+	}
+	if tor := q.Get("tor"); tor != "" {
+		like := "%\"tor\":\"" + tor + "\"%"
+		session = session.And("(tor=? OR attached_from LIKE ? OR attached_to LIKE ?)", tor, like, like)
+	}
+	if since := q.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			HttpError(rw, "Bad Request", nil, http.StatusBadRequest)
+			return
+		}
+		session = session.And("created>=?", t)
+	}
+	limit := 500
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			HttpError(rw, "Bad Request", nil, http.StatusBadRequest)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	rows := make([]*SapiTopologyEvents, 0)
+	if err := session.Desc("id").Limit(limit).Find(&rows); err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	events := []*TopologyEvent{}
+	for _, row := range rows {
+		events = append(events, row.event())
+	}
+	writeJson(rw, struct {
+		Events []*TopologyEvent `json:"events"`
+	}{events})
+}
+
+func init() {
+	Regist(MakeApiEndpoints("GET", eventsPath, http.HandlerFunc(listEvents)))
+}
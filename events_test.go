@@ -0,0 +1,65 @@
+package sapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+func TestDiffTopology(t *testing.T) {
+	before := map[string][]Attachment{
+		"host1": {{Tor: "tor1", Index: "1"}},
+		"host2": {{Tor: "tor1", Index: "2"}},
+		"host3": {{Tor: "tor1", Index: "3"}, {Tor: "tor2", Index: "3"}},
+	}
+	after := map[string][]Attachment{
+		"host1": {{Tor: "tor1", Index: "1", Interface: "eth1"}},
+		"host3": {{Tor: "tor1", Index: "3"}, {Tor: "tor2", Index: "4"}},
+		"host4": {{Tor: "tor2", Index: "5"}},
+	}
+	events := diffTopology(before, after)
+	expected := []struct{ host, kind string }{
+		{"host2", EventHostDisappeared},
+		{"host3", EventHostMoved},
+		{"host4", EventHostAppeared},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+	for i, e := range expected {
+		if events[i].Host != e.host || events[i].Kind != e.kind {
+			t.Errorf("Expected %s %s, got %s %s", e.host, e.kind, events[i].Host, events[i].Kind)
+		}
+	}
+	if moved := events[1]; len(moved.From) != 2 || moved.To[1].Index != "4" {
+		t.Errorf("Expected host3 moved to index 4 of tor2, got %+v", moved)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	savedAttempts, savedBackoff := webhookAttempts, webhookBackoff
+	defer func() { webhookAttempts, webhookBackoff = savedAttempts, savedBackoff }()
+	webhookAttempts, webhookBackoff = 3, time.Millisecond
+
+	var mu gosync.Mutex
+	calls := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if calls++; calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer s.Close()
+
+	e := &TopologyEvent{Kind: EventHostAppeared, Host: "host1"}
+	if err := deliver(s.URL, e); err != nil || calls != 3 {
+		t.Errorf("Expected the event delivered on the 3rd attempt, got %d %v", calls, err)
+	}
+	calls = -10
+	if err := deliver(s.URL, e); err == nil {
+		t.Error("Expected the delivery to give up after 3 attempts")
+	}
+}
@@ -0,0 +1,311 @@
+package sapi
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	NodeTor    = "tor"
+	NodeSwitch = "switch"
+	NodeHost   = "host"
+	NodeOther  = "other"
+)
+
+var (
+	graphPath = "/topology/graph"
+	//shortest paths returned by one path query
+	graphMaxPaths = 32
+)
+
+//GraphNode is a device of the fabric, Polled tells whether sapi polls it
+type GraphNode struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Ip     string `json:"ip,omitempty"`
+	Polled bool   `json:"polled"`
+}
+
+//GraphLink is a cable between two node ports
+type GraphLink struct {
+	From     string `json:"from"`
+	FromPort string `json:"from_port"`
+	To       string `json:"to"`
+	ToPort   string `json:"to_port"`
+}
+
+//FabricGraph is the fabric as told by the lldp neighbors of the tors
+type FabricGraph struct {
+	Nodes []*GraphNode `json:"nodes"`
+	Links []*GraphLink `json:"links"`
+}
+
+//GraphHop is a step of a path and the parallel links it can take
+type GraphHop struct {
+	From  string       `json:"from"`
+	To    string       `json:"to"`
+	Links []*GraphLink `json:"links"`
+}
+
+func neighborKind(n *Neighbor) string {
+	if n.Host {
+		return NodeHost
+	}
+	for _, c := range n.Capabilities {
+		if c == "bridge" || c == "router" {
+			return NodeSwitch
+		}
+	}
+	return NodeOther
+}
+
+//peer returns the other end of a link seen from node
+func (l *GraphLink) peer(node string) (string, string, string) {
+	if l.From == node {
+		return l.To, l.FromPort, l.ToPort
+	}
+	return l.From, l.ToPort, l.FromPort
+}
+
+//buildGraph turns the neighbors of every polled tor into one graph. A
+//neighbor is the polled tor with its management ip or sysname, others are
+//told apart by sysname, then mac. A link seen from both ends counts once.
+func buildGraph(every map[string][]*Neighbor) *FabricGraph {
+	tors := []string{}
+	for tor := range every {
+		tors = append(tors, tor)
+	}
+	sort.Strings(tors)
+
+	nodes := make(map[string]*GraphNode)
+	byIp := make(map[string]string)
+	byName := make(map[string]string)
+	for _, tor := range tors {
+		node := &GraphNode{Id: tor, Name: tor, Kind: NodeTor, Ip: tor, Polled: true}
+		for _, n := range every[tor] {
+			if n.TorName != "" {
+				node.Name = n.TorName
+				byName[n.TorName] = tor
+			}
+			if n.Tor != "" {
+				byIp[n.Tor] = tor
+			}
+		}
+		nodes[tor] = node
+		byIp[tor] = tor
+	}
+
+	g := &FabricGraph{Nodes: []*GraphNode{}, Links: []*GraphLink{}}
+	seen := make(map[string]bool)
+	for _, tor := range tors {
+		for _, n := range every[tor] {
+			id, ok := byIp[n.Ip]
+			if !ok {
+				id, ok = byName[n.SysName]
+			}
+			if !ok {
+				id = n.SysName
+				if id == "" {
+					id = n.Mac
+				}
+				if id == "" {
+					id = tor + "/" + n.Index
+				}
+				if _, exists := nodes[id]; !exists {
+					nodes[id] = &GraphNode{Id: id, Name: n.SysName, Kind: neighborKind(n), Ip: n.Ip}
+				}
+			}
+			link := &GraphLink{From: tor, FromPort: n.Port, To: id, ToPort: n.RemotePort}
+			key := fmt.Sprintf("%s\x00%s\x00%s\x00%s", link.From, link.FromPort, link.To, link.ToPort)
+			back := fmt.Sprintf("%s\x00%s\x00%s\x00%s", link.To, link.ToPort, link.From, link.FromPort)
+			if seen[key] || seen[back] {
+				continue
+			}
+			seen[key] = true
+			g.Links = append(g.Links, link)
+		}
+	}
+
+	for _, node := range nodes {
+		g.Nodes = append(g.Nodes, node)
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Id < g.Nodes[j].Id })
+	sort.SliceStable(g.Links, func(i, j int) bool {
+		if g.Links[i].From != g.Links[j].From {
+			return g.Links[i].From < g.Links[j].From
+		}
+		return g.Links[i].FromPort < g.Links[j].FromPort
+	})
+	return g
+}
+
+//fabricGraph is the graph of the last polls
+func fabricGraph() *FabricGraph {
+	every := make(map[string][]*Neighbor)
+	neighborsMu.Lock()
+	for tor, list := range neighbors {
+		every[tor] = list
+	}
+	neighborsMu.Unlock()
+	return buildGraph(every)
+}
+
+func (g *FabricGraph) node(id string) *GraphNode {
+	for _, node := range g.Nodes {
+		if node.Id == id {
+			return node
+		}
+	}
+	return nil
+}
+
+//linksOf returns the links of a node, seen from the node
+func (g *FabricGraph) linksOf(id string) []*GraphLink {
+	links := []*GraphLink{}
+	for _, l := range g.Links {
+		if l.From != id && l.To != id {
+			continue
+		}
+		peer, port, peerPort := l.peer(id)
+		links = append(links, &GraphLink{From: id, FromPort: port, To: peer, ToPort: peerPort})
+	}
+	return links
+}
+
+//paths returns the shortest paths from one node to another, at most max.
+//Parallel links between two nodes are one hop.
+func (g *FabricGraph) paths(from, to string, max int) [][]*GraphHop {
+	adj := make(map[string]map[string][]*GraphLink)
+	for _, l := range g.Links {
+		for _, end := range []string{l.From, l.To} {
+			peer, port, peerPort := l.peer(end)
+			if adj[end] == nil {
+				adj[end] = make(map[string][]*GraphLink)
+			}
+			adj[end][peer] = append(adj[end][peer],
+				&GraphLink{From: end, FromPort: port, To: peer, ToPort: peerPort})
+		}
+	}
+
+	//breadth first, every node keeps the nodes it is reached from
+	dist := map[string]int{from: 0}
+	parents := make(map[string][]string)
+	queue := []string{from}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if cur == to {
+			break
+		}
+		peers := []string{}
+		for peer := range adj[cur] {
+			peers = append(peers, peer)
+		}
+		sort.Strings(peers)
+		for _, peer := range peers {
+			d, ok := dist[peer]
+			if !ok {
+				dist[peer] = dist[cur] + 1
+				queue = append(queue, peer)
+			} else if d != dist[cur]+1 {
+				continue
+			}
+			parents[peer] = append(parents[peer], cur)
+		}
+	}
+
+	paths := [][]*GraphHop{}
+	if _, ok := dist[to]; !ok || from == to {
+		return paths
+	}
+	var walk func(node string, tail []*GraphHop)
+	walk = func(node string, tail []*GraphHop) {
+		if len(paths) >= max {
+			return
+		}
+		if node == from {
+			paths = append(paths, tail)
+			return
+		}
+		for _, parent := range parents[node] {
+			hop := &GraphHop{From: parent, To: node, Links: adj[parent][node]}
+			walk(parent, append([]*GraphHop{hop}, tail...))
+		}
+	}
+	walk(to, []*GraphHop{})
+	return paths
+}
+
+//dot writes the graph in graphviz dot, link ends are labeled with ports
+func (g *FabricGraph) dot() []byte {
+	var b bytes.Buffer
+	shapes := map[string]string{NodeTor: "box", NodeSwitch: "box", NodeHost: "ellipse", NodeOther: "diamond"}
+	b.WriteString("graph fabric {\n")
+	for _, node := range g.Nodes {
+		fmt.Fprintf(&b, "  %q [label=%q shape=%s];\n", node.Id, node.Name, shapes[node.Kind])
+	}
+	for _, l := range g.Links {
+		fmt.Fprintf(&b, "  %q -- %q [taillabel=%q headlabel=%q];\n", l.From, l.To, l.FromPort, l.ToPort)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+//showGraph serves the fabric graph, as dot with format=dot
+func showGraph(rw http.ResponseWriter, r *http.Request) {
+	g := fabricGraph()
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJson(rw, g)
+	case "dot":
+		rw.Header().Set("Content/Type", "text/vnd.graphviz")
+		rw.Write(g.dot())
+	default:
+		HttpError(rw, "Bad Request", nil, http.StatusBadRequest)
+	}
+}
+
+//showNodeLinks lists the links of a node, eg the spine links of a tor
+func showNodeLinks(rw http.ResponseWriter, r *http.Request) {
+	g := fabricGraph()
+	node := g.node(mux.Vars(r)["id"])
+	if node == nil {
+		HttpError(rw, "Not Found", nil, http.StatusNotFound)
+		return
+	}
+	writeJson(rw, struct {
+		Node  *GraphNode   `json:"node"`
+		Links []*GraphLink `json:"links"`
+	}{node, g.linksOf(node.Id)})
+}
+
+//showPaths answers which links traffic between two nodes may take
+func showPaths(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	if from == "" || to == "" {
+		HttpError(rw, "Bad Request", nil, http.StatusBadRequest)
+		return
+	}
+	g := fabricGraph()
+	if g.node(from) == nil || g.node(to) == nil {
+		HttpError(rw, "Not Found", nil, http.StatusNotFound)
+		return
+	}
+	writeJson(rw, struct {
+		From  string        `json:"from"`
+		To    string        `json:"to"`
+		Paths [][]*GraphHop `json:"paths"`
+	}{from, to, g.paths(from, to, graphMaxPaths)})
+}
+
+func init() {
+	Regist(MakeApiEndpoints("GET", graphPath, http.HandlerFunc(showGraph)))
+	Regist(MakeApiEndpoints("GET", graphPath+"/nodes/{id}/links", http.HandlerFunc(showNodeLinks)))
+	Regist(MakeApiEndpoints("GET", graphPath+"/paths", http.HandlerFunc(showPaths)))
+}
@@ -0,0 +1,95 @@
+package sapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func testFabric() map[string][]*Neighbor {
+	spine := []string{"bridge", "router"}
+	return map[string][]*Neighbor{
+		"10.0.0.1": {
+			{Tor: "10.0.0.1", TorName: "tor-a", Port: "xe1", RemotePort: "xe10", Ip: "10.0.1.1", SysName: "spine-1", Capabilities: spine},
+			{Tor: "10.0.0.1", TorName: "tor-a", Port: "xe2", RemotePort: "xe10", Ip: "10.0.1.2", SysName: "spine-2", Capabilities: spine},
+			{Tor: "10.0.0.1", TorName: "tor-a", Port: "ge1", RemotePort: "eth0", SysName: "host-1", Host: true},
+		},
+		"10.0.0.2": {
+			{Tor: "10.0.0.2", TorName: "tor-b", Port: "xe1", RemotePort: "xe11", Ip: "10.0.1.1", SysName: "spine-1", Capabilities: spine},
+			{Tor: "10.0.0.2", TorName: "tor-b", Port: "xe2", RemotePort: "xe11", Ip: "10.0.1.2", SysName: "spine-2", Capabilities: spine},
+			{Tor: "10.0.0.2", TorName: "tor-b", Port: "xe9", RemotePort: "xe9", SysName: "tor-a"},
+		},
+		"10.0.1.1": {
+			{Tor: "10.0.1.1", TorName: "spine-1", Port: "xe10", RemotePort: "xe1", Ip: "10.0.0.1", SysName: "tor-a"},
+		},
+	}
+}
+
+func TestBuildGraph(t *testing.T) {
+	g := buildGraph(testFabric())
+
+	kinds := map[string]string{}
+	for _, node := range g.Nodes {
+		kinds[node.Id] = node.Kind
+	}
+	expected := map[string]string{"10.0.0.1": NodeTor, "10.0.0.2": NodeTor, "10.0.1.1": NodeTor,
+		"spine-2": NodeSwitch, "host-1": NodeHost}
+	if len(kinds) != len(expected) {
+		t.Errorf("Expected %d nodes, got %v", len(expected), kinds)
+	}
+	for id, kind := range expected {
+		if kinds[id] != kind {
+			t.Errorf("Expected %s a %s, got %s", id, kind, kinds[id])
+		}
+	}
+	//tor-a to spine-1 is seen from both ends
+	if len(g.Links) != 6 {
+		t.Errorf("Expected 6 links, got %d", len(g.Links))
+	}
+
+	links := g.linksOf("10.0.0.1")
+	if len(links) != 4 {
+		t.Errorf("Expected 4 links of tor-a, got %d", len(links))
+	}
+	for _, l := range links {
+		if l.From != "10.0.0.1" {
+			t.Errorf("Expected links seen from tor-a, got %v", l)
+		}
+	}
+
+	dot := string(g.dot())
+	if !strings.HasPrefix(dot, "graph fabric {") ||
+		!strings.Contains(dot, `"10.0.0.1" -- "spine-2" [taillabel="xe2" headlabel="xe10"]`) {
+		t.Errorf("Expected a dot graph, got %s", dot)
+	}
+}
+
+func TestGraphPaths(t *testing.T) {
+	g := buildGraph(testFabric())
+
+	paths := g.paths("host-1", "10.0.1.1", 32)
+	if len(paths) != 1 || len(paths[0]) != 2 || paths[0][1].From != "10.0.0.1" {
+		t.Errorf("Expected host-1 to spine-1 through tor-a, got %v", paths)
+	}
+
+	//tor-a and tor-b are cabled directly besides the spines
+	paths = g.paths("10.0.0.1", "10.0.0.2", 32)
+	if len(paths) != 1 || len(paths[0]) != 1 || len(paths[0][0].Links) != 1 {
+		t.Errorf("Expected the direct link, got %v", paths)
+	}
+
+	paths = g.paths("host-1", "spine-2", 32)
+	if len(paths) != 1 || paths[0][1].Links[0].FromPort != "xe2" {
+		t.Errorf("Expected host-1 to spine-2 over xe2, got %v", paths)
+	}
+
+	paths = g.paths("10.0.1.1", "spine-2", 32)
+	if len(paths) != 2 {
+		t.Errorf("Expected 2 paths from spine-1 to spine-2, got %d", len(paths))
+	}
+	if len(g.paths("10.0.1.1", "spine-2", 1)) != 1 {
+		t.Errorf("Expected the paths limited")
+	}
+	if len(g.paths("host-1", "nowhere", 32)) != 0 {
+		t.Errorf("Expected no path to an unknown node")
+	}
+}
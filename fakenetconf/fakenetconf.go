@@ -0,0 +1,568 @@
+//Package fakenetconf is a local NETCONF server for tests and development.
+//It serves RFC 6241 over ssh with running and candidate datastores holding
+//the sapi vxlan model, and lets tests inject rpc errors.
+package fakenetconf
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	base = "urn:ietf:params:xml:ns:netconf:base:1.0"
+	eom  = "]]>]]>"
+)
+
+//Tunnel is a vxlan tunnel
+type Tunnel struct {
+	Id          int
+	Source      string
+	Destination string
+}
+
+//Mapping maps a vlan to a vni on an interface
+type Mapping struct {
+	Index int
+	Vlan  int
+	Vxlan int
+}
+
+//Trunk carries a vlan on an interface
+type Trunk struct {
+	Index    int
+	Vlan     int
+	Untagged bool
+}
+
+//Datastore is one NETCONF configuration datastore
+type Datastore struct {
+	Tunnels  map[int]Tunnel
+	Vsis     map[int][]int
+	Mappings map[Mapping]bool
+	Trunks   map[Trunk]bool
+}
+
+func newDatastore() *Datastore {
+	return &Datastore{
+		Tunnels:  make(map[int]Tunnel),
+		Vsis:     make(map[int][]int),
+		Mappings: make(map[Mapping]bool),
+		Trunks:   make(map[Trunk]bool),
+	}
+}
+
+func (d *Datastore) copy() *Datastore {
+	c := newDatastore()
+	for k, v := range d.Tunnels {
+		c.Tunnels[k] = v
+	}
+	for k, v := range d.Vsis {
+		c.Vsis[k] = append([]int(nil), v...)
+	}
+	for k, v := range d.Mappings {
+		c.Mappings[k] = v
+	}
+	for k, v := range d.Trunks {
+		c.Trunks[k] = v
+	}
+	return c
+}
+
+//wire format of the model, operation is the RFC 6241 edit operation
+type config struct {
+	XMLName  xml.Name  `xml:"urn:sapi:params:xml:ns:yang:vxlan vxlan"`
+	Tunnels  []tunnel  `xml:"tunnels>tunnel"`
+	Vsis     []vsi     `xml:"vsis>vsi"`
+	Mappings []mapping `xml:"mappings>mapping"`
+	Trunks   []trunk   `xml:"trunks>trunk"`
+}
+
+type tunnel struct {
+	Op  string `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 operation,attr,omitempty"`
+	Id  int    `xml:"id"`
+	Src string `xml:"source,omitempty"`
+	Dst string `xml:"destination,omitempty"`
+}
+
+type vsi struct {
+	Op      string `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 operation,attr,omitempty"`
+	Vxlan   int    `xml:"vxlan"`
+	Tunnels []int  `xml:"tunnel"`
+}
+
+type mapping struct {
+	Op    string `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 operation,attr,omitempty"`
+	Index int    `xml:"index"`
+	Vlan  int    `xml:"vlan"`
+	Vxlan int    `xml:"vxlan"`
+}
+
+type trunk struct {
+	Op       string `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 operation,attr,omitempty"`
+	Index    int    `xml:"index"`
+	Vlan     int    `xml:"vlan"`
+	Untagged bool   `xml:"untagged"`
+}
+
+type target struct {
+	Candidate *struct{} `xml:"candidate"`
+	Running   *struct{} `xml:"running"`
+}
+
+type rpc struct {
+	MessageId  string  `xml:"message-id,attr"`
+	Lock       *target `xml:"lock>target"`
+	Unlock     *target `xml:"unlock>target"`
+	GetConfig  *target `xml:"get-config>source"`
+	EditConfig *struct {
+		Target target `xml:"target"`
+		Config config `xml:"config>vxlan"`
+	} `xml:"edit-config"`
+	Commit  *struct{} `xml:"commit"`
+	Discard *struct{} `xml:"discard-changes"`
+	Close   *struct{} `xml:"close-session"`
+}
+
+func (r *rpc) name() string {
+	switch {
+	case r.Lock != nil:
+		return "lock"
+	case r.Unlock != nil:
+		return "unlock"
+	case r.GetConfig != nil:
+		return "get-config"
+	case r.EditConfig != nil:
+		return "edit-config"
+	case r.Commit != nil:
+		return "commit"
+	case r.Discard != nil:
+		return "discard-changes"
+	case r.Close != nil:
+		return "close-session"
+	}
+	return ""
+}
+
+//rpcError is an <rpc-error> answer
+type rpcError struct {
+	tag     string
+	message string
+}
+
+func (e *rpcError) Error() string {
+	return e.tag + ": " + e.message
+}
+
+//Server is a fake NETCONF server
+type Server struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+
+	mu        sync.Mutex
+	running   *Datastore
+	candidate *Datastore
+	lockedBy  int
+	sessions  int
+	commits   int
+	failures  map[string]int
+	rpcs      []string
+	conns     map[net.Conn]bool
+}
+
+//NewServer listens on a local port for ssh logins of user with password,
+//Close it when done.
+func NewServer(user, password string) (*Server, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener:  l,
+		hostKey:   signer.PublicKey(),
+		running:   newDatastore(),
+		candidate: newDatastore(),
+		failures:  make(map[string]int),
+		conns:     make(map[net.Conn]bool),
+	}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == user && string(pass) == password {
+				return nil, nil
+			}
+			return nil, errors.New("fakenetconf: bad credentials")
+		},
+	}
+	s.config.AddHostKey(signer)
+	go s.accept()
+	return s, nil
+}
+
+//Port is the ssh port the server listens on.
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+//HostKey is the ssh host key of the server, clients check it with
+//ssh.FixedHostKey.
+func (s *Server) HostKey() ssh.PublicKey {
+	return s.hostKey
+}
+
+//Close stops the server and drops every session.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+}
+
+//FailNext answers the next n rpcs named op, e.g. "commit", with an
+//rpc-error.
+func (s *Server) FailNext(op string, n int) {
+	s.mu.Lock()
+	s.failures[op] = n
+	s.mu.Unlock()
+}
+
+//Running returns a copy of the running datastore.
+func (s *Server) Running() *Datastore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running.copy()
+}
+
+//Candidate returns a copy of the candidate datastore.
+func (s *Server) Candidate() *Datastore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.candidate.copy()
+}
+
+//Commits counts successful commits.
+func (s *Server) Commits() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commits
+}
+
+//Rpcs lists the rpcs received in order.
+func (s *Server) Rpcs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.rpcs...)
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range chReqs {
+				//subsystem payload is a length prefixed name
+				if req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "netconf" {
+					req.Reply(true, nil)
+					go s.serve(ch)
+					continue
+				}
+				req.Reply(false, nil)
+			}
+		}()
+	}
+}
+
+func read(r *bufio.Reader) ([]byte, error) {
+	var msg []byte
+	for {
+		chunk, err := r.ReadBytes('>')
+		msg = append(msg, chunk...)
+		if bytes.HasSuffix(msg, []byte(eom)) {
+			return msg[:len(msg)-len(eom)], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//serve runs one NETCONF session on ch
+func (s *Server) serve(ch ssh.Channel) {
+	defer ch.Close()
+	s.mu.Lock()
+	s.sessions++
+	id := s.sessions
+	s.mu.Unlock()
+	defer s.unlock(id)
+
+	fmt.Fprintf(ch, `<hello xmlns="%s"><capabilities>`+
+		`<capability>urn:ietf:params:netconf:base:1.0</capability>`+
+		`<capability>urn:ietf:params:netconf:capability:candidate:1.0</capability>`+
+		`</capabilities><session-id>%d</session-id></hello>%s`, base, id, eom)
+	r := bufio.NewReader(ch)
+	if _, err := read(r); err != nil {
+		return
+	}
+	for {
+		raw, err := read(r)
+		if err != nil {
+			return
+		}
+		req := new(rpc)
+		var body string
+		if err := xml.Unmarshal(raw, req); err != nil {
+			body = errorReply(&rpcError{"malformed-message", err.Error()})
+		} else {
+			body = s.exec(id, req)
+		}
+		fmt.Fprintf(ch, `<rpc-reply message-id="%s" xmlns="%s">%s</rpc-reply>%s`, req.MessageId, base, body, eom)
+		if req.Close != nil {
+			return
+		}
+	}
+}
+
+func errorReply(e *rpcError) string {
+	var b bytes.Buffer
+	b.WriteString("<rpc-error><error-type>application</error-type><error-tag>")
+	xml.EscapeText(&b, []byte(e.tag))
+	b.WriteString("</error-tag><error-severity>error</error-severity><error-message>")
+	xml.EscapeText(&b, []byte(e.message))
+	b.WriteString("</error-message></rpc-error>")
+	return b.String()
+}
+
+func (s *Server) exec(id int, req *rpc) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op := req.name()
+	s.rpcs = append(s.rpcs, op)
+	if n := s.failures[op]; n != 0 {
+		s.failures[op] = n - 1
+		return errorReply(&rpcError{"operation-failed", "injected failure"})
+	}
+
+	var err *rpcError
+	switch op {
+	case "lock":
+		if req.Lock.Candidate == nil {
+			err = &rpcError{"operation-not-supported", "only the candidate is lockable"}
+		} else if s.lockedBy != 0 && s.lockedBy != id {
+			err = &rpcError{"lock-denied", fmt.Sprintf("locked by session %d", s.lockedBy)}
+		} else {
+			s.lockedBy = id
+		}
+	case "unlock":
+		if s.lockedBy != id {
+			err = &rpcError{"operation-failed", "not locked by this session"}
+		} else {
+			s.lockedBy = 0
+		}
+	case "get-config":
+		store := s.running
+		if req.GetConfig.Candidate != nil {
+			store = s.candidate
+		}
+		data, merr := xml.Marshal(wire(store))
+		if merr != nil {
+			err = &rpcError{"operation-failed", merr.Error()}
+			break
+		}
+		return "<data>" + string(data) + "</data>"
+	case "edit-config":
+		if req.EditConfig.Target.Candidate == nil {
+			err = &rpcError{"operation-not-supported", "edit the candidate and commit"}
+		} else if s.lockedBy != 0 && s.lockedBy != id {
+			err = &rpcError{"in-use", fmt.Sprintf("locked by session %d", s.lockedBy)}
+		} else {
+			store := s.candidate.copy()
+			if err = apply(store, &req.EditConfig.Config); err == nil {
+				s.candidate = store
+			}
+		}
+	case "commit":
+		s.running = s.candidate.copy()
+		s.commits++
+	case "discard-changes":
+		s.candidate = s.running.copy()
+	case "close-session":
+	default:
+		err = &rpcError{"operation-not-supported", "unknown rpc"}
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+	return "<ok/>"
+}
+
+//unlock releases the candidate lock of a finished session, discarding
+//what it did not commit
+func (s *Server) unlock(id int) {
+	s.mu.Lock()
+	if s.lockedBy == id {
+		s.lockedBy = 0
+		s.candidate = s.running.copy()
+	}
+	s.mu.Unlock()
+}
+
+func deleting(op string) bool {
+	return op == "delete" || op == "remove"
+}
+
+//apply merges conf into d, delete fails on missing data, remove does not
+func apply(d *Datastore, conf *config) *rpcError {
+	for _, t := range conf.Tunnels {
+		_, has := d.Tunnels[t.Id]
+		switch {
+		case t.Op == "delete" && !has:
+			return &rpcError{"data-missing", fmt.Sprintf("tunnel %d", t.Id)}
+		case deleting(t.Op):
+			delete(d.Tunnels, t.Id)
+		case t.Op == "create" && has:
+			return &rpcError{"data-exists", fmt.Sprintf("tunnel %d", t.Id)}
+		default:
+			d.Tunnels[t.Id] = Tunnel{Id: t.Id, Source: t.Src, Destination: t.Dst}
+		}
+	}
+	for _, v := range conf.Vsis {
+		tunnels, has := d.Vsis[v.Vxlan]
+		switch {
+		case v.Op == "delete" && !has:
+			return &rpcError{"data-missing", fmt.Sprintf("vsi %d", v.Vxlan)}
+		case deleting(v.Op):
+			delete(d.Vsis, v.Vxlan)
+		default:
+			for _, id := range v.Tunnels {
+				if _, ok := d.Tunnels[id]; !ok {
+					return &rpcError{"invalid-value", fmt.Sprintf("vsi %d: no tunnel %d", v.Vxlan, id)}
+				}
+				if !contains(tunnels, id) {
+					tunnels = append(tunnels, id)
+				}
+			}
+			sort.Ints(tunnels)
+			if tunnels == nil {
+				tunnels = []int{}
+			}
+			d.Vsis[v.Vxlan] = tunnels
+		}
+	}
+	for _, m := range conf.Mappings {
+		key := Mapping{Index: m.Index, Vlan: m.Vlan, Vxlan: m.Vxlan}
+		switch {
+		case m.Op == "delete" && !d.Mappings[key]:
+			return &rpcError{"data-missing", fmt.Sprintf("mapping %d/%d", m.Index, m.Vlan)}
+		case deleting(m.Op):
+			delete(d.Mappings, key)
+		default:
+			if _, ok := d.Vsis[m.Vxlan]; !ok {
+				return &rpcError{"invalid-value", fmt.Sprintf("mapping %d/%d: no vsi %d", m.Index, m.Vlan, m.Vxlan)}
+			}
+			d.Mappings[key] = true
+		}
+	}
+	for _, t := range conf.Trunks {
+		key := Trunk{Index: t.Index, Vlan: t.Vlan, Untagged: t.Untagged}
+		switch {
+		case t.Op == "delete" && !d.Trunks[key]:
+			return &rpcError{"data-missing", fmt.Sprintf("trunk %d/%d", t.Index, t.Vlan)}
+		case deleting(t.Op):
+			delete(d.Trunks, key)
+		default:
+			d.Trunks[key] = true
+		}
+	}
+	return nil
+}
+
+func contains(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+//wire renders d in a stable order
+func wire(d *Datastore) *config {
+	c := new(config)
+	for _, t := range d.Tunnels {
+		c.Tunnels = append(c.Tunnels, tunnel{Id: t.Id, Src: t.Source, Dst: t.Destination})
+	}
+	sort.Slice(c.Tunnels, func(i, j int) bool { return c.Tunnels[i].Id < c.Tunnels[j].Id })
+	for vxlan, tunnels := range d.Vsis {
+		c.Vsis = append(c.Vsis, vsi{Vxlan: vxlan, Tunnels: tunnels})
+	}
+	sort.Slice(c.Vsis, func(i, j int) bool { return c.Vsis[i].Vxlan < c.Vsis[j].Vxlan })
+	for m := range d.Mappings {
+		c.Mappings = append(c.Mappings, mapping{Index: m.Index, Vlan: m.Vlan, Vxlan: m.Vxlan})
+	}
+	sort.Slice(c.Mappings, func(i, j int) bool {
+		if c.Mappings[i].Index != c.Mappings[j].Index {
+			return c.Mappings[i].Index < c.Mappings[j].Index
+		}
+		return c.Mappings[i].Vlan < c.Mappings[j].Vlan
+	})
+	for t := range d.Trunks {
+		c.Trunks = append(c.Trunks, trunk{Index: t.Index, Vlan: t.Vlan, Untagged: t.Untagged})
+	}
+	sort.Slice(c.Trunks, func(i, j int) bool {
+		if c.Trunks[i].Index != c.Trunks[j].Index {
+			return c.Trunks[i].Index < c.Trunks[j].Index
+		}
+		return c.Trunks[i].Vlan < c.Trunks[j].Vlan
+	})
+	return c
+}
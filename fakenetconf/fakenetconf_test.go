@@ -0,0 +1,63 @@
+package fakenetconf
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	d := newDatastore()
+	conf := new(config)
+	xml.Unmarshal([]byte(`<vxlan xmlns="urn:sapi:params:xml:ns:yang:vxlan">`+
+		`<tunnels><tunnel><id>1</id><source>1.1.1.1</source><destination>2.2.2.2</destination></tunnel></tunnels>`+
+		`<vsis><vsi><vxlan>100</vxlan><tunnel>1</tunnel></vsi></vsis>`+
+		`<mappings><mapping><index>3</index><vlan>2</vlan><vxlan>100</vxlan></mapping></mappings>`+
+		`</vxlan>`), conf)
+	if err := apply(d, conf); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if !d.Mappings[Mapping{Index: 3, Vlan: 2, Vxlan: 100}] || len(d.Vsis[100]) != 1 {
+		t.Errorf("Expected vlan 2 mapped to vxlan 100 on index 3, got %v", d.Mappings)
+	}
+
+	missing := &config{Vsis: []vsi{{Vxlan: 200, Tunnels: []int{9}}}}
+	if err := apply(d, missing); err == nil || err.tag != "invalid-value" {
+		t.Errorf("Expected invalid-value for an unknown tunnel, got %v", err)
+	}
+
+	gone := &config{Mappings: []mapping{{Op: "delete", Index: 4, Vlan: 2, Vxlan: 100}}}
+	if err := apply(d, gone); err == nil || err.tag != "data-missing" {
+		t.Errorf("Expected data-missing deleting an unknown mapping, got %v", err)
+	}
+	gone.Mappings[0].Op = "remove"
+	if err := apply(d, gone); err != nil {
+		t.Errorf("Expected remove of an unknown mapping to succeed, got %s", err)
+	}
+}
+
+func TestWireRoundTrip(t *testing.T) {
+	d := newDatastore()
+	d.Tunnels[2] = Tunnel{Id: 2, Source: "1.1.1.1", Destination: "3.3.3.3"}
+	d.Tunnels[1] = Tunnel{Id: 1, Source: "1.1.1.1", Destination: "2.2.2.2"}
+	d.Vsis[100] = []int{1, 2}
+	d.Trunks[Trunk{Index: 1, Vlan: 30}] = true
+
+	data, err := xml.Marshal(wire(d))
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	conf := new(config)
+	if err := xml.Unmarshal(data, conf); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if len(conf.Tunnels) != 2 || conf.Tunnels[0].Id != 1 {
+		t.Errorf("Expected tunnels ordered by id, got %v", conf.Tunnels)
+	}
+	back := newDatastore()
+	if err := apply(back, conf); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if len(back.Vsis[100]) != 2 || !back.Trunks[Trunk{Index: 1, Vlan: 30}] {
+		t.Errorf("Expected the datastore back, got %v", back)
+	}
+}
@@ -0,0 +1,478 @@
+//Package faketorconf is an in-process torconf for tests and development.
+//It serves the torconf api on an httptest.Server, keeps the resulting
+//configuration per switch and lets tests inject failures and latency.
+package faketorconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Tunnel is a vxlan tunnel configured on a switch
+type Tunnel struct {
+	Id  int    `json:"tunnel_id"`
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+//Mapping maps a vlan to a vni on a switch interface
+type Mapping struct {
+	Vlan  int `json:"vlan"`
+	Vxlan int `json:"vxlan"`
+	Index int `json:"index"`
+}
+
+//Trunk carries a provider vlan on a switch interface
+type Trunk struct {
+	Vlan     int  `json:"vlan"`
+	Index    int  `json:"index"`
+	Untagged bool `json:"untagged"`
+}
+
+//Switch is the configuration torconf pushed to one switch
+type Switch struct {
+	Type     string
+	Tunnels  map[int]Tunnel
+	Vsis     map[int][]int
+	Mappings map[Mapping]bool
+	Trunks   map[Trunk]bool
+}
+
+func newSwitch(t string) *Switch {
+	return &Switch{
+		Type:     t,
+		Tunnels:  make(map[int]Tunnel),
+		Vsis:     make(map[int][]int),
+		Mappings: make(map[Mapping]bool),
+		Trunks:   make(map[Trunk]bool),
+	}
+}
+
+//Request is a call torconf received
+type Request struct {
+	Method string
+	Path   string
+	Body   []byte
+}
+
+type failure struct {
+	code  int
+	count int //remaining failures, <0 fails forever
+}
+
+//Server is a fake torconf
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	switches  map[string]*Switch
+	endpoints map[string]bool
+	tunnelId  int
+	latency   time.Duration
+	failures  map[string]*failure
+	requests  []Request
+}
+
+//NewServer starts a fake torconf, Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		switches:  make(map[string]*Switch),
+		endpoints: make(map[string]bool),
+		failures:  make(map[string]*failure),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnel", s.tunnel)
+	mux.HandleFunc("/tsync", s.tsync)
+	mux.HandleFunc("/vlan2vxlan", s.vlan2vxlan)
+	mux.HandleFunc("/ensure", s.ensure)
+	mux.HandleFunc("/trunk", s.trunk)
+	mux.HandleFunc("/config", s.config)
+	s.Server = httptest.NewServer(s.intercept(mux))
+	return s
+}
+
+//SetLatency delays every answer by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	s.latency = d
+	s.mu.Unlock()
+}
+
+//FailNext answers the next n calls of path with code, n < 0 fails until
+//Recover.
+func (s *Server) FailNext(path string, n, code int) {
+	s.mu.Lock()
+	s.failures[path] = &failure{code: code, count: n}
+	s.mu.Unlock()
+}
+
+//Recover stops injected failures of path.
+func (s *Server) Recover(path string) {
+	s.mu.Lock()
+	delete(s.failures, path)
+	s.mu.Unlock()
+}
+
+//AddEndpoint makes torconf know a tunnel source, as if a switch outside
+//sapi used it.
+func (s *Server) AddEndpoint(ip string) {
+	s.mu.Lock()
+	s.endpoints[ip] = true
+	s.mu.Unlock()
+}
+
+//Requests returns the calls received on path, every call if path is empty.
+func (s *Server) Requests(path string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Request{}
+	for _, r := range s.requests {
+		if path == "" || r.Path == path {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+//Switch returns a copy of the configuration of mgr, nil if torconf never
+//configured it.
+func (s *Server) Switch(mgr string) *Switch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.switches[mgr]
+	if !ok {
+		return nil
+	}
+	c := newSwitch(sw.Type)
+	for k, v := range sw.Tunnels {
+		c.Tunnels[k] = v
+	}
+	for k, v := range sw.Vsis {
+		c.Vsis[k] = append([]int{}, v...)
+	}
+	for k := range sw.Mappings {
+		c.Mappings[k] = true
+	}
+	for k := range sw.Trunks {
+		c.Trunks[k] = true
+	}
+	return c
+}
+
+//HasTunnel reports whether mgr has a tunnel from src to dst.
+func (s *Server) HasTunnel(mgr, src, dst string) bool {
+	sw := s.Switch(mgr)
+	if sw == nil {
+		return false
+	}
+	for _, t := range sw.Tunnels {
+		if t.Src == src && t.Dst == dst {
+			return true
+		}
+	}
+	return false
+}
+
+//HasMapping reports whether mgr maps vlan to vxlan on interface index.
+func (s *Server) HasMapping(mgr string, index, vlan, vxlan int) bool {
+	sw := s.Switch(mgr)
+	return sw != nil && sw.Mappings[Mapping{Vlan: vlan, Vxlan: vxlan, Index: index}]
+}
+
+//HasVsi reports whether mgr has the vsi, bound to tunnels if any are given.
+func (s *Server) HasVsi(mgr string, vxlan int, tunnels ...int) bool {
+	sw := s.Switch(mgr)
+	if sw == nil {
+		return false
+	}
+	bound, ok := sw.Vsis[vxlan]
+	if !ok {
+		return false
+	}
+	for _, want := range tunnels {
+		found := false
+		for _, id := range bound {
+			if id == want {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//intercept records calls and applies latency and injected failures.
+func (s *Server) intercept(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Body: body})
+		latency := s.latency
+		var code int
+		if f, ok := s.failures[r.URL.Path]; ok {
+			code = f.code
+			if f.count > 0 {
+				f.count--
+				if f.count == 0 {
+					delete(s.failures, r.URL.Path)
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		if code != 0 {
+			http.Error(w, "injected failure", code)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+//sw returns the switch of mgr, creating it, with s.mu held.
+func (s *Server) sw(mgr, t string) *Switch {
+	sw, ok := s.switches[mgr]
+	if !ok {
+		sw = newSwitch(t)
+		s.switches[mgr] = sw
+	}
+	if t != "" {
+		sw.Type = t
+	}
+	return sw
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) tunnel(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type     string `json:"type"`
+		Mgr      string `json:"mgr"`
+		Src      string `json:"src"`
+		Dst      string `json:"dst"`
+		TunnelId int    `json:"tunnel_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Mgr == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw := s.sw(req.Mgr, req.Type)
+	switch r.Method {
+	case "POST":
+		for id, t := range sw.Tunnels {
+			if t.Src == req.Src && t.Dst == req.Dst {
+				writeJSON(w, map[string]int{"tunnel_id": id})
+				return
+			}
+		}
+		s.tunnelId++
+		sw.Tunnels[s.tunnelId] = Tunnel{Id: s.tunnelId, Src: req.Src, Dst: req.Dst}
+		s.endpoints[req.Src] = true
+		s.endpoints[req.Dst] = true
+		writeJSON(w, map[string]int{"tunnel_id": s.tunnelId})
+	case "DELETE":
+		if _, ok := sw.Tunnels[req.TunnelId]; !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		delete(sw.Tunnels, req.TunnelId)
+		for vxlan, ids := range sw.Vsis {
+			sw.Vsis[vxlan] = without(ids, req.TunnelId)
+		}
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//tsync answers every tunnel source torconf knows, src included.
+func (s *Server) tsync(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Src string `json:"src"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Src == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoints[req.Src] = true
+	ips := []string{}
+	for ip := range s.endpoints {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	tunnels := []map[string]string{}
+	for _, ip := range ips {
+		tunnels = append(tunnels, map[string]string{"ip_address": ip})
+	}
+	writeJSON(w, map[string]interface{}{"tunnels": tunnels})
+}
+
+func (s *Server) vlan2vxlan(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type      string `json:"type"`
+		Mgr       string `json:"mgr"`
+		Vlan      int    `json:"vlan"`
+		Vxlan     int    `json:"vxlan"`
+		Index     int    `json:"index"`
+		TunnelIds []int  `json:"tunnel_ids"`
+		Only      bool   `json:"delete_on_index"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Mgr == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw := s.sw(req.Mgr, req.Type)
+	m := Mapping{Vlan: req.Vlan, Vxlan: req.Vxlan, Index: req.Index}
+	switch r.Method {
+	case "POST":
+		sw.Mappings[m] = true
+		sw.Vsis[req.Vxlan] = union(sw.Vsis[req.Vxlan], req.TunnelIds)
+	case "DELETE":
+		delete(sw.Mappings, m)
+		if !req.Only {
+			delete(sw.Vsis, req.Vxlan)
+		}
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+func (s *Server) ensure(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type    string `json:"type"`
+		Mgr     string `json:"mgr"`
+		Vxlans  []int  `json:"vxlans"`
+		Tunnels []int  `json:"tunnels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Mgr == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw := s.sw(req.Mgr, req.Type)
+	for _, vxlan := range req.Vxlans {
+		sw.Vsis[vxlan] = union(sw.Vsis[vxlan], req.Tunnels)
+	}
+	w.Write([]byte("OK"))
+}
+
+func (s *Server) trunk(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type     string `json:"type"`
+		Mgr      string `json:"mgr"`
+		Vlan     int    `json:"vlan"`
+		Index    int    `json:"index"`
+		Untagged bool   `json:"untagged"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Mgr == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw := s.sw(req.Mgr, req.Type)
+	t := Trunk{Vlan: req.Vlan, Index: req.Index, Untagged: req.Untagged}
+	switch r.Method {
+	case "POST":
+		sw.Trunks[t] = true
+	case "DELETE":
+		delete(sw.Trunks, t)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+//config reads back the configuration of ?mgr=
+func (s *Server) config(w http.ResponseWriter, r *http.Request) {
+	sw := s.Switch(r.URL.Query().Get("mgr"))
+	if sw == nil {
+		sw = newSwitch(r.URL.Query().Get("type"))
+	}
+	conf := struct {
+		Tunnels  []Tunnel  `json:"tunnels"`
+		Vsis     []int     `json:"vsis"`
+		Mappings []Mapping `json:"mappings"`
+		Trunks   []Trunk   `json:"trunks"`
+	}{[]Tunnel{}, []int{}, []Mapping{}, []Trunk{}}
+	for _, t := range sw.Tunnels {
+		conf.Tunnels = append(conf.Tunnels, t)
+	}
+	for vxlan := range sw.Vsis {
+		conf.Vsis = append(conf.Vsis, vxlan)
+	}
+	for m := range sw.Mappings {
+		conf.Mappings = append(conf.Mappings, m)
+	}
+	for t := range sw.Trunks {
+		conf.Trunks = append(conf.Trunks, t)
+	}
+	sort.Slice(conf.Tunnels, func(i, j int) bool { return conf.Tunnels[i].Id < conf.Tunnels[j].Id })
+	sort.Ints(conf.Vsis)
+	sort.Slice(conf.Mappings, func(i, j int) bool {
+		if conf.Mappings[i].Index != conf.Mappings[j].Index {
+			return conf.Mappings[i].Index < conf.Mappings[j].Index
+		}
+		return conf.Mappings[i].Vlan < conf.Mappings[j].Vlan
+	})
+	sort.Slice(conf.Trunks, func(i, j int) bool {
+		if conf.Trunks[i].Index != conf.Trunks[j].Index {
+			return conf.Trunks[i].Index < conf.Trunks[j].Index
+		}
+		return conf.Trunks[i].Vlan < conf.Trunks[j].Vlan
+	})
+	writeJSON(w, conf)
+}
+
+func union(a, b []int) []int {
+	seen := make(map[int]bool)
+	ret := []int{}
+	for _, v := range append(append([]int{}, a...), b...) {
+		if !seen[v] {
+			seen[v] = true
+			ret = append(ret, v)
+		}
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+func without(a []int, v int) []int {
+	ret := []int{}
+	for _, x := range a {
+		if x != v {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
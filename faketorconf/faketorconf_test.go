@@ -0,0 +1,90 @@
+package faketorconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func do(t *testing.T, s *Server, method, path string, body interface{}) *http.Response {
+	b, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, s.URL+path, bytes.NewReader(b))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	return resp
+}
+
+func TestTunnelAndMapping(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	resp := do(t, s, "POST", "/tunnel", map[string]string{"type": "h3c", "mgr": "tor1", "src": "1.1.1.1", "dst": "2.2.2.2"})
+	var tunnel struct {
+		TunnelId int `json:"tunnel_id"`
+	}
+	json.NewDecoder(resp.Body).Decode(&tunnel)
+	if tunnel.TunnelId != 1 || !s.HasTunnel("tor1", "1.1.1.1", "2.2.2.2") {
+		t.Fatalf("Expected tunnel 1 on tor1, got %d", tunnel.TunnelId)
+	}
+
+	do(t, s, "POST", "/vlan2vxlan", map[string]interface{}{"mgr": "tor1", "vlan": 2, "vxlan": 100, "index": 3, "tunnel_ids": []int{1}})
+	if !s.HasMapping("tor1", 3, 2, 100) || !s.HasVsi("tor1", 100, 1) {
+		t.Error("Expected vlan 2 mapped to vxlan 100 on index 3")
+	}
+	do(t, s, "DELETE", "/vlan2vxlan", map[string]interface{}{"mgr": "tor1", "vlan": 2, "vxlan": 100, "index": 3})
+	if s.HasMapping("tor1", 3, 2, 100) || s.HasVsi("tor1", 100) {
+		t.Error("Expected mapping and vsi removed")
+	}
+
+	do(t, s, "DELETE", "/tunnel", map[string]interface{}{"mgr": "tor1", "tunnel_id": 1})
+	if s.HasTunnel("tor1", "1.1.1.1", "2.2.2.2") {
+		t.Error("Expected tunnel removed")
+	}
+	if len(s.Requests("/vlan2vxlan")) != 2 {
+		t.Errorf("Expected %d /vlan2vxlan requests, got %d", 2, len(s.Requests("/vlan2vxlan")))
+	}
+}
+
+func TestTsync(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddEndpoint("9.9.9.9")
+
+	resp := do(t, s, "POST", "/tsync", map[string]string{"src": "1.1.1.1", "tunnel_type": "vxlan"})
+	var ret struct {
+		Tunnels []map[string]string `json:"tunnels"`
+	}
+	json.NewDecoder(resp.Body).Decode(&ret)
+	if len(ret.Tunnels) != 2 || ret.Tunnels[0]["ip_address"] != "1.1.1.1" || ret.Tunnels[1]["ip_address"] != "9.9.9.9" {
+		t.Errorf("Unexpected tsync answer %v", ret.Tunnels)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.FailNext("/ensure", 2, http.StatusServiceUnavailable)
+	for i := 0; i < 2; i++ {
+		if resp := do(t, s, "POST", "/ensure", map[string]interface{}{"mgr": "tor1", "vxlans": []int{100}}); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+	}
+	if resp := do(t, s, "POST", "/ensure", map[string]interface{}{"mgr": "tor1", "vxlans": []int{100}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if !s.HasVsi("tor1", 100) {
+		t.Error("Expected vsi 100 on tor1")
+	}
+
+	s.SetLatency(time.Millisecond * 50)
+	start := time.Now()
+	do(t, s, "POST", "/ensure", map[string]interface{}{"mgr": "tor1"})
+	if time.Since(start) < time.Millisecond*50 {
+		t.Error("Expected latency applied")
+	}
+}
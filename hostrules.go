@@ -0,0 +1,378 @@
+package sapi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	gosync "sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	RuleInclude = "include"
+	RuleExclude = "exclude"
+)
+
+var (
+	hostRulesPath = "/topology/rules"
+	neighborsPath = "/topology/neighbors"
+
+	//what sapi always took for a host, used until rules are stored
+	defaultHostRules = []*HostRule{
+		{Name: "linux", Action: RuleInclude, SysDesc: "Linux|Ubuntu"}}
+
+	hostRules   = mustCompileRules(defaultHostRules)
+	hostRulesMu gosync.RWMutex
+
+	//tor -> neighbors of its last successful poll, see recordNeighbors
+	neighbors   = make(map[string][]*Neighbor)
+	neighborsMu gosync.Mutex
+
+	ErrorHostRule = errors.New("Invalid host rule")
+)
+
+//HostRule takes a neighbor for a host or not. A rule matches when every
+//criterion given matches: the regexes the sysdesc and sysname, all the
+//capabilities are enabled and the chassis mac is in one of the ouis. The
+//first matching rule decides, a neighbor no rule matches is excluded.
+type HostRule struct {
+	Name         string   `json:"name"`
+	Action       string   `json:"action"`
+	SysDesc      string   `json:"sysdesc,omitempty"`
+	SysName      string   `json:"sysname,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Ouis         []string `json:"ouis,omitempty"`
+}
+
+//SapiHostRules stores the host rules, rules apply in id order
+type SapiHostRules struct {
+	Id           int64  `xorm:"pk autoincr"`
+	Name         string `xorm:"varchar(64)"`
+	Action       string `xorm:"varchar(16)"`
+	SysDesc      string `xorm:"text"`
+	SysName      string `xorm:"text"`
+	Capabilities string `xorm:"varchar(255)"`
+	Ouis         string `xorm:"text"`
+}
+
+type hostRule struct {
+	*HostRule
+	sysDesc, sysName *regexp.Regexp
+}
+
+//Neighbor is an lldp neighbor of a tor port and how it was classified.
+//RemotePort is the interface of the neighbor the tor port is linked to.
+type Neighbor struct {
+	Tor          string   `json:"tor"`
+	TorName      string   `json:"tor_name"`
+	Index        string   `json:"index"`
+	Port         string   `json:"port"`
+	RemotePort   string   `json:"remote_port"`
+	Ip           string   `json:"ip"`
+	SysName      string   `json:"sysname"`
+	SysDesc      string   `json:"sysdesc"`
+	Mac          string   `json:"mac"`
+	Capabilities []string `json:"capabilities"`
+	Host         bool     `json:"host"`
+	Rule         string   `json:"rule,omitempty"`
+	Reason       string   `json:"reason"`
+}
+
+func (this *SapiHostRules) rule() *HostRule {
+	rule := &HostRule{Name: this.Name, Action: this.Action, SysDesc: this.SysDesc, SysName: this.SysName}
+	if this.Capabilities != "" {
+		rule.Capabilities = strings.Split(this.Capabilities, ",")
+	}
+	if this.Ouis != "" {
+		rule.Ouis = strings.Split(this.Ouis, ",")
+	}
+	return rule
+}
+
+func (rule *HostRule) row() *SapiHostRules {
+	return &SapiHostRules{
+		Name:         rule.Name,
+		Action:       rule.Action,
+		SysDesc:      rule.SysDesc,
+		SysName:      rule.SysName,
+		Capabilities: strings.Join(rule.Capabilities, ","),
+		Ouis:         strings.Join(rule.Ouis, ",")}
+}
+
+//normalize checks a rule, ouis become six lower hex digits
+func (rule *HostRule) normalize() error {
+	if rule.Name == "" || rule.Action != RuleInclude && rule.Action != RuleExclude {
+		return ErrorHostRule
+	}
+	for _, c := range rule.Capabilities {
+		if capabilityBit(c) < 0 {
+			return fmt.Errorf("%s: unknown capability %s", ErrorHostRule, c)
+		}
+	}
+	for i, oui := range rule.Ouis {
+		oui = strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(oui))
+		if _, err := hex.DecodeString(oui); err != nil || len(oui) != 6 {
+			return fmt.Errorf("%s: bad oui %s", ErrorHostRule, rule.Ouis[i])
+		}
+		rule.Ouis[i] = oui
+	}
+	return nil
+}
+
+func compileRules(rules []*HostRule) ([]*hostRule, error) {
+	compiled := []*hostRule{}
+	for _, rule := range rules {
+		if err := rule.normalize(); err != nil {
+			return nil, err
+		}
+		c := &hostRule{HostRule: rule}
+		var err error
+		if rule.SysDesc != "" {
+			if c.sysDesc, err = regexp.Compile(rule.SysDesc); err != nil {
+				return nil, fmt.Errorf("%s: %s", ErrorHostRule, err)
+			}
+		}
+		if rule.SysName != "" {
+			if c.sysName, err = regexp.Compile(rule.SysName); err != nil {
+				return nil, fmt.Errorf("%s: %s", ErrorHostRule, err)
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func mustCompileRules(rules []*HostRule) []*hostRule {
+	compiled, err := compileRules(rules)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+//match returns why the rule matches the neighbor, false if it does not
+func (rule *hostRule) match(n *Neighbor) (string, bool) {
+	why := []string{}
+	if rule.sysDesc != nil {
+		if !rule.sysDesc.MatchString(n.SysDesc) {
+			return "", false
+		}
+		why = append(why, fmt.Sprintf("sysdesc matches %q", rule.SysDesc))
+	}
+	if rule.sysName != nil {
+		if !rule.sysName.MatchString(n.SysName) {
+			return "", false
+		}
+		why = append(why, fmt.Sprintf("sysname matches %q", rule.SysName))
+	}
+	if len(rule.Capabilities) > 0 {
+		enabled := make(map[string]bool)
+		for _, c := range n.Capabilities {
+			enabled[c] = true
+		}
+		for _, c := range rule.Capabilities {
+			if !enabled[c] {
+				return "", false
+			}
+		}
+		why = append(why, fmt.Sprintf("capabilities %s enabled", strings.Join(rule.Capabilities, ",")))
+	}
+	if len(rule.Ouis) > 0 {
+		oui := ""
+		for _, o := range rule.Ouis {
+			if strings.HasPrefix(n.Mac, o) {
+				oui = o
+				break
+			}
+		}
+		if oui == "" {
+			return "", false
+		}
+		why = append(why, fmt.Sprintf("mac in oui %s", oui))
+	}
+	if len(why) == 0 {
+		why = append(why, "matches every neighbor")
+	}
+	return strings.Join(why, ", "), true
+}
+
+//classify decides whether a neighbor is a host with the current rules
+func classify(n *Neighbor) {
+	hostRulesMu.RLock()
+	defer hostRulesMu.RUnlock()
+	for _, rule := range hostRules {
+		if why, ok := rule.match(n); ok {
+			n.Host = rule.Action == RuleInclude
+			n.Rule = rule.Name
+			n.Reason = fmt.Sprintf("%sd by rule %s: %s", rule.Action, rule.Name, why)
+			return
+		}
+	}
+	n.Host, n.Rule, n.Reason = false, "", "excluded, no rule matched"
+}
+
+//neighborOf is the remote of a tor port as classified
+func neighborOf(tor, index, port string, rem *RemoteData) *Neighbor {
+	n := &Neighbor{
+		Tor:          tor,
+		Index:        index,
+		Port:         port,
+		Ip:           rem.RemManAddress,
+		SysName:      rem.RemSysName,
+		SysDesc:      rem.RemSysDesc,
+		Mac:          rem.RemMacAddress,
+		Capabilities: rem.RemSysCapEnabled}
+	if n.Mac == "" {
+		n.Mac = rem.RemPortId.Mac()
+	}
+	if n.Capabilities == nil {
+		n.Capabilities = []string{}
+	}
+	classify(n)
+	//switch ports are named by port id as their own polls name them
+	n.RemotePort = rem.RemPortId.Value
+	if n.Host || n.RemotePort == "" {
+		n.RemotePort = rem.Interface()
+	}
+	return n
+}
+
+//recordNeighbors keeps the neighbors of the last successful poll of a tor
+func recordNeighbors(tor string, list []*Neighbor) {
+	sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+	neighborsMu.Lock()
+	defer neighborsMu.Unlock()
+	neighbors[tor] = list
+}
+
+func forgetNeighbors(tor string) {
+	neighborsMu.Lock()
+	defer neighborsMu.Unlock()
+	delete(neighbors, tor)
+}
+
+//setHostRules makes the rules current, no rules means the defaults
+func setHostRules(rules []*HostRule) error {
+	if len(rules) == 0 {
+		rules = defaultHostRules
+	}
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return err
+	}
+	hostRulesMu.Lock()
+	defer hostRulesMu.Unlock()
+	hostRules = compiled
+	return nil
+}
+
+func currentHostRules() []*HostRule {
+	hostRulesMu.RLock()
+	defer hostRulesMu.RUnlock()
+	rules := []*HostRule{}
+	for _, rule := range hostRules {
+		rules = append(rules, rule.HostRule)
+	}
+	return rules
+}
+
+//LoadHostRules makes the stored rules current
+func LoadHostRules() error {
+	rows := make([]*SapiHostRules, 0)
+	if err := DB().Asc("id").Find(&rows); err != nil {
+		return err
+	}
+	rules := []*HostRule{}
+	for _, row := range rows {
+		rules = append(rules, row.rule())
+	}
+	return setHostRules(rules)
+}
+
+//storeHostRules replaces the stored rules
+func storeHostRules(rules []*HostRule) error {
+	session := DB().NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	if _, err := session.Where("1=1").Delete(new(SapiHostRules)); err != nil {
+		session.Rollback()
+		return err
+	}
+	for _, rule := range rules {
+		if _, err := session.Insert(rule.row()); err != nil {
+			session.Rollback()
+			return err
+		}
+	}
+	return session.Commit()
+}
+
+func showHostRules(rw http.ResponseWriter, r *http.Request) {
+	writeJson(rw, struct {
+		Rules []*HostRule `json:"rules"`
+	}{currentHostRules()})
+}
+
+//updateHostRules replaces the rules, an empty list restores the defaults.
+//The tors are polled again to classify their neighbors with the new rules.
+func updateHostRules(rw http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Rules []*HostRule `json:"rules"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		HttpError(rw, "Bad Request", nil, http.StatusBadRequest)
+		return
+	}
+	if _, err := compileRules(data.Rules); err != nil {
+		HttpError(rw, err.Error(), err, http.StatusBadRequest)
+		return
+	}
+	if err := storeHostRules(data.Rules); err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	setHostRules(data.Rules)
+	Log().WithFields(logrus.Fields{
+		"Rules": len(data.Rules),
+	}).Info("updateHostRules: host rules changed")
+	requestRefresh()
+	rw.Write([]byte("OK"))
+}
+
+//listNeighbors shows every neighbor of the last polls and why it was taken
+//for a host or not. Filters: tor and host=true|false.
+func listNeighbors(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	list := []*Neighbor{}
+	neighborsMu.Lock()
+	for tor, items := range neighbors {
+		if t := q.Get("tor"); t != "" && t != tor {
+			continue
+		}
+		for _, n := range items {
+			if h := q.Get("host"); h != "" && h != fmt.Sprint(n.Host) {
+				continue
+			}
+			list = append(list, n)
+		}
+	}
+	neighborsMu.Unlock()
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Tor < list[j].Tor })
+	writeJson(rw, struct {
+		Neighbors []*Neighbor `json:"neighbors"`
+	}{list})
+}
+
+func init() {
+	Regist(MakeApiEndpoints("GET", hostRulesPath, http.HandlerFunc(showHostRules)))
+	Regist(MakeApiEndpoints("PUT", hostRulesPath, http.HandlerFunc(updateHostRules)))
+	Regist(MakeApiEndpoints("GET", neighborsPath, http.HandlerFunc(listNeighbors)))
+}
@@ -0,0 +1,98 @@
+package sapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeCapabilities(t *testing.T) {
+	caps := decodeCapabilities([]byte{0x28})
+	if strings.Join(caps, ",") != "bridge,router" {
+		t.Errorf("Expected bridge,router, got %v", caps)
+	}
+	if caps := decodeCapabilities(nil); len(caps) != 0 {
+		t.Errorf("Expected no capabilities, got %v", caps)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	defer setHostRules(nil)
+
+	n := &Neighbor{SysDesc: "Ubuntu 16.04 LTS"}
+	classify(n)
+	if !n.Host || n.Rule != "linux" {
+		t.Errorf("Expected a host by the default rule, got %v %s", n.Host, n.Reason)
+	}
+
+	rules := []*HostRule{
+		{Name: "switches", Action: RuleExclude, Capabilities: []string{"bridge", "router"}},
+		{Name: "esxi", Action: RuleInclude, SysDesc: "VMware ESX"},
+		{Name: "appliances", Action: RuleInclude, Ouis: []string{"00:1B:21"}},
+		{Name: "linux", Action: RuleInclude, SysDesc: "Linux|CentOS", SysName: "^compute-"},
+	}
+	if err := setHostRules(rules); err != nil {
+		t.Errorf("Expected the rules set, got %s", err)
+	}
+
+	cases := []struct {
+		n    *Neighbor
+		host bool
+		rule string
+	}{
+		{&Neighbor{SysDesc: "Linux 4.4 cumulus", SysName: "compute-1",
+			Capabilities: []string{"bridge", "router"}}, false, "switches"},
+		{&Neighbor{SysDesc: "Linux 4.4", SysName: "compute-1",
+			Capabilities: []string{"bridge"}}, true, "linux"},
+		{&Neighbor{SysDesc: "VMware ESX 6.5"}, true, "esxi"},
+		{&Neighbor{SysDesc: "appliance", Mac: "001b213c4d5e"}, true, "appliances"},
+		{&Neighbor{SysDesc: "CentOS 7", SysName: "storage-1"}, false, ""},
+	}
+	for _, c := range cases {
+		classify(c.n)
+		if c.n.Host != c.host || c.n.Rule != c.rule || c.n.Reason == "" {
+			t.Errorf("Expected %v by %q, got %v by %q: %s", c.host, c.rule, c.n.Host, c.n.Rule, c.n.Reason)
+		}
+	}
+
+	bad := [][]*HostRule{
+		{{Name: "x", Action: "maybe"}},
+		{{Name: "x", Action: RuleInclude, SysDesc: "("}},
+		{{Name: "x", Action: RuleInclude, Capabilities: []string{"toaster"}}},
+		{{Name: "x", Action: RuleInclude, Ouis: []string{"00:1b"}}},
+	}
+	for _, rules := range bad {
+		if err := setHostRules(rules); err == nil {
+			t.Errorf("Expected %v refused", rules[0])
+		}
+	}
+	if currentHostRules()[0].Name != "switches" {
+		t.Errorf("Expected the rules kept after refused ones")
+	}
+}
+
+func TestResolveNeighbors(t *testing.T) {
+	defer setHostRules(nil)
+	setHostRules([]*HostRule{
+		{Name: "switches", Action: RuleExclude, Capabilities: []string{"router"}},
+		{Name: "all", Action: RuleInclude}})
+
+	l := newl()
+	l.ManAddress["1"] = "10.0.0.1"
+	l.Ports["1"], l.Ports["2"] = "GE1/0/1", "GE1/0/2"
+	r := map[string]*RemoteData{
+		"1": {RemSysName: "esx-1", RemSysDesc: "VMware ESX", Index: "1"},
+		"2": {RemSysName: "leaf-1", RemSysDesc: "Linux", RemSysCapEnabled: []string{"bridge", "router"}, Index: "2"},
+	}
+	topo, found := (&LLDP{Local: l, Remote: r}).resolveTopology()
+	if len(topo) != 1 || topo["1"] == nil || topo["1"].Host != "esx-1" {
+		t.Errorf("Expected esx-1 the only host, got %v", topo)
+	}
+	if len(found) != 2 {
+		t.Errorf("Expected 2 neighbors, got %d", len(found))
+	}
+	for _, n := range found {
+		if n.SysName == "leaf-1" && (n.Host || n.Rule != "switches" || n.Port != "GE1/0/2") {
+			t.Errorf("Expected leaf-1 excluded by switches, got %v", n)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package sapi
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+//SapiTopologyLinks is the discovered topology, one row per host interface
+//behind a tor interface. PolledTor is the tor whose poll found the link.
+type SapiTopologyLinks struct {
+	Id            int64     `xorm:"pk autoincr"`
+	PolledTor     string    `xorm:"index varchar(45)"`
+	TorIp         string    `xorm:"unique(tor_port) varchar(45)"`
+	PortIndex     string    `xorm:"unique(tor_port) varchar(16)"`
+	PortName      string    `xorm:"varchar(255)"`
+	Tor           string    `xorm:"varchar(255)"`
+	Host          string    `xorm:"index varchar(255)"`
+	HostInterface string    `xorm:"varchar(255)"`
+	Ip            string    `xorm:"varchar(45)"`
+	Mac           string    `xorm:"varchar(64)"`
+	SysDesc       string    `xorm:"text"`
+	FirstSeen     time.Time `xorm:"created"`
+	LastSeen      time.Time
+}
+
+func linkOf(polled string, item *Topology) *SapiTopologyLinks {
+	return &SapiTopologyLinks{
+		PolledTor:     polled,
+		TorIp:         item.TorIp,
+		PortIndex:     item.Index,
+		PortName:      item.IndexName,
+		Tor:           item.Tor,
+		Host:          item.Host,
+		HostInterface: item.HostInterface,
+		Ip:            item.Ip,
+		Mac:           item.Mac,
+		SysDesc:       item.SysDesc,
+		LastSeen:      item.LastSeen}
+}
+
+func (this *SapiTopologyLinks) topology() *Topology {
+	return &Topology{
+		Index:         this.PortIndex,
+		IndexName:     this.PortName,
+		Tor:           this.Tor,
+		TorIp:         this.TorIp,
+		Host:          this.Host,
+		HostInterface: this.HostInterface,
+		Ip:            this.Ip,
+		Mac:           this.Mac,
+		SysDesc:       this.SysDesc,
+		FirstSeen:     this.FirstSeen,
+		LastSeen:      this.LastSeen}
+}
+
+//sameLink tells whether a stored link still shows the same host
+func sameLink(a, b *SapiTopologyLinks) bool {
+	return a.Host == b.Host && a.HostInterface == b.HostInterface && a.Mac == b.Mac &&
+		a.Ip == b.Ip && a.PortName == b.PortName && a.Tor == b.Tor && a.SysDesc == b.SysDesc
+}
+
+//storeLinks brings the stored links found by polling a tor in line with
+//the poll and stamps the polled items with their first and last sighting.
+//A link whose host changed starts over.
+func storeLinks(polled string, found map[string][]*Topology, now time.Time) error {
+	stored := make([]*SapiTopologyLinks, 0)
+	if err := DB().Where("polled_tor=?", polled).Find(&stored); err != nil {
+		return err
+	}
+	byPort := make(map[string]*SapiTopologyLinks)
+	for _, link := range stored {
+		byPort[link.TorIp+"/"+link.PortIndex] = link
+	}
+
+	for _, items := range found {
+		for _, item := range items {
+			item.LastSeen = now
+			link := linkOf(polled, item)
+			key := link.TorIp + "/" + link.PortIndex
+			old, ok := byPort[key]
+			delete(byPort, key)
+			switch {
+			case ok && sameLink(old, link):
+				item.FirstSeen = old.FirstSeen
+				if _, err := DB().Id(old.Id).Cols("last_seen").Update(link); err != nil {
+					return err
+				}
+				continue
+			case ok:
+				if _, err := DB().Id(old.Id).Delete(new(SapiTopologyLinks)); err != nil {
+					return err
+				}
+			default:
+				//the port may have been found through another tor before
+				if _, err := DB().Where("tor_ip=? AND port_index=?", link.TorIp, link.PortIndex).
+					Delete(new(SapiTopologyLinks)); err != nil {
+					return err
+				}
+			}
+			if _, err := DB().Insert(link); err != nil {
+				return err
+			}
+			item.FirstSeen = link.FirstSeen
+		}
+	}
+	for _, gone := range byPort {
+		if _, err := DB().Id(gone.Id).Delete(new(SapiTopologyLinks)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//dropLinks forgets the links found by polling a tor
+func dropLinks(polled string) error {
+	_, err := DB().Where("polled_tor=?", polled).Delete(new(SapiTopologyLinks))
+	return err
+}
+
+//LoadTopology serves the stored topology until the tors are polled, ports
+//can be bound right after a restart. The stored links count as the last
+//successful poll of their tor.
+func LoadTopology() error {
+	links := make([]*SapiTopologyLinks, 0)
+	if err := DB().Asc("id").Find(&links); err != nil {
+		return err
+	}
+	byTor := make(map[string]map[string][]*Topology)
+	seen := make(map[string]time.Time)
+	for _, link := range links {
+		found, ok := byTor[link.PolledTor]
+		if !ok {
+			found = make(map[string][]*Topology)
+			byTor[link.PolledTor] = found
+		}
+		found[link.TorIp] = append(found[link.TorIp], link.topology())
+		if link.LastSeen.After(seen[link.PolledTor]) {
+			seen[link.PolledTor] = link.LastSeen
+		}
+	}
+	for tor, found := range byTor {
+		simple := make(map[string][]string)
+		for torIp, items := range found {
+			for _, item := range items {
+				simple[torIp] = append(simple[torIp], item.Host)
+			}
+		}
+		mergeTopology(tor, found, simple)
+		loadedPoll(tor, seen[tor])
+	}
+	Log().WithFields(logrus.Fields{
+		"Tors":  len(byTor),
+		"Links": len(links),
+	}).Info("LoadTopology: stored topology loaded")
+	return nil
+}
@@ -0,0 +1,29 @@
+package sapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLinkRoundTrip(t *testing.T) {
+	seen := time.Now()
+	item := &Topology{Index: "7", IndexName: "Ten-GigabitEthernet1/0/7", Tor: "tor-a", TorIp: "10.0.0.1",
+		Host: "compute1", HostInterface: "eth0", Ip: "10.1.0.5", Mac: "aabbccddeeff", LastSeen: seen}
+	link := linkOf("10.0.0.1", item)
+	if link.PortIndex != "7" || link.PolledTor != "10.0.0.1" || !link.LastSeen.Equal(seen) {
+		t.Errorf("Expected port 7 polled through 10.0.0.1, got %+v", link)
+	}
+	if back := link.topology(); *back != *item {
+		t.Errorf("Expected %+v back, got %+v", item, back)
+	}
+
+	moved := linkOf("10.0.0.1", &Topology{Index: "7", TorIp: "10.0.0.1", Host: "compute2"})
+	if sameLink(link, moved) {
+		t.Error("Expected another host on the port to be another link")
+	}
+	again := *link
+	again.LastSeen = seen.Add(time.Minute)
+	if !sameLink(link, &again) {
+		t.Error("Expected a link seen again to be the same link")
+	}
+}
@@ -7,38 +7,53 @@ import "encoding/json"
 import "strconv"
 import g "github.com/soniah/gosnmp"
 import "encoding/hex"
+import gosync "sync"
 
 var (
 	LocalDataOid  = "1.0.8802.1.1.2.1.3"
 	RemoteDataOid = "1.0.8802.1.1.2.1.4"
 
+	//tor -> last poll, see recordPoll
+	polls   = make(map[string]*PollStatus)
+	pollsMu gosync.Mutex
+
 	lldpLocChassisIdSubtype = "1.0.8802.1.1.2.1.3.1.0"
 	lldpLocChassisId        = "1.0.8802.1.1.2.1.3.2.0"
 	lldpLocSysName          = "1.0.8802.1.1.2.1.3.3.0"
 	lldpLocSysDesc          = "1.0.8802.1.1.2.1.3.4.0"
+	lldpLocPortIdSubtype    = "1.0.8802.1.1.2.1.3.7.1.2"
 	lldpLocPorts            = "1.0.8802.1.1.2.1.3.7.1.3"
+	lldpLocPortDesc         = "1.0.8802.1.1.2.1.3.7.1.4"
 	lldpLocManAddress       = "1.0.8802.1.1.2.1.3.8.1.5"
 	lldpLocal               = map[string]string{
 		lldpLocChassisIdSubtype: lldpLocChassisIdSubtype,
 		lldpLocChassisId:        lldpLocChassisId,
 		lldpLocSysDesc:          lldpLocSysDesc,
+		lldpLocPortIdSubtype:    lldpLocPortIdSubtype,
 		lldpLocPorts:            lldpLocPorts,
+		lldpLocPortDesc:         lldpLocPortDesc,
 		lldpLocSysName:          lldpLocSysName,
 		lldpLocManAddress:       lldpLocManAddress,
 	}
 
 	lldpRemChassisIdSubtype = "1.0.8802.1.1.2.1.4.1.1.4"
 	lldpRemChassisId        = "1.0.8802.1.1.2.1.4.1.1.5"
+	lldpRemPortIdSubtype    = "1.0.8802.1.1.2.1.4.1.1.6"
+	lldpRemPortId           = "1.0.8802.1.1.2.1.4.1.1.7"
 	lldpRemPortDesc         = "1.0.8802.1.1.2.1.4.1.1.8"
 	lldpRemSysName          = "1.0.8802.1.1.2.1.4.1.1.9"
 	lldpRemSysDesc          = "1.0.8802.1.1.2.1.4.1.1.10"
+	lldpRemSysCapEnabled    = "1.0.8802.1.1.2.1.4.1.1.12"
 	lldpRemManAddress       = "1.0.8802.1.1.2.1.4.2.1.3"
 	lldpRemote              = map[string]string{
 		lldpRemChassisIdSubtype: lldpRemChassisIdSubtype,
 		lldpRemChassisId:        lldpRemChassisId,
+		lldpRemPortIdSubtype:    lldpRemPortIdSubtype,
+		lldpRemPortId:           lldpRemPortId,
 		lldpRemPortDesc:         lldpRemPortDesc,
 		lldpRemSysDesc:          lldpRemSysDesc,
 		lldpRemSysName:          lldpRemSysName,
+		lldpRemSysCapEnabled:    lldpRemSysCapEnabled,
 		lldpRemManAddress:       lldpRemManAddress,
 	}
 	VeryCloudy = []string{
@@ -49,12 +64,17 @@ var (
 		"             "}
 )
 
+//LocalData is what a tor tells about itself. MacAddress is the chassis id
+//if it is a mac, Ports holds the port ids and PortDescs the descriptions.
 type LocalData struct {
 	MacAddress string            `json:"mac_address"`
+	ChassisId  LldpId            `json:"chassis_id"`
 	SysName    string            `json:"sysname"`
 	SysDesc    string            `json:"sysdesc"`
 	ManAddress map[string]string `json:"mgr"`
 	Ports      map[string]string `json:"ports"`
+	PortIds    map[string]LldpId `json:"port_ids"`
+	PortDescs  map[string]string `json:"port_descs"`
 }
 
 func (ld *LocalData) String() string {
@@ -67,17 +87,22 @@ func newl() *LocalData {
 
 	l.ManAddress = make(map[string]string)
 	l.Ports = make(map[string]string)
+	l.PortIds = make(map[string]LldpId)
+	l.PortDescs = make(map[string]string)
 
 	return l
 }
 
 type RemoteData struct {
-	RemMacAddress string `json:"rem_mac_address"`
-	RemPortDesc   string `json:"rem_desc"`
-	RemSysName    string `json:"rem_sysname"`
-	RemSysDesc    string `json:"rem_sysdesc"`
-	RemManAddress string `json:"rem_mgr"`
-	Index         string `json:"index"`
+	RemMacAddress    string   `json:"rem_mac_address"`
+	RemChassisId     LldpId   `json:"rem_chassis_id"`
+	RemPortId        LldpId   `json:"rem_port_id"`
+	RemPortDesc      string   `json:"rem_desc"`
+	RemSysName       string   `json:"rem_sysname"`
+	RemSysDesc       string   `json:"rem_sysdesc"`
+	RemManAddress    string   `json:"rem_mgr"`
+	RemSysCapEnabled []string `json:"rem_sys_cap"`
+	Index            string   `json:"index"`
 }
 
 func (rd *RemoteData) String() string {
@@ -89,6 +114,60 @@ func newr() *RemoteData {
 	return &RemoteData{}
 }
 
+//Interface is the host interface, the port description or else the port id
+func (rd *RemoteData) Interface() string {
+	if rd.RemPortDesc != "" {
+		return rd.RemPortDesc
+	}
+	return rd.RemPortId.Value
+}
+
+//lldpIds gathers the subtypes and raw ids of a walk, the subtype may come
+//after its id
+type lldpIds struct {
+	subtypes map[string]int
+	raw      map[string][]byte
+}
+
+func newIds() *lldpIds {
+	return &lldpIds{subtypes: make(map[string]int), raw: make(map[string][]byte)}
+}
+
+func pduBytes(pdu g.SnmpPDU) []byte {
+	switch v := pdu.Value.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
+
+func pduInt(pdu g.SnmpPDU) int {
+	switch v := pdu.Value.(type) {
+	case int:
+		return v
+	case uint:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint64:
+		return int(v)
+	case uint32:
+		return int(v)
+	}
+	return 0
+}
+
+//chassisMac is the hex mac sapi records for a chassis id, an agent not
+//telling the subtype gets the raw id in hex as before
+func chassisMac(id LldpId, raw []byte) string {
+	if id.Subtype == 0 {
+		return hex.EncodeToString(raw)
+	}
+	return id.Mac()
+}
+
 type LLDP struct {
 	Local  *LocalData             `json:"local"`
 	Remote map[string]*RemoteData `json:"remote"`
@@ -99,9 +178,19 @@ func (lldp *LLDP) String() string {
 	return string(b)
 }
 
+//oidIndex returns the index parts of an instance of the object oid
+func oidIndex(name, oid string) []string {
+	index := strings.TrimPrefix(strings.TrimPrefix(name, "."+oid), ".")
+	if index == "" {
+		return nil
+	}
+	return strings.Split(index, ".")
+}
+
+//isOid returns the object of ll that oid is or is an instance of
 func isOid(oid string, ll map[string]string) string {
 	for k, _ := range ll {
-		if strings.HasPrefix(oid, "."+k) {
+		if oid == "."+k || strings.HasPrefix(oid, "."+k+".") {
 			return k
 		}
 	}
@@ -110,83 +199,130 @@ func isOid(oid string, ll map[string]string) string {
 
 func parseLocalData(res []g.SnmpPDU) *LocalData {
 	l := newl()
+	chassis := newIds()
+	ports := newIds()
 
 	for _, pdu := range res {
 		t := isOid(pdu.Name, lldpLocal)
+		tmp := strings.Split(pdu.Name, ".")
 		switch t {
+		case lldpLocChassisIdSubtype:
+			chassis.subtypes[""] = pduInt(pdu)
 		case lldpLocChassisId:
-			l.MacAddress = hex.EncodeToString(pdu.Value.([]byte))
+			chassis.raw[""] = pduBytes(pdu)
 		case lldpLocSysName:
-			l.SysName = string(pdu.Value.([]byte))
+			l.SysName = string(pduBytes(pdu))
 		case lldpLocSysDesc:
-			l.SysDesc = string(pdu.Value.([]byte))
+			l.SysDesc = string(pduBytes(pdu))
+		case lldpLocPortIdSubtype:
+			ports.subtypes[tmp[len(tmp)-1]] = pduInt(pdu)
 		case lldpLocPorts:
-			tmp := strings.Split(pdu.Name, ".")
 			index := tmp[len(tmp)-1]
-			_, ok := l.Ports[index]
-			if !ok {
-				l.Ports[index] = string(pdu.Value.([]byte))
+			if _, ok := ports.raw[index]; !ok {
+				ports.raw[index] = pduBytes(pdu)
 			}
+		case lldpLocPortDesc:
+			l.PortDescs[tmp[len(tmp)-1]] = string(pduBytes(pdu))
 		case lldpLocManAddress:
-			tmp := strings.Split(pdu.Name, ".")
-			ip := strings.Join(tmp[len(tmp)-4:], ".")
-			index := strconv.Itoa(pdu.Value.(int))
-			_, ok := l.ManAddress[index]
-			if !ok {
+			ip, ok := manAddr(oidIndex(pdu.Name, t))
+			index := strconv.Itoa(pduInt(pdu))
+			if ok && betterAddr(l.ManAddress[index], ip) {
 				l.ManAddress[index] = ip
 			}
 		}
 	}
+
+	if raw, ok := chassis.raw[""]; ok {
+		l.ChassisId = decodeChassisId(chassis.subtypes[""], raw)
+		l.MacAddress = chassisMac(l.ChassisId, raw)
+	}
+	for index, raw := range ports.raw {
+		subtype, ok := ports.subtypes[index]
+		if !ok {
+			//the port id as text, as sapi always read it
+			subtype = PortLocal
+		}
+		id := decodePortId(subtype, raw)
+		l.PortIds[index] = id
+		l.Ports[index] = id.Value
+	}
 	return l
 }
 
 func parseRemoteData(res []g.SnmpPDU) map[string]*RemoteData {
 	var index string
 	r := make(map[string]*RemoteData)
+	chassis := newIds()
+	ports := newIds()
 
 	for _, pdu := range res {
 		t := isOid(pdu.Name, lldpRemote)
-		tmp := strings.Split(pdu.Name, ".")
-		index = tmp[len(tmp)-2]
-		if t == lldpRemManAddress {
-			index = tmp[len(tmp)-8]
-		}
 		if t == "" {
 			continue
 		}
+		//rows are indexed by time mark, local port and remote index
+		tmp := oidIndex(pdu.Name, t)
+		if len(tmp) < 3 {
+			continue
+		}
+		index = tmp[1]
 		_, ok := r[index]
 		if !ok {
 			r[index] = newr()
 		}
 		r[index].Index = index
 		switch t {
+		case lldpRemChassisIdSubtype:
+			chassis.subtypes[index] = pduInt(pdu)
 		case lldpRemChassisId:
-			r[index].RemMacAddress = hex.EncodeToString(pdu.Value.([]byte))
+			chassis.raw[index] = pduBytes(pdu)
+		case lldpRemPortIdSubtype:
+			ports.subtypes[index] = pduInt(pdu)
+		case lldpRemPortId:
+			ports.raw[index] = pduBytes(pdu)
 		case lldpRemManAddress:
-			r[index].RemManAddress = strings.Join(tmp[len(tmp)-4:len(tmp)], ".")
+			ip, ok := manAddr(tmp[3:])
+			if ok && betterAddr(r[index].RemManAddress, ip) {
+				r[index].RemManAddress = ip
+			}
 		case lldpRemSysName:
-			r[index].RemSysName = string(pdu.Value.([]byte))
+			r[index].RemSysName = string(pduBytes(pdu))
 		case lldpRemSysDesc:
-			r[index].RemSysDesc = string(pdu.Value.([]byte))
+			r[index].RemSysDesc = string(pduBytes(pdu))
 		case lldpRemPortDesc:
-			r[index].RemPortDesc = string(pdu.Value.([]byte))
+			r[index].RemPortDesc = string(pduBytes(pdu))
+		case lldpRemSysCapEnabled:
+			r[index].RemSysCapEnabled = decodeCapabilities(pduBytes(pdu))
 		}
 	}
 
+	for index, raw := range chassis.raw {
+		id := decodeChassisId(chassis.subtypes[index], raw)
+		r[index].RemChassisId = id
+		r[index].RemMacAddress = chassisMac(id, raw)
+	}
+	for index, raw := range ports.raw {
+		r[index].RemPortId = decodePortId(ports.subtypes[index], raw)
+	}
 	return r
 }
 
-func retrieve(target string, community string, t time.Duration) (*LLDP, error) {
-	gs := NewSnmpAgent().
-		Target(target).
-		Community(community).
-		Timeout(t).
-		Version(g.Version2c).GS()
+//retrieve walks the lldp tables through the agent, its timeout bounds
+//every request and deadline the whole walk.
+func retrieve(sa *SnmpAgent, deadline time.Duration) (lldp *LLDP, err error) {
+	gs := sa.GS()
 
-	err := gs.Connect()
+	err = gs.Connect()
 	if err != nil {
 		return nil, err
 	}
+	//closing the connection cuts a walk short at the deadline
+	expired := time.AfterFunc(deadline, func() { gs.Conn.Close() })
+	defer func() {
+		if !expired.Stop() {
+			lldp, err = nil, ErrorPollDeadline
+		}
+	}()
 	defer gs.Conn.Close()
 
 	res, err := gs.WalkAll(LocalDataOid)
@@ -204,26 +340,110 @@ func retrieve(target string, community string, t time.Duration) (*LLDP, error) {
 	return &LLDP{l, d}, nil
 }
 
-func GetTopology(tors []string, community string, t time.Duration) (map[string][]*Topology, map[string][]string) {
-	var tp1 = make(map[string][]*Topology)
-	var tp2 = make(map[string][]string)
+//pollTor polls one tor with its snmp credentials and resolves the hosts
+//behind it
+func pollTor(tor string, t, deadline time.Duration) (map[string][]*Topology, map[string][]string, error) {
+	creds, err := snmpCredentials(tor)
+	var lldp *LLDP
+	if err == nil {
+		lldp, err = retrieve(creds.agent(tor, t), deadline)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	tp1Tmp, found := lldp.resolveTopology()
+	recordNeighbors(tor, found)
+	tp1 := make(map[string][]*Topology)
+	for _, v := range tp1Tmp {
+		tp1[v.TorIp] = append(tp1[v.TorIp], v)
+	}
+	return tp1, topologySimple(tp1Tmp), nil
+}
 
-	for _, tor := range tors {
-		lldp, err := retrieve(tor, community, t)
-		if err != nil {
-			continue
-		}
-		tp1Tmp := lldp.resolveTopology()
-		tp2Tmp := topologySimple(tp1Tmp)
+//PollStatus is the outcome of the lldp polls of a tor. Failures counts the
+//failed polls since the last success, Stale tells the topology of the tor
+//is the last known one.
+type PollStatus struct {
+	Time          time.Time  `json:"time"`
+	Error         string     `json:"error,omitempty"`
+	LastSuccess   *time.Time `json:"last_success,omitempty"`
+	Failures      int        `json:"failures"`
+	TotalFailures int        `json:"total_failures"`
+	Stale         bool       `json:"stale"`
+}
 
-		for _, v := range tp1Tmp {
-			tp1[v.TorIp] = append(tp1[v.TorIp], v)
-		}
-		for k, v := range tp2Tmp {
-			tp2[k] = v
-		}
+//recordPoll counts a poll of a tor and returns the status after it
+func recordPoll(tor string, err error) PollStatus {
+	pollsMu.Lock()
+	defer pollsMu.Unlock()
+	status, ok := polls[tor]
+	if !ok {
+		status = new(PollStatus)
+		polls[tor] = status
+	}
+	status.Time = time.Now()
+	if err == nil {
+		t := status.Time
+		status.Error = ""
+		status.LastSuccess = &t
+		status.Failures = 0
+		status.Stale = false
+		return *status
+	}
+	status.Error = err.Error()
+	status.Failures++
+	status.TotalFailures++
+	status.Stale = status.LastSuccess != nil
+	return *status
+}
+
+//loadedPoll counts stored links of a tor last seen at t as its last
+//successful poll
+func loadedPoll(tor string, t time.Time) {
+	pollsMu.Lock()
+	defer pollsMu.Unlock()
+	if _, ok := polls[tor]; ok {
+		return
+	}
+	polls[tor] = &PollStatus{Time: t, LastSuccess: &t, Stale: true}
+}
+
+//expirePoll notes the last known topology of a tor is no longer served
+func expirePoll(tor string) {
+	pollsMu.Lock()
+	if status, ok := polls[tor]; ok {
+		status.Stale = false
+	}
+	pollsMu.Unlock()
+}
+
+func forgetPoll(tor string) {
+	pollsMu.Lock()
+	delete(polls, tor)
+	pollsMu.Unlock()
+}
+
+func lastPoll(tor string) *PollStatus {
+	pollsMu.Lock()
+	defer pollsMu.Unlock()
+	status, ok := polls[tor]
+	if !ok {
+		return nil
+	}
+	copied := *status
+	return &copied
+}
+
+//allPolls returns the poll status of every tor polled
+func allPolls() map[string]*PollStatus {
+	pollsMu.Lock()
+	defer pollsMu.Unlock()
+	every := make(map[string]*PollStatus)
+	for tor, status := range polls {
+		copied := *status
+		every[tor] = &copied
 	}
-	return tp1, tp2
+	return every
 }
 
 //Topology got by lldp information
@@ -237,6 +457,8 @@ type Topology struct {
 	Ip            string
 	Mac           string
 	SysDesc       string
+	FirstSeen     time.Time
+	LastSeen      time.Time
 }
 
 func (t *Topology) String() string {
@@ -244,9 +466,12 @@ func (t *Topology) String() string {
 	return string(b)
 }
 
-func (lldp *LLDP) resolveTopology() map[string]*Topology {
+//resolveTopology returns the hosts behind the tor ports and every neighbor
+//as classified by the host rules
+func (lldp *LLDP) resolveTopology() (map[string]*Topology, []*Neighbor) {
 	var index, ip string
 	topo := make(map[string]*Topology)
+	found := []*Neighbor{}
 
 	tor := lldp.Local.SysName
 	for index, ip = range lldp.Local.ManAddress {
@@ -257,7 +482,14 @@ func (lldp *LLDP) resolveTopology() map[string]*Topology {
 	torIp := ip
 
 	for index, rem := range lldp.Remote {
-		if !checkForLinux(rem.RemSysDesc) {
+		port := lldp.Local.Ports[index]
+		if port == "" {
+			port = lldp.Local.PortDescs[index]
+		}
+		n := neighborOf(torIp, index, port, rem)
+		n.TorName = tor
+		found = append(found, n)
+		if !n.Host {
 			continue
 		}
 
@@ -267,26 +499,15 @@ func (lldp *LLDP) resolveTopology() map[string]*Topology {
 				TorIp: torIp}
 		}
 		topo[index].Host = rem.RemSysName
-		topo[index].HostInterface = rem.RemPortDesc
+		topo[index].HostInterface = rem.Interface()
 		topo[index].SysDesc = rem.RemSysDesc
-		topo[index].Mac = rem.RemMacAddress
+		topo[index].Mac = n.Mac
 		topo[index].Ip = rem.RemManAddress
-		topo[index].IndexName = lldp.Local.Ports[index]
+		topo[index].IndexName = port
 		topo[index].Index = index
 	}
 
-	return topo
-}
-
-func checkForLinux(desc string) bool {
-	var linux = []string{"Linux", "Ubuntu"}
-
-	for _, s1 := range linux {
-		if strings.Contains(desc, s1) {
-			return true
-		}
-	}
-	return false
+	return topo, found
 }
 
 func topologySimple(topo map[string]*Topology) map[string][]string {
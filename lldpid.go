@@ -0,0 +1,228 @@
+package sapi
+
+import (
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//chassis id subtypes, IEEE 802.1AB LldpChassisIdSubtype
+const (
+	ChassisComponent  = 1
+	ChassisIfAlias    = 2
+	ChassisPort       = 3
+	ChassisMacAddress = 4
+	ChassisNetAddress = 5
+	ChassisIfName     = 6
+	ChassisLocal      = 7
+)
+
+//port id subtypes, IEEE 802.1AB LldpPortIdSubtype
+const (
+	PortIfAlias      = 1
+	PortComponent    = 2
+	PortMacAddress   = 3
+	PortNetAddress   = 4
+	PortIfName       = 5
+	PortAgentCircuit = 6
+	PortLocal        = 7
+)
+
+//IANA address families of network address ids and management addresses
+const (
+	AddrIPv4 = 1
+	AddrIPv6 = 2
+	AddrDNS  = 16
+)
+
+var (
+	chassisSubtypes = map[int]string{
+		ChassisComponent:  "chassisComponent",
+		ChassisIfAlias:    "interfaceAlias",
+		ChassisPort:       "portComponent",
+		ChassisMacAddress: "macAddress",
+		ChassisNetAddress: "networkAddress",
+		ChassisIfName:     "interfaceName",
+		ChassisLocal:      "local",
+	}
+	portSubtypes = map[int]string{
+		PortIfAlias:      "interfaceAlias",
+		PortComponent:    "portComponent",
+		PortMacAddress:   "macAddress",
+		PortNetAddress:   "networkAddress",
+		PortIfName:       "interfaceName",
+		PortAgentCircuit: "agentCircuitId",
+		PortLocal:        "local",
+	}
+)
+
+//system capabilities, IEEE 802.1AB LldpSystemCapabilitiesMap bit order
+var sysCapabilities = []string{"other", "repeater", "bridge", "wlanAccessPoint",
+	"router", "telephone", "docsisCableDevice", "stationOnly"}
+
+func capabilityBit(name string) int {
+	for bit, c := range sysCapabilities {
+		if c == name {
+			return bit
+		}
+	}
+	return -1
+}
+
+//decodeCapabilities returns the capabilities set in an snmp BITS value,
+//bit 0 is the high bit of the first octet
+func decodeCapabilities(raw []byte) []string {
+	enabled := []string{}
+	for bit, c := range sysCapabilities {
+		if bit/8 < len(raw) && raw[bit/8]&(0x80>>uint(bit%8)) != 0 {
+			enabled = append(enabled, c)
+		}
+	}
+	return enabled
+}
+
+//LldpId is a decoded chassis or port id. Value is a mac as aa:bb:cc:dd:ee:ff,
+//a network address as an ip, text ids as text and anything else as hex.
+type LldpId struct {
+	Subtype int    `json:"subtype"`
+	Kind    string `json:"kind"`
+	Value   string `json:"value"`
+}
+
+//Mac returns the id as the hex mac sapi records, empty if it is no mac
+func (id *LldpId) Mac() string {
+	hw, err := net.ParseMAC(id.Value)
+	if id.Kind != "macAddress" || err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hw)
+}
+
+func decodeChassisId(subtype int, raw []byte) LldpId {
+	id := LldpId{Subtype: subtype, Kind: chassisSubtypes[subtype]}
+	switch subtype {
+	case ChassisMacAddress:
+		id.Value = decodeMac(raw)
+	case ChassisNetAddress:
+		id.Value = decodeNetAddress(raw)
+	case ChassisComponent, ChassisIfAlias, ChassisPort, ChassisIfName, ChassisLocal:
+		id.Value = decodeText(raw)
+	default:
+		id.Kind = "unknown"
+		id.Value = hex.EncodeToString(raw)
+	}
+	return id
+}
+
+func decodePortId(subtype int, raw []byte) LldpId {
+	id := LldpId{Subtype: subtype, Kind: portSubtypes[subtype]}
+	switch subtype {
+	case PortMacAddress:
+		id.Value = decodeMac(raw)
+	case PortNetAddress:
+		id.Value = decodeNetAddress(raw)
+	case PortIfAlias, PortComponent, PortIfName, PortAgentCircuit, PortLocal:
+		id.Value = decodeText(raw)
+	default:
+		id.Kind = "unknown"
+		id.Value = hex.EncodeToString(raw)
+	}
+	return id
+}
+
+func decodeMac(raw []byte) string {
+	if len(raw) != 6 {
+		return hex.EncodeToString(raw)
+	}
+	return net.HardwareAddr(raw).String()
+}
+
+//decodeNetAddress decodes an IANA address family octet and the address
+func decodeNetAddress(raw []byte) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	if addr, ok := decodeAddress(int(raw[0]), raw[1:]); ok {
+		return addr
+	}
+	return hex.EncodeToString(raw)
+}
+
+//decodeAddress returns an ip of the family as text, a DNS name as is and
+//false for anything else
+func decodeAddress(family int, raw []byte) (string, bool) {
+	switch {
+	case family == AddrIPv4 && len(raw) == net.IPv4len:
+		return net.IP(raw).String(), true
+	case family == AddrIPv6 && len(raw) == net.IPv6len:
+		return net.IP(raw).String(), true
+	case family == AddrDNS && len(raw) > 0:
+		s := decodeText(raw)
+		return s, s != hex.EncodeToString(raw)
+	}
+	return "", false
+}
+
+//manAddr decodes the index of a management address row, the address
+//family and the length prefixed address. Agents leaving out the length
+//are tolerated for ips.
+func manAddr(index []string) (string, bool) {
+	parts := make([]int, len(index))
+	for i, part := range index {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 255 {
+			return "", false
+		}
+		parts[i] = n
+	}
+	if len(parts) < 2 {
+		return "", false
+	}
+	family, rest := parts[0], parts[1:]
+	if rest[0] == len(rest)-1 {
+		rest = rest[1:]
+	} else if family == AddrDNS {
+		return "", false
+	}
+	raw := make([]byte, len(rest))
+	for i, n := range rest {
+		raw[i] = byte(n)
+	}
+	if addr, ok := decodeAddress(family, raw); ok {
+		return addr, true
+	}
+	return hex.EncodeToString(raw), len(raw) > 0
+}
+
+//addrRank orders management addresses, ipv4 over ipv6 over the rest
+func addrRank(addr string) int {
+	ip := net.ParseIP(addr)
+	switch {
+	case addr == "":
+		return 0
+	case ip == nil:
+		return 1
+	case ip.To4() == nil:
+		return 2
+	}
+	return 3
+}
+
+//betterAddr tells whether addr is to replace the management address cur
+func betterAddr(cur, addr string) bool {
+	return addrRank(addr) > addrRank(cur)
+}
+
+//decodeText keeps printable ids as text, some agents send binary ids in
+//the text subtypes
+func decodeText(raw []byte) string {
+	s := strings.TrimRight(string(raw), "\x00")
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return hex.EncodeToString(raw)
+		}
+	}
+	return s
+}
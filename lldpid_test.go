@@ -0,0 +1,156 @@
+package sapi
+
+import (
+	"strings"
+	"testing"
+
+	g "github.com/soniah/gosnmp"
+)
+
+func TestDecodeLldpId(t *testing.T) {
+	mac := []byte{0x00, 0x1b, 0x21, 0x3c, 0x4d, 0x5e}
+	cases := []struct {
+		id    LldpId
+		kind  string
+		value string
+	}{
+		{decodeChassisId(ChassisMacAddress, mac), "macAddress", "00:1b:21:3c:4d:5e"},
+		{decodeChassisId(ChassisNetAddress, []byte{1, 10, 0, 0, 1}), "networkAddress", "10.0.0.1"},
+		{decodeChassisId(ChassisNetAddress, append([]byte{2, 0x20, 0x01, 0x0d, 0xb8}, make([]byte, 12)...)),
+			"networkAddress", "2001:db8::"},
+		{decodeChassisId(ChassisLocal, []byte("sw-01")), "local", "sw-01"},
+		{decodeChassisId(ChassisComponent, []byte{0x01, 0x02}), "chassisComponent", "0102"},
+		{decodeChassisId(9, []byte{0xff}), "unknown", "ff"},
+		{decodePortId(PortMacAddress, mac), "macAddress", "00:1b:21:3c:4d:5e"},
+		{decodePortId(PortIfName, []byte("eth0\x00")), "interfaceName", "eth0"},
+		{decodePortId(PortIfAlias, []byte("uplink")), "interfaceAlias", "uplink"},
+		{decodePortId(PortAgentCircuit, []byte("c1")), "agentCircuitId", "c1"},
+		{decodePortId(PortLocal, []byte("Ten-GigabitEthernet1/0/1")), "local", "Ten-GigabitEthernet1/0/1"},
+		{decodePortId(PortNetAddress, []byte{1, 192, 168, 1, 2}), "networkAddress", "192.168.1.2"},
+		{decodePortId(PortMacAddress, []byte{0x01}), "macAddress", "01"},
+	}
+	for _, c := range cases {
+		if c.id.Kind != c.kind || c.id.Value != c.value {
+			t.Errorf("Expected %s %s, got %s %s", c.kind, c.value, c.id.Kind, c.id.Value)
+		}
+	}
+
+	id := decodeChassisId(ChassisMacAddress, mac)
+	if id.Mac() != "001b213c4d5e" {
+		t.Errorf("Expected mac 001b213c4d5e, got %s", id.Mac())
+	}
+	id = decodeChassisId(ChassisLocal, []byte("sw-01"))
+	if id.Mac() != "" {
+		t.Errorf("Expected no mac, got %s", id.Mac())
+	}
+}
+
+func TestParseLldpIds(t *testing.T) {
+	mac := []byte{0x00, 0x1b, 0x21, 0x3c, 0x4d, 0x5e}
+	local := []g.SnmpPDU{
+		{Name: "." + lldpLocChassisIdSubtype, Value: ChassisLocal},
+		{Name: "." + lldpLocChassisId, Value: []byte("tor-1")},
+		{Name: "." + lldpLocSysName, Value: []byte("tor-1")},
+		{Name: "." + lldpLocPorts + ".1", Value: []byte("GE1/0/1")},
+		{Name: "." + lldpLocPortDesc + ".1", Value: []byte("GigabitEthernet1/0/1")},
+		{Name: "." + lldpLocPortIdSubtype + ".2", Value: PortMacAddress},
+		{Name: "." + lldpLocPorts + ".2", Value: mac},
+		{Name: "." + lldpLocPortDesc + ".2", Value: []byte("GigabitEthernet1/0/2")},
+		{Name: "." + lldpLocManAddress + ".1.4.10.0.0.1", Value: 1},
+	}
+	l := parseLocalData(local)
+	if l.ChassisId.Kind != "local" || l.ChassisId.Value != "tor-1" || l.MacAddress != "" {
+		t.Errorf("Expected local chassis tor-1, got %v %s", l.ChassisId, l.MacAddress)
+	}
+	if l.Ports["1"] != "GE1/0/1" || l.PortIds["1"].Subtype != PortLocal {
+		t.Errorf("Expected port 1 GE1/0/1, got %v", l.PortIds["1"])
+	}
+	if l.Ports["2"] != "00:1b:21:3c:4d:5e" || l.PortIds["2"].Kind != "macAddress" {
+		t.Errorf("Expected port 2 a mac, got %v", l.PortIds["2"])
+	}
+	if l.PortDescs["2"] != "GigabitEthernet1/0/2" {
+		t.Errorf("Expected port 2 description, got %s", l.PortDescs["2"])
+	}
+	if l.ManAddress["1"] != "10.0.0.1" {
+		t.Errorf("Expected man address 10.0.0.1, got %s", l.ManAddress["1"])
+	}
+
+	remote := []g.SnmpPDU{
+		{Name: "." + lldpRemChassisIdSubtype + ".0.1.1", Value: ChassisMacAddress},
+		{Name: "." + lldpRemChassisId + ".0.1.1", Value: mac},
+		{Name: "." + lldpRemPortIdSubtype + ".0.1.1", Value: PortIfName},
+		{Name: "." + lldpRemPortId + ".0.1.1", Value: []byte("eth0")},
+		{Name: "." + lldpRemSysName + ".0.1.1", Value: []byte("host-1")},
+		{Name: "." + lldpRemSysDesc + ".0.1.1", Value: []byte("Ubuntu 16.04")},
+		{Name: "." + lldpRemPortIdSubtype + ".0.2.1", Value: PortMacAddress},
+		{Name: "." + lldpRemPortId + ".0.2.1", Value: mac},
+		{Name: "." + lldpRemChassisIdSubtype + ".0.2.1", Value: ChassisLocal},
+		{Name: "." + lldpRemChassisId + ".0.2.1", Value: []byte("host-2")},
+		{Name: "." + lldpRemPortDesc + ".0.2.1", Value: []byte("eth1")},
+		{Name: "." + lldpRemSysName + ".0.2.1", Value: []byte("host-2")},
+		{Name: "." + lldpRemSysDesc + ".0.2.1", Value: []byte("Linux")},
+	}
+	r := parseRemoteData(remote)
+	if r["1"].RemMacAddress != "001b213c4d5e" || r["1"].RemPortId.Value != "eth0" {
+		t.Errorf("Expected remote 1 mac and eth0, got %s", r["1"])
+	}
+	if r["2"].RemMacAddress != "" || r["2"].RemChassisId.Value != "host-2" {
+		t.Errorf("Expected remote 2 local chassis, got %s", r["2"])
+	}
+
+	topo, _ := (&LLDP{Local: l, Remote: r}).resolveTopology()
+	if topo["1"].HostInterface != "eth0" || topo["1"].IndexName != "GE1/0/1" {
+		t.Errorf("Expected eth0 on GE1/0/1, got %s", topo["1"])
+	}
+	if topo["2"].HostInterface != "eth1" || topo["2"].Mac != "001b213c4d5e" {
+		t.Errorf("Expected eth1 with the port mac, got %s", topo["2"])
+	}
+}
+
+func TestManAddr(t *testing.T) {
+	v6 := "2.16.32.1.13.184.0.0.0.0.0.0.0.0.0.0.0.1"
+	cases := []struct {
+		index string
+		addr  string
+		ok    bool
+	}{
+		{"1.4.10.0.0.1", "10.0.0.1", true},
+		{"1.10.0.0.1", "10.0.0.1", true},
+		{v6, "2001:db8::1", true},
+		{"16.6.115.119.46.110.101.116", "sw.net", true},
+		{"16.115.119", "", false},
+		{"1.4.300.0.0.1", "", false},
+		{"1", "", false},
+	}
+	for _, c := range cases {
+		addr, ok := manAddr(strings.Split(c.index, "."))
+		if addr != c.addr || ok != c.ok {
+			t.Errorf("Expected %s %v for %s, got %s %v", c.addr, c.ok, c.index, addr, ok)
+		}
+	}
+
+	if !betterAddr("2001:db8::1", "10.0.0.1") || betterAddr("10.0.0.1", "2001:db8::1") {
+		t.Errorf("Expected ipv4 management addresses first")
+	}
+	if !betterAddr("sw.net", "2001:db8::1") || !betterAddr("", "sw.net") {
+		t.Errorf("Expected ips before names")
+	}
+
+	remote := []g.SnmpPDU{
+		{Name: "." + lldpRemSysName + ".0.3.1", Value: []byte("host-3")},
+		{Name: "." + lldpRemManAddress + ".0.3.1." + v6, Value: 2},
+	}
+	r := parseRemoteData(remote)
+	if r["3"] == nil || r["3"].RemManAddress != "2001:db8::1" {
+		t.Errorf("Expected remote 3 at 2001:db8::1, got %v", r["3"])
+	}
+
+	local := []g.SnmpPDU{
+		{Name: "." + lldpLocManAddress + "." + v6, Value: 1},
+		{Name: "." + lldpLocPorts + ".1", Value: []byte("GE1/0/1")},
+	}
+	l := parseLocalData(local)
+	if l.ManAddress["1"] != "2001:db8::1" {
+		t.Errorf("Expected man address 2001:db8::1, got %s", l.ManAddress["1"])
+	}
+}
@@ -0,0 +1,406 @@
+package sapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	gosync "sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-xorm/xorm"
+)
+
+const (
+	//operation kind of a mesh reconciliation
+	OpMesh = "mesh"
+)
+
+var (
+	meshPath     = "/mesh"
+	meshInterval = time.Minute * 10
+
+	//one reconciliation at a time, scheduled or on demand
+	meshMu gosync.Mutex
+)
+
+//meshPlan is what it takes to bring one tor to the full mesh
+type meshPlan struct {
+	//tunnel destinations to build
+	Create []string `json:"create"`
+	//switch tunnels to remove, duplicates or to sources neither registered
+	//nor reported by tsync
+	Delete []Tunnel `json:"delete"`
+	//switch tunnels sapi did not record
+	Record []Tunnel `json:"record"`
+	//records of tunnels the switch does not have
+	Forget []Tunnel `json:"forget"`
+}
+
+func (p *meshPlan) empty() bool {
+	return len(p.Create)+len(p.Delete)+len(p.Record)+len(p.Forget) == 0
+}
+
+//MeshReport is the reconciliation result of one tor
+type MeshReport struct {
+	Tor   string    `json:"tor"`
+	Plan  *meshPlan `json:"plan,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+//SetMeshInterval sets how often the tunnel mesh is reconciled, 0 only
+//reconciles on demand.
+func SetMeshInterval(d time.Duration) {
+	meshInterval = d
+}
+
+//SapiTunnelEndpoints are the tunnel sources outside sapi tsync reported to
+//a tor, the mesh of the tor keeps its tunnels to them.
+type SapiTunnelEndpoints struct {
+	Id    int    `xorm:"pk autoincr"`
+	TorIp string `xorm:"varchar(45) unique(endpoint)"`
+	Addr  string `xorm:"varchar(45) unique(endpoint)"`
+}
+
+//recordEndpoints keeps the endpoints tsync reported to a tor
+func recordEndpoints(s *xorm.Session, tor string, addrs []string) error {
+	for _, addr := range addrs {
+		has, err := s.Get(&SapiTunnelEndpoints{TorIp: tor, Addr: addr})
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		if _, err := s.Insert(&SapiTunnelEndpoints{TorIp: tor, Addr: addr}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func endpointsOf(tor string) ([]string, error) {
+	rows := make([]*SapiTunnelEndpoints, 0)
+	if err := DB().Where("tor_ip=?", tor).Find(&rows); err != nil {
+		return nil, err
+	}
+	addrs := []string{}
+	for _, row := range rows {
+		addrs = append(addrs, row.Addr)
+	}
+	return addrs, nil
+}
+
+//expectedMesh returns the tunnel destinations a tor needs, one per tunnel
+//source of every other tor and per endpoint tsync reported to the tor.
+//Tors of a mlag pair may share a source.
+func expectedMesh(tor *SapiTor, sapiTors []*SapiTor, endpoints []string) []string {
+	seen := make(map[string]bool)
+	dsts := []string{}
+	srcs := endpoints
+	for _, peer := range sapiTors {
+		srcs = append(srcs, peer.TunnelSrcIp)
+	}
+	for _, src := range srcs {
+		if src == "" || src == tor.TunnelSrcIp || seen[src] {
+			continue
+		}
+		seen[src] = true
+		dsts = append(dsts, src)
+	}
+	sort.Strings(dsts)
+	return dsts
+}
+
+//meshOf is the expected mesh of a tor with its stored endpoints
+func meshOf(tor *SapiTor, sapiTors []*SapiTor) ([]string, error) {
+	endpoints, err := endpointsOf(tor.TorIp)
+	if err != nil {
+		return nil, err
+	}
+	return expectedMesh(tor, sapiTors, endpoints), nil
+}
+
+//planMesh compares the expected mesh of a tor with its tunnel records and
+//the tunnels read back from the switch. Only switch tunnels from the tor's
+//own source are touched, queued tunnel jobs are not planned again.
+func planMesh(tor *SapiTor, expected []string, recorded []*SapiTorTunnels,
+	onSwitch []Tunnel, creating map[string]bool, deleting map[int]bool) *meshPlan {
+	plan := &meshPlan{
+		Create: []string{},
+		Delete: []Tunnel{},
+		Record: []Tunnel{},
+		Forget: []Tunnel{}}
+
+	want := make(map[string]bool)
+	for _, dst := range expected {
+		want[dst] = true
+	}
+	byDst := make(map[string][]Tunnel)
+	present := make(map[int]bool)
+	for _, t := range onSwitch {
+		if t.Src != tor.TunnelSrcIp || t.Id == 0 {
+			continue
+		}
+		present[t.Id] = true
+		byDst[t.Dst] = append(byDst[t.Dst], t)
+	}
+	records := make(map[string][]*SapiTorTunnels)
+	for _, r := range recorded {
+		records[r.DstAddr] = append(records[r.DstAddr], r)
+	}
+
+	for _, dst := range expected {
+		tunnels := byDst[dst]
+		sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Id < tunnels[j].Id })
+		if len(tunnels) == 0 {
+			if !creating[dst] {
+				plan.Create = append(plan.Create, dst)
+			}
+			for _, r := range records[dst] {
+				plan.Forget = append(plan.Forget, Tunnel{Id: r.TunnelId, Src: tor.TunnelSrcIp, Dst: dst})
+			}
+			continue
+		}
+		keep := tunnels[0]
+		for _, extra := range tunnels[1:] {
+			if !deleting[extra.Id] {
+				plan.Delete = append(plan.Delete, extra)
+			}
+		}
+		kept := 0
+		for _, r := range records[dst] {
+			if r.TunnelId == keep.Id {
+				kept++
+			} else if !present[r.TunnelId] {
+				plan.Forget = append(plan.Forget, Tunnel{Id: r.TunnelId, Src: tor.TunnelSrcIp, Dst: dst})
+			}
+		}
+		//duplicate records are dropped and written once again
+		if kept > 1 {
+			plan.Forget = append(plan.Forget, keep)
+		}
+		if kept != 1 {
+			plan.Record = append(plan.Record, keep)
+		}
+	}
+
+	dsts := []string{}
+	for dst := range byDst {
+		dsts = append(dsts, dst)
+	}
+	sort.Strings(dsts)
+	for _, dst := range dsts {
+		if want[dst] {
+			continue
+		}
+		for _, t := range byDst[dst] {
+			if !deleting[t.Id] {
+				plan.Delete = append(plan.Delete, t)
+			}
+		}
+	}
+	for _, r := range recorded {
+		if !want[r.DstAddr] && !present[r.TunnelId] {
+			plan.Forget = append(plan.Forget, Tunnel{Id: r.TunnelId, Src: tor.TunnelSrcIp, Dst: r.DstAddr})
+		}
+	}
+	return plan
+}
+
+//queuedTunnels returns the tunnel jobs of a tor not finished yet
+func queuedTunnels(tor string) (map[string]bool, map[int]bool, error) {
+	creating := make(map[string]bool)
+	deleting := make(map[int]bool)
+	every := make([]*SapiConfigJobs, 0)
+	err := DB().Where("tor_ip=?", tor).In("state", []string{JobPending, JobRunning}).
+		In("kind", []string{JobTunnel, JobTunnelDelete}).Find(&every)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, job := range every {
+		var tunnel Tunnel
+		if json.Unmarshal([]byte(job.Payload), &tunnel) != nil {
+			continue
+		}
+		if job.Kind == JobTunnel {
+			creating[tunnel.Dst] = true
+		} else {
+			deleting[tunnel.Id] = true
+		}
+	}
+	return creating, deleting, nil
+}
+
+//applyMesh fixes the records and queues the switch changes in the
+//transaction of s, vsis are ensured once the new tunnels are built.
+func applyMesh(s *xorm.Session, op string, tor *SapiTor, plan *meshPlan) error {
+	for _, t := range plan.Forget {
+		//spelled out, a zero tunnel id is a condition as well
+		_, err := s.Where("tor_ip=? AND dst_addr=? AND tunnel_id=?", tor.TorIp, t.Dst, t.Id).Delete(new(SapiTorTunnels))
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range plan.Record {
+		if err := addNewTunnel(s, tor.TorIp, t.Dst, t.Id); err != nil {
+			return err
+		}
+	}
+	for _, t := range plan.Delete {
+		if err := enqueueJob(s, op, tor.TorIp, JobTunnelDelete, t); err != nil {
+			return err
+		}
+	}
+	for _, dst := range plan.Create {
+		if err := goTunnelSync(s, op, tor.TorIp, tor.TunnelSrcIp, dst); err != nil {
+			return err
+		}
+	}
+	if len(plan.Create) != 0 {
+		return enqueueJob(s, op, tor.TorIp, JobEnsure, struct{}{})
+	}
+	return nil
+}
+
+//reconcileMesh plans, and unless dryRun applies, the full tunnel mesh of
+//every tor. A tor whose switch cannot be read is left alone. The operation
+//of the repairs is only created when there is something to repair.
+func reconcileMesh(dryRun bool) (string, []*MeshReport, error) {
+	var op string
+	meshMu.Lock()
+	defer meshMu.Unlock()
+
+	sapiTors := make([]*SapiTor, 0)
+	if err := SelectAllTors(&sapiTors); err != nil {
+		return "", nil, err
+	}
+	sort.Slice(sapiTors, func(i, j int) bool { return sapiTors[i].TorIp < sapiTors[j].TorIp })
+
+	reports := []*MeshReport{}
+	for _, tor := range sapiTors {
+		report := &MeshReport{Tor: tor.TorIp}
+		reports = append(reports, report)
+
+		plan, err := torMeshPlan(tor, sapiTors)
+		if err != nil {
+			report.Error = err.Error()
+			Log().WithFields(logrus.Fields{
+				"Tor":   tor.TorIp,
+				"Error": err,
+			}).Warn("reconcileMesh: tor skipped")
+			continue
+		}
+		report.Plan = plan
+		if plan.empty() || dryRun {
+			continue
+		}
+		Log().WithFields(logrus.Fields{
+			"Tor":    tor.TorIp,
+			"Create": len(plan.Create),
+			"Delete": len(plan.Delete),
+			"Record": len(plan.Record),
+			"Forget": len(plan.Forget),
+		}).Info("reconcileMesh: repair tunnels")
+		if op == "" {
+			var err error
+			if op, err = newOperation(OpMesh); err != nil {
+				return "", nil, err
+			}
+		}
+		if err := queueJobs(func(s *xorm.Session) error {
+			return applyMesh(s, op, tor, plan)
+		}); err != nil {
+			return "", nil, err
+		}
+	}
+	return op, reports, nil
+}
+
+func torMeshPlan(tor *SapiTor, sapiTors []*SapiTor) (*meshPlan, error) {
+	d, err := driverFor(tor)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := d.ReadConfig(tor)
+	if err != nil {
+		return nil, err
+	}
+	recorded := make([]*SapiTorTunnels, 0)
+	if err := SelectAllTunnelByTor(tor.TorIp, &recorded); err != nil {
+		return nil, err
+	}
+	creating, deleting, err := queuedTunnels(tor.TorIp)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := meshOf(tor, sapiTors)
+	if err != nil {
+		return nil, err
+	}
+	return planMesh(tor, expected, recorded, conf.Tunnels, creating, deleting), nil
+}
+
+//GoMesh reconciles the tunnel mesh every meshInterval
+func GoMesh(done chan struct{}) {
+	if meshInterval <= 0 {
+		return
+	}
+	go func() {
+		Seconds := time.NewTimer(meshInterval)
+		for {
+			select {
+			case <-Seconds.C:
+				if _, _, err := reconcileMesh(false); err != nil {
+					Log().WithFields(logrus.Fields{"Error": err}).Error("GoMesh: reconcile error")
+				}
+				Seconds.Reset(meshInterval)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func writeMesh(rw http.ResponseWriter, code int, op string, reports []*MeshReport) {
+	rw.Header().Set("Content/Type", "application/json")
+	ret, _ := json.MarshalIndent(struct {
+		Operation string        `json:"operation,omitempty"`
+		Tors      []*MeshReport `json:"tors"`
+	}{
+		Operation: op,
+		Tors:      reports,
+	}, "", "    ")
+	rw.WriteHeader(code)
+	rw.Write(ret)
+}
+
+//showMesh reports what a reconciliation would change
+func showMesh(rw http.ResponseWriter, r *http.Request) {
+	_, reports, err := reconcileMesh(true)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	writeMesh(rw, http.StatusOK, "", reports)
+}
+
+//repairMesh reconciles the tunnel mesh now, the response carries the
+//operation of the repairs if any were needed.
+func repairMesh(rw http.ResponseWriter, r *http.Request) {
+	op, reports, err := reconcileMesh(false)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	code := http.StatusOK
+	if op != "" {
+		_, code = finishOperation(rw, r, op)
+	}
+	writeMesh(rw, code, op, reports)
+}
+
+func init() {
+	Regist(MakeApiEndpoints("GET", meshPath, http.HandlerFunc(showMesh)))
+	Regist(MakeApiEndpoints("POST", meshPath, http.HandlerFunc(repairMesh)))
+}
@@ -0,0 +1,69 @@
+package sapi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpectedMesh(t *testing.T) {
+	sapiTors := []*SapiTor{
+		{TorIp: "tor1", TunnelSrcIp: "1.1.1.1"},
+		{TorIp: "tor2", TunnelSrcIp: "2.2.2.2"},
+		//mlag pair sharing a source
+		{TorIp: "tor3", TunnelSrcIp: "3.3.3.3"},
+		{TorIp: "tor4", TunnelSrcIp: "3.3.3.3"},
+	}
+	got := expectedMesh(sapiTors[0], sapiTors, nil)
+	if !reflect.DeepEqual(got, []string{"2.2.2.2", "3.3.3.3"}) {
+		t.Errorf("Expected [2.2.2.2 3.3.3.3], got %v", got)
+	}
+	if got := expectedMesh(sapiTors[3], sapiTors, nil); !reflect.DeepEqual(got, []string{"1.1.1.1", "2.2.2.2"}) {
+		t.Errorf("Expected [1.1.1.1 2.2.2.2], got %v", got)
+	}
+	//endpoints tsync reported are kept beside the tors
+	got = expectedMesh(sapiTors[0], sapiTors, []string{"9.9.9.9", "2.2.2.2", "1.1.1.1"})
+	if !reflect.DeepEqual(got, []string{"2.2.2.2", "3.3.3.3", "9.9.9.9"}) {
+		t.Errorf("Expected [2.2.2.2 3.3.3.3 9.9.9.9], got %v", got)
+	}
+}
+
+func TestPlanMesh(t *testing.T) {
+	tor := &SapiTor{TorIp: "tor1", TunnelSrcIp: "1.1.1.1"}
+	expected := []string{"2.2.2.2", "3.3.3.3", "4.4.4.4", "5.5.5.5"}
+	recorded := []*SapiTorTunnels{
+		//failed build recorded with id 0
+		{TorIp: "tor1", TunnelId: 0, DstAddr: "2.2.2.2"},
+		{TorIp: "tor1", TunnelId: 3, DstAddr: "3.3.3.3"},
+		//tor deregistered, tunnel already gone
+		{TorIp: "tor1", TunnelId: 9, DstAddr: "9.9.9.9"},
+	}
+	onSwitch := []Tunnel{
+		{Id: 3, Src: "1.1.1.1", Dst: "3.3.3.3"},
+		{Id: 4, Src: "1.1.1.1", Dst: "4.4.4.4"},
+		{Id: 5, Src: "1.1.1.1", Dst: "4.4.4.4"},
+		{Id: 6, Src: "1.1.1.1", Dst: "8.8.8.8"},
+		//not built by sapi
+		{Id: 7, Src: "10.0.0.1", Dst: "8.8.8.8"},
+	}
+	creating := map[string]bool{"5.5.5.5": true}
+
+	plan := planMesh(tor, expected, recorded, onSwitch, creating, map[int]bool{})
+	if !reflect.DeepEqual(plan.Create, []string{"2.2.2.2"}) {
+		t.Errorf("Expected to create [2.2.2.2], got %v", plan.Create)
+	}
+	if !reflect.DeepEqual(plan.Delete, []Tunnel{{Id: 5, Src: "1.1.1.1", Dst: "4.4.4.4"}, {Id: 6, Src: "1.1.1.1", Dst: "8.8.8.8"}}) {
+		t.Errorf("Expected to delete tunnels 5 and 6, got %v", plan.Delete)
+	}
+	if !reflect.DeepEqual(plan.Record, []Tunnel{{Id: 4, Src: "1.1.1.1", Dst: "4.4.4.4"}}) {
+		t.Errorf("Expected to record tunnel 4, got %v", plan.Record)
+	}
+	if len(plan.Forget) != 2 || plan.Forget[0].Dst != "2.2.2.2" || plan.Forget[1].Id != 9 {
+		t.Errorf("Expected to forget tunnels to 2.2.2.2 and 9.9.9.9, got %v", plan.Forget)
+	}
+
+	//once repaired there is nothing left to do
+	done := planMesh(tor, []string{"3.3.3.3"}, recorded[1:2], onSwitch[:1], nil, nil)
+	if !done.empty() {
+		t.Errorf("Expected an empty plan, got %+v", done)
+	}
+}
@@ -0,0 +1,103 @@
+package sapi
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	gosync "sync"
+)
+
+var (
+	//tor ip -> mlag pair id, tors without a pair are absent
+	torPairs   = make(map[string]string)
+	torPairsMu gosync.RWMutex
+
+	pairPrefix = "pair:"
+
+	ErrorUplinkScope = errors.New("Host uplinks span tors outside one pair")
+)
+
+//Uplink is one link between a host and a tor interface
+type Uplink struct {
+	Tor   string `json:"tor"`
+	Index int    `json:"index"`
+}
+
+func pairScope(pair string) string {
+	return pairPrefix + pair
+}
+
+//torPair returns the pair of a tor, empty if it has none
+func torPair(tor string) string {
+	torPairsMu.RLock()
+	defer torPairsMu.RUnlock()
+	return torPairs[tor]
+}
+
+func pairMembers(pair string) []string {
+	members := []string{}
+	torPairsMu.RLock()
+	for tor, p := range torPairs {
+		if p == pair {
+			members = append(members, tor)
+		}
+	}
+	torPairsMu.RUnlock()
+	sort.Strings(members)
+	return members
+}
+
+func loadTorPairs() {
+	sapiTors := make([]*SapiTor, 0)
+	if err := SelectAllTors(&sapiTors); err != nil {
+		Log().Error(fmt.Sprintf("loadTorPairs: %s", err))
+		return
+	}
+	pairs := make(map[string]string)
+	for _, tor := range sapiTors {
+		if tor.PairId != "" {
+			pairs[tor.TorIp] = tor.PairId
+		}
+	}
+	torPairsMu.Lock()
+	torPairs = pairs
+	torPairsMu.Unlock()
+}
+
+//selectUplinks returns every tor interface the host is attached to, ordered
+//by tor and interface index.
+func selectUplinks(h string) []Uplink {
+	uplinks := []Uplink{}
+	tpMu.RLock()
+	for tor, items := range tp {
+		for _, item := range items {
+			if h == item.Host {
+				index, _ := strconv.Atoi(item.Index)
+				uplinks = append(uplinks, Uplink{Tor: tor, Index: index})
+			}
+		}
+	}
+	tpMu.RUnlock()
+	sort.Slice(uplinks, func(i, j int) bool {
+		if uplinks[i].Tor != uplinks[j].Tor {
+			return uplinks[i].Tor < uplinks[j].Tor
+		}
+		return uplinks[i].Index < uplinks[j].Index
+	})
+	return uplinks
+}
+
+//uplinkScope returns the allocation scope shared by all uplinks of a host,
+//a dual-homed host must hang off the two tors of one pair.
+func uplinkScope(uplinks []Uplink, shared bool) (string, error) {
+	scope := ""
+	for _, uplink := range uplinks {
+		s := allocationTor(uplink.Tor, shared)
+		if scope != "" && s != scope {
+			return "", ErrorUplinkScope
+		}
+		scope = s
+	}
+	return scope, nil
+}
@@ -0,0 +1,66 @@
+package sapi
+
+import (
+	"testing"
+)
+
+func TestSelectUplinks(t *testing.T) {
+	saved := tp
+	defer func() { tp = saved }()
+	tp = map[string][]*Topology{
+		"tor-b": []*Topology{&Topology{Host: "compute1", Index: "7"}},
+		"tor-a": []*Topology{
+			&Topology{Host: "compute2", Index: "1"},
+			&Topology{Host: "compute1", Index: "3"}},
+	}
+
+	uplinks := selectUplinks("compute1")
+	if len(uplinks) != 2 {
+		t.Fatalf("Expected %d uplinks, but got %d", 2, len(uplinks))
+	}
+	if uplinks[0] != (Uplink{Tor: "tor-a", Index: 3}) || uplinks[1] != (Uplink{Tor: "tor-b", Index: 7}) {
+		t.Errorf("Unexpected uplinks %v", uplinks)
+	}
+	if len(selectUplinks("compute3")) != 0 {
+		t.Errorf("Expected no uplinks for unknown host")
+	}
+}
+
+func TestPairVlan(t *testing.T) {
+	var vid uint32
+	savedPairs, savedTplv := torPairs, tplv
+	defer func() { torPairs, tplv = savedPairs, savedTplv }()
+	torPairs = map[string]string{"tor-a": "p1", "tor-b": "p1"}
+	tplv = map[string]*LocalVlan{}
+	for _, tor := range []string{"tor-a", "tor-b", "tor-c"} {
+		tplv[tor] = &LocalVlan{
+			Shared:   NewBitmap(uint32(vlanSharedMin), uint32(vlanSharedMax)),
+			Unshared: NewBitmap(uint32(vlanVpcMin), uint32(vlanVpcMax))}
+	}
+	tplv["tor-b"].Unshared.Setbit(2)
+
+	scope, err := uplinkScope([]Uplink{{Tor: "tor-a", Index: 1}, {Tor: "tor-b", Index: 1}}, false)
+	if err != nil || scope != pairScope("p1") {
+		t.Fatalf("Expected scope %s, got %s (%v)", pairScope("p1"), scope, err)
+	}
+	if _, err := uplinkScope([]Uplink{{Tor: "tor-a"}, {Tor: "tor-c"}}, false); err != ErrorUplinkScope {
+		t.Errorf("Expected error %s, got %v", ErrorUplinkScope, err)
+	}
+
+	if !allocateVlanId(scope, &vid, false) {
+		t.Fatal("Cant allocate pair vlan")
+	}
+	if vid != 3 {
+		t.Errorf("Expected vlan id %d, but got %d", 3, vid)
+	}
+	if !tplv["tor-a"].Unshared.bitOn(vid) || !tplv["tor-b"].Unshared.bitOn(vid) {
+		t.Errorf("Expected vlan id %d reserved on both pair members", vid)
+	}
+	if tplv["tor-c"].Unshared.bitOn(vid) {
+		t.Errorf("Unexpected vlan id %d reserved outside the pair", vid)
+	}
+	releaseVlanId(scope, vid, false)
+	if tplv["tor-a"].Unshared.bitOn(vid) || tplv["tor-b"].Unshared.bitOn(vid) {
+		t.Errorf("Expected vlan id %d released", vid)
+	}
+}
@@ -0,0 +1,443 @@
+package sapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//NETCONF (RFC 6241) over ssh. The driver speaks the sapi vxlan model below,
+//which no switch implements, only fakenetconf serves it. It is a stub for
+//development and the reference for drivers of real models, it is only
+//registered by RegisterNetconfStub.
+const (
+	NetconfStubType = "netconf"
+
+	NetconfBase  = "urn:ietf:params:xml:ns:netconf:base:1.0"
+	NetconfVxlan = "urn:sapi:params:xml:ns:yang:vxlan"
+
+	netconfEom = "]]>]]>"
+
+	ncRemove = "remove"
+)
+
+var (
+	netconfUser     string
+	netconfPassword string
+	netconfPort     = 830
+	//switches are not dialed until host keys are checked, see SetNetconf
+	netconfHostKey ssh.HostKeyCallback
+	netconfTimeout = 30 * time.Second
+
+	ErrorNetconfRpc     = errors.New("Netconf rpc error")
+	ErrorNetconfHostKey = errors.New("Netconf host keys not checked, give known hosts or allow insecure")
+)
+
+//SetNetconf sets the ssh account and port of switches configured over
+//NETCONF. Host keys are checked against knownHosts, without it switches are
+//only dialed if insecure skips the check.
+func SetNetconf(user, password string, port int, knownHosts string, insecure bool) error {
+	netconfUser, netconfPassword, netconfPort = user, password, port
+	switch {
+	case knownHosts != "":
+		cb, err := knownhosts.New(knownHosts)
+		if err != nil {
+			return err
+		}
+		netconfHostKey = cb
+	case insecure:
+		Log().Warn("Netconf host keys are not verified")
+		netconfHostKey = ssh.InsecureIgnoreHostKey()
+	default:
+		netconfHostKey = nil
+	}
+	return nil
+}
+
+//RegisterNetconfStub configures the tors of type NetconfStubType through
+//the sapi vxlan model, for development against fakenetconf.
+func RegisterNetconfStub() {
+	RegisterDriver(NetconfStubType, new(netconfDriver))
+}
+
+//sapi vxlan model
+type ncConfig struct {
+	XMLName  xml.Name    `xml:"urn:sapi:params:xml:ns:yang:vxlan vxlan"`
+	Tunnels  []ncTunnel  `xml:"tunnels>tunnel"`
+	Vsis     []ncVsi     `xml:"vsis>vsi"`
+	Mappings []ncMapping `xml:"mappings>mapping"`
+	Trunks   []ncTrunk   `xml:"trunks>trunk"`
+}
+
+type ncTunnel struct {
+	Op  string `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 operation,attr,omitempty"`
+	Id  int    `xml:"id"`
+	Src string `xml:"source,omitempty"`
+	Dst string `xml:"destination,omitempty"`
+}
+
+type ncVsi struct {
+	Op      string `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 operation,attr,omitempty"`
+	Vxlan   int    `xml:"vxlan"`
+	Tunnels []int  `xml:"tunnel"`
+}
+
+type ncMapping struct {
+	Op    string `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 operation,attr,omitempty"`
+	Index int    `xml:"index"`
+	Vlan  int    `xml:"vlan"`
+	Vxlan int    `xml:"vxlan"`
+}
+
+type ncTrunk struct {
+	Op       string `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 operation,attr,omitempty"`
+	Index    int    `xml:"index"`
+	Vlan     int    `xml:"vlan"`
+	Untagged bool   `xml:"untagged"`
+}
+
+type ncRpcError struct {
+	Tag     string `xml:"error-tag"`
+	Message string `xml:"error-message"`
+}
+
+type ncReply struct {
+	XMLName xml.Name     `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 rpc-reply"`
+	Errors  []ncRpcError `xml:"rpc-error"`
+	Data    struct {
+		Config ncConfig
+	} `xml:"data"`
+}
+
+//netconfSession is one ssh session running the netconf subsystem
+type netconfSession struct {
+	client *ssh.Client
+	in     io.WriteCloser
+	out    *bufio.Reader
+	msgId  int
+	timer  *time.Timer
+	ready  bool
+}
+
+func dialNetconf(tor *SapiTor) (*netconfSession, error) {
+	if netconfHostKey == nil {
+		return nil, ErrorNetconfHostKey
+	}
+	config := &ssh.ClientConfig{
+		User:            netconfUser,
+		Auth:            []ssh.AuthMethod{ssh.Password(netconfPassword)},
+		HostKeyCallback: netconfHostKey,
+		Timeout:         netconfTimeout,
+	}
+	addr := net.JoinHostPort(tor.TorIp, strconv.Itoa(netconfPort))
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	s := &netconfSession{client: client}
+	//a hung switch must not hold the tor's outbox forever
+	s.timer = time.AfterFunc(netconfTimeout, func() { client.Close() })
+
+	session, err := client.NewSession()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.in, err = session.StdinPipe(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.out = bufio.NewReader(out)
+	if err := session.RequestSubsystem("netconf"); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	hello := `<hello xmlns="` + NetconfBase + `"><capabilities>` +
+		`<capability>urn:ietf:params:netconf:base:1.0</capability>` +
+		`<capability>urn:ietf:params:netconf:capability:candidate:1.0</capability>` +
+		`</capabilities></hello>`
+	if err := s.write(hello); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if _, err := s.read(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.ready = true
+	return s, nil
+}
+
+func (s *netconfSession) write(msg string) error {
+	_, err := io.WriteString(s.in, msg+netconfEom)
+	return err
+}
+
+//read returns the next message without its end of message marker
+func (s *netconfSession) read() ([]byte, error) {
+	var msg []byte
+	for {
+		chunk, err := s.out.ReadBytes('>')
+		msg = append(msg, chunk...)
+		if bytes.HasSuffix(msg, []byte(netconfEom)) {
+			return msg[:len(msg)-len(netconfEom)], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//rpc issues one operation and returns its reply
+func (s *netconfSession) rpc(op string) (*ncReply, error) {
+	s.msgId++
+	msg := fmt.Sprintf(`<rpc message-id="%d" xmlns="%s">%s</rpc>`, s.msgId, NetconfBase, op)
+	if err := s.write(msg); err != nil {
+		return nil, err
+	}
+	raw, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	reply := new(ncReply)
+	if err := xml.Unmarshal(raw, reply); err != nil {
+		return nil, err
+	}
+	if len(reply.Errors) != 0 {
+		e := reply.Errors[0]
+		return reply, fmt.Errorf("%s: %s %s", ErrorNetconfRpc, e.Tag, e.Message)
+	}
+	return reply, nil
+}
+
+func (s *netconfSession) getConfig() (*ncConfig, error) {
+	reply, err := s.rpc(`<get-config><source><running/></source>` +
+		`<filter type="subtree"><vxlan xmlns="` + NetconfVxlan + `"/></filter></get-config>`)
+	if err != nil {
+		return nil, err
+	}
+	return &reply.Data.Config, nil
+}
+
+//locked runs fn holding the candidate lock, changes read and made by fn
+//are not raced by other clients of the switch.
+func (s *netconfSession) locked(fn func() error) error {
+	if _, err := s.rpc(`<lock><target><candidate/></target></lock>`); err != nil {
+		return err
+	}
+	defer s.rpc(`<unlock><target><candidate/></target></unlock>`)
+	return fn()
+}
+
+//commit changes the locked candidate and commits it, the candidate is
+//rolled back to running if any step fails.
+func (s *netconfSession) commit(conf *ncConfig) error {
+	body, err := xml.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	_, err = s.rpc(`<edit-config><target><candidate/></target>` +
+		`<default-operation>merge</default-operation><config>` + string(body) + `</config></edit-config>`)
+	if err == nil {
+		_, err = s.rpc(`<commit/>`)
+	}
+	if err != nil {
+		if _, derr := s.rpc(`<discard-changes/>`); derr != nil {
+			Log().WithFields(logrus.Fields{"error": derr}).Error("Netconf discard changes failed")
+		}
+		return err
+	}
+	return nil
+}
+
+//edit changes the candidate and commits it under the candidate lock
+func (s *netconfSession) edit(conf *ncConfig) error {
+	return s.locked(func() error { return s.commit(conf) })
+}
+
+func (s *netconfSession) Close() {
+	if s.ready {
+		s.rpc(`<close-session/>`)
+	}
+	s.timer.Stop()
+	s.client.Close()
+}
+
+//netconfDriver configures switches directly over NETCONF, one session and
+//one commit per change.
+type netconfDriver struct{}
+
+func (d *netconfDriver) edit(tor *SapiTor, conf *ncConfig) error {
+	s, err := dialNetconf(tor)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.edit(conf)
+}
+
+//TunnelEndpoints has no switch to ask, the other tors are the endpoints
+func (d *netconfDriver) TunnelEndpoints(tor *SapiTor) ([]string, error) {
+	peers := make([]*SapiTor, 0)
+	if err := DB().Where("tor_ip != ?", tor.TorIp).Find(&peers); err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	for _, peer := range peers {
+		if peer.TunnelSrcIp != "" {
+			ips = append(ips, peer.TunnelSrcIp)
+		}
+	}
+	return ips, nil
+}
+
+//CreateTunnel reuses a tunnel between src and dst, or builds one with the
+//lowest free id. The id is chosen and committed under one candidate lock.
+func (d *netconfDriver) CreateTunnel(tor *SapiTor, src, dst string) (int, error) {
+	s, err := dialNetconf(tor)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	id := 0
+	err = s.locked(func() error {
+		conf, err := s.getConfig()
+		if err != nil {
+			return err
+		}
+		used := make(map[int]bool)
+		for _, t := range conf.Tunnels {
+			if t.Src == src && t.Dst == dst {
+				id = t.Id
+				return nil
+			}
+			used[t.Id] = true
+		}
+		id = 1
+		for used[id] {
+			id++
+		}
+		return s.commit(&ncConfig{Tunnels: []ncTunnel{{Id: id, Src: src, Dst: dst}}})
+	})
+	return id, err
+}
+
+func (d *netconfDriver) DeleteTunnel(tor *SapiTor, id int) error {
+	return d.edit(tor, &ncConfig{Tunnels: []ncTunnel{{Op: ncRemove, Id: id}}})
+}
+
+func (d *netconfDriver) EnsureVsi(tor *SapiTor, vxlans, tunnels []int) error {
+	if len(vxlans) == 0 {
+		return nil
+	}
+	conf := new(ncConfig)
+	for _, vxlan := range vxlans {
+		conf.Vsis = append(conf.Vsis, ncVsi{Vxlan: vxlan, Tunnels: tunnels})
+	}
+	return d.edit(tor, conf)
+}
+
+func (d *netconfDriver) MapVlan(tor *SapiTor, m VlanMap) error {
+	return d.edit(tor, &ncConfig{
+		Vsis:     []ncVsi{{Vxlan: m.Vxlan, Tunnels: m.TunnelIds}},
+		Mappings: []ncMapping{{Index: m.Index, Vlan: m.Vlan, Vxlan: m.Vxlan}}})
+}
+
+func (d *netconfDriver) UnmapVlan(tor *SapiTor, m VlanMap, onlyIndex bool) error {
+	conf := &ncConfig{
+		Mappings: []ncMapping{{Op: ncRemove, Index: m.Index, Vlan: m.Vlan, Vxlan: m.Vxlan}}}
+	if !onlyIndex {
+		conf.Vsis = []ncVsi{{Op: ncRemove, Vxlan: m.Vxlan}}
+	}
+	return d.edit(tor, conf)
+}
+
+func (d *netconfDriver) Trunk(tor *SapiTor, t Trunk) error {
+	return d.edit(tor, &ncConfig{
+		Trunks: []ncTrunk{{Index: t.Index, Vlan: t.Vlan, Untagged: t.Untagged}}})
+}
+
+func (d *netconfDriver) Untrunk(tor *SapiTor, t Trunk) error {
+	return d.edit(tor, &ncConfig{
+		Trunks: []ncTrunk{{Op: ncRemove, Index: t.Index, Vlan: t.Vlan, Untagged: t.Untagged}}})
+}
+
+//ApplyBatch issues every change in one edit-config and one commit
+func (d *netconfDriver) ApplyBatch(tor *SapiTor, changes []Change) error {
+	conf := new(ncConfig)
+	for _, c := range changes {
+		m, t := c.Map, c.Trunk
+		switch c.Kind {
+		case JobVlanMap:
+			conf.Vsis = append(conf.Vsis, ncVsi{Vxlan: m.Vxlan, Tunnels: m.TunnelIds})
+			conf.Mappings = append(conf.Mappings, ncMapping{Index: m.Index, Vlan: m.Vlan, Vxlan: m.Vxlan})
+		case JobVlanUnmap:
+			conf.Mappings = append(conf.Mappings, ncMapping{Op: ncRemove, Index: m.Index, Vlan: m.Vlan, Vxlan: m.Vxlan})
+			if !c.OnlyIndex {
+				conf.Vsis = append(conf.Vsis, ncVsi{Op: ncRemove, Vxlan: m.Vxlan})
+			}
+		case JobTrunk:
+			conf.Trunks = append(conf.Trunks, ncTrunk{Index: t.Index, Vlan: t.Vlan, Untagged: t.Untagged})
+		case JobUntrunk:
+			conf.Trunks = append(conf.Trunks, ncTrunk{Op: ncRemove, Index: t.Index, Vlan: t.Vlan, Untagged: t.Untagged})
+		default:
+			return fmt.Errorf("Netconf: change %s is not batchable", c.Kind)
+		}
+	}
+	return d.edit(tor, conf)
+}
+
+func (d *netconfDriver) ReadConfig(tor *SapiTor) (*SwitchConfig, error) {
+	s, err := dialNetconf(tor)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	nc, err := s.getConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &SwitchConfig{
+		Tunnels:  []Tunnel{},
+		Vsis:     []int{},
+		Mappings: []VlanMap{},
+		Trunks:   []Trunk{}}
+	for _, t := range nc.Tunnels {
+		conf.Tunnels = append(conf.Tunnels, Tunnel{Id: t.Id, Src: t.Src, Dst: t.Dst})
+	}
+	tunnels := make(map[int][]int)
+	for _, vsi := range nc.Vsis {
+		conf.Vsis = append(conf.Vsis, vsi.Vxlan)
+		tunnels[vsi.Vxlan] = vsi.Tunnels
+	}
+	sort.Ints(conf.Vsis)
+	for _, m := range nc.Mappings {
+		conf.Mappings = append(conf.Mappings, VlanMap{
+			Vlan:      m.Vlan,
+			Vxlan:     m.Vxlan,
+			Index:     m.Index,
+			TunnelIds: tunnels[m.Vxlan]})
+	}
+	for _, t := range nc.Trunks {
+		conf.Trunks = append(conf.Trunks, Trunk{Vlan: t.Vlan, Index: t.Index, Untagged: t.Untagged})
+	}
+	return conf, nil
+}
@@ -0,0 +1,158 @@
+package sapi
+
+import (
+	"testing"
+
+	"github.com/wangtaoX/sapi/fakenetconf"
+	"golang.org/x/crypto/ssh"
+)
+
+func netconfStub(t *testing.T) (*fakenetconf.Server, *SapiTor) {
+	s, err := fakenetconf.NewServer("sapi", "secret")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	RegisterNetconfStub()
+	netconfUser, netconfPassword, netconfPort = "sapi", "secret", s.Port()
+	netconfHostKey = ssh.FixedHostKey(s.HostKey())
+	return s, &SapiTor{TorIp: "127.0.0.1", TunnelSrcIp: "1.1.1.1", Type: NetconfStubType}
+}
+
+func TestNetconfHostKey(t *testing.T) {
+	s, tor := netconfStub(t)
+	defer s.Close()
+	d := new(netconfDriver)
+
+	if err := SetNetconf("sapi", "secret", s.Port(), "", false); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if _, err := d.CreateTunnel(tor, "1.1.1.1", "2.2.2.2"); err != ErrorNetconfHostKey {
+		t.Errorf("Expected %s without known hosts, got %v", ErrorNetconfHostKey, err)
+	}
+
+	other, err := fakenetconf.NewServer("sapi", "secret")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	defer other.Close()
+	netconfHostKey = ssh.FixedHostKey(other.HostKey())
+	if _, err := d.CreateTunnel(tor, "1.1.1.1", "2.2.2.2"); err == nil {
+		t.Error("Expected a switch with another host key refused")
+	}
+	if len(s.Running().Tunnels) != 0 {
+		t.Error("Expected nothing configured on the refused switch")
+	}
+}
+
+func TestNetconfDriver(t *testing.T) {
+	s, tor := netconfStub(t)
+	defer s.Close()
+	d, err := driverFor(tor)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	id, err := d.CreateTunnel(tor, "1.1.1.1", "2.2.2.2")
+	if err != nil || id != 1 {
+		t.Fatalf("Expected tunnel 1, got %d %v", id, err)
+	}
+	if again, _ := d.CreateTunnel(tor, "1.1.1.1", "2.2.2.2"); again != id {
+		t.Errorf("Expected tunnel %d reused, got %d", id, again)
+	}
+	if err := d.MapVlan(tor, VlanMap{Vlan: 2, Vxlan: 100, Index: 3, TunnelIds: []int{id}}); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if err := d.Trunk(tor, Trunk{Vlan: 30, Index: 4}); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	conf, err := d.ReadConfig(tor)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if len(conf.Tunnels) != 1 || len(conf.Mappings) != 1 || len(conf.Trunks) != 1 {
+		t.Fatalf("Expected 1 tunnel, mapping and trunk, got %+v", conf)
+	}
+	if m := conf.Mappings[0]; m.Vlan != 2 || m.Vxlan != 100 || m.Index != 3 || len(m.TunnelIds) != 1 {
+		t.Errorf("Expected vlan 2 mapped to vxlan 100 on index 3, got %+v", m)
+	}
+
+	if err := d.UnmapVlan(tor, VlanMap{Vlan: 2, Vxlan: 100, Index: 3}, false); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	running := s.Running()
+	if len(running.Mappings) != 0 || len(running.Vsis) != 0 {
+		t.Errorf("Expected mapping and vsi removed, got %v %v", running.Mappings, running.Vsis)
+	}
+}
+
+func TestNetconfRollback(t *testing.T) {
+	s, tor := netconfStub(t)
+	defer s.Close()
+	d := new(netconfDriver)
+
+	s.FailNext("commit", 1)
+	if err := d.Trunk(tor, Trunk{Vlan: 30, Index: 4}); err == nil {
+		t.Fatal("Expected the failed commit to surface")
+	}
+	if len(s.Running().Trunks) != 0 || len(s.Candidate().Trunks) != 0 {
+		t.Error("Expected the candidate rolled back")
+	}
+	if s.Commits() != 0 {
+		t.Errorf("Expected no commit, got %d", s.Commits())
+	}
+
+	//a mapping to a missing tunnel is refused and leaves nothing behind
+	if err := d.MapVlan(tor, VlanMap{Vlan: 2, Vxlan: 100, Index: 3, TunnelIds: []int{7}}); err == nil {
+		t.Error("Expected an rpc error for an unknown tunnel")
+	}
+	if len(s.Candidate().Vsis) != 0 {
+		t.Error("Expected the candidate rolled back")
+	}
+
+	if err := d.Trunk(tor, Trunk{Vlan: 30, Index: 4}); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if len(s.Running().Trunks) != 1 {
+		t.Error("Expected the trunk committed after recovery")
+	}
+}
+
+func TestNetconfApplyBatch(t *testing.T) {
+	s, tor := netconfStub(t)
+	defer s.Close()
+	d := new(netconfDriver)
+
+	id, err := d.CreateTunnel(tor, "1.1.1.1", "2.2.2.2")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	commits := s.Commits()
+	err = d.ApplyBatch(tor, []Change{
+		{Kind: JobVlanMap, Map: VlanMap{Vlan: 2, Vxlan: 100, Index: 3, TunnelIds: []int{id}}},
+		{Kind: JobVlanMap, Map: VlanMap{Vlan: 2, Vxlan: 100, Index: 4, TunnelIds: []int{id}}},
+		{Kind: JobTrunk, Trunk: Trunk{Vlan: 30, Index: 5}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if got := s.Commits() - commits; got != 1 {
+		t.Errorf("Expected the batch in 1 commit, got %d", got)
+	}
+	running := s.Running()
+	if len(running.Mappings) != 2 || len(running.Trunks) != 1 {
+		t.Errorf("Expected 2 mappings and 1 trunk, got %+v", running)
+	}
+
+	//one refused change leaves the whole batch out
+	err = d.ApplyBatch(tor, []Change{
+		{Kind: JobUntrunk, Trunk: Trunk{Vlan: 30, Index: 5}},
+		{Kind: JobVlanMap, Map: VlanMap{Vlan: 3, Vxlan: 200, Index: 3, TunnelIds: []int{7}}},
+	})
+	if err == nil {
+		t.Fatal("Expected an rpc error for an unknown tunnel")
+	}
+	if len(s.Running().Trunks) != 1 {
+		t.Error("Expected the trunk kept after the failed batch")
+	}
+}
@@ -1,5 +1,11 @@
 package sapi
 
+import (
+	"fmt"
+
+	"github.com/go-xorm/xorm"
+)
+
 type SapiProvisionedNets struct {
 	NetworkId        string `json:"id" xorm:"pk varchar(36)"`
 	TenantId         string `json:"tenant_id"`
@@ -33,6 +39,7 @@ type SapiProvisionedPorts struct {
 
 type SapiPortVlanMapping struct {
 	Id        int    `xorm:"pk autoincr"`
+	PortId    string `xorm:"index varchar(36)"`
 	NetworkId string `xorm:"varchar(36)"`
 	TorIp     string `xorm:"varchar(45)"`
 	VlanId    int
@@ -45,13 +52,27 @@ func (this *SapiPortVlanMapping) insert() error {
 }
 
 func (this *SapiPortVlanMapping) search(id string) (bool, error) {
-	this.NetworkId = id
+	this.PortId = id
 	has, err := DB().Get(this)
 	return has, err
 }
 
-func (this *SapiPortVlanMapping) count() int64 {
-	total, _ := DB().Where("network_id=? AND tor_ip=?", this.NetworkId, this.TorIp).Count(new(SapiPortVlanMapping))
+//count, countByIndex and countByTors run in the transaction of s, they see
+//the mappings the transaction changed.
+func (this *SapiPortVlanMapping) count(s *xorm.Session) (int64, error) {
+	return s.Where("network_id=? AND tor_ip=?", this.NetworkId, this.TorIp).Count(new(SapiPortVlanMapping))
+}
+
+func (this *SapiPortVlanMapping) countByIndex(s *xorm.Session) (int64, error) {
+	return s.Where("network_id=? AND tor_ip=? AND `index`=?", this.NetworkId, this.TorIp, this.Index).Count(new(SapiPortVlanMapping))
+}
+
+func (this *SapiPortVlanMapping) countByTors(s *xorm.Session, tors []string) (int64, error) {
+	return s.Where("network_id=?", this.NetworkId).In("tor_ip", tors).Count(new(SapiPortVlanMapping))
+}
+
+func (this *SapiPortVlanMapping) countByVlan() int64 {
+	total, _ := DB().Where("tor_ip=? AND vlan_id=?", this.TorIp, this.VlanId).Count(new(SapiPortVlanMapping))
 	return total
 }
 
@@ -64,6 +85,9 @@ type SapiTor struct {
 	TorIp       string `xorm:"pk varchar(45)"`
 	TunnelSrcIp string `xorm:"varchar(45)"`
 	Type        string `xorm:"varchar(45)"`
+	PairId      string `xorm:"varchar(45)"`
+	Pod         string `xorm:"varchar(45)"`
+	Torconf     string `xorm:"varchar(255)"`
 }
 
 func (this *SapiTor) insert() error {
@@ -71,6 +95,24 @@ func (this *SapiTor) insert() error {
 	return err
 }
 
+func (this *SapiTor) search(ip string) (bool, error) {
+	this.TorIp = ip
+	has, err := DB().Get(this)
+	return has, err
+}
+
+func torByIp(ip string) (*SapiTor, error) {
+	tor := new(SapiTor)
+	has, err := tor.search(ip)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("tor %s not registered", ip)
+	}
+	return tor, nil
+}
+
 type SapiTorTunnels struct {
 	Id       int    `xorm:"pk autoincr"`
 	TorIp    string `xorm:"varchar(45)"`
@@ -88,10 +130,12 @@ func (this *SapiTorTunnels) delete() (int64, error) {
 	return c, err
 }
 
+//SapiTorVsis is a vsi on a tor, Refs counts the networks using it there
 type SapiTorVsis struct {
 	Id    int    `xorm:"pk autoincr"`
-	TorIp string `xorm:"varchar(45)"`
-	Vxlan int
+	TorIp string `xorm:"unique(tor_vxlan) varchar(45)"`
+	Vxlan int    `xorm:"unique(tor_vxlan)"`
+	Refs  int
 }
 
 func (this *SapiTorVsis) insert() error {
@@ -138,7 +182,14 @@ func SelectAllTors(every *[]*SapiTor) error {
 }
 
 func SelectAllVsiByTor(torIp string, every *[]*SapiTorVsis) error {
-	if err := DB().Where("tor_ip=?", torIp).Find(every); err != nil {
+	if err := DB().Where("tor_ip=? AND refs>0", torIp).Asc("vxlan").Find(every); err != nil {
+		return err
+	}
+	return nil
+}
+
+func SelectAllPvmByPort(portId string, every *[]*SapiPortVlanMapping) error {
+	if err := DB().Where("port_id=?", portId).Find(every); err != nil {
 		return err
 	}
 	return nil
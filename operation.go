@@ -0,0 +1,251 @@
+package sapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	OpPending   = "pending"
+	OpRunning   = "running"
+	OpSucceeded = "succeeded"
+	OpFailed    = "failed"
+)
+
+var (
+	operations  = "/operations/"
+	opWaitMax   = time.Minute * 5
+	opWaitPoll  = time.Millisecond * 200
+	opIdHeader  = "X-Operation-Id"
+	opWaitParam = "wait"
+)
+
+//SapiOperations groups the outbox jobs issued for one api request.
+//Error is set when the request failed after its operation was recorded.
+type SapiOperations struct {
+	Id      string    `xorm:"pk varchar(36)"`
+	Kind    string    `xorm:"varchar(32)"`
+	Error   string    `xorm:"text"`
+	Created time.Time `xorm:"created"`
+}
+
+func (this *SapiOperations) insert() error {
+	_, err := DB().Insert(this)
+	return err
+}
+
+func (this *SapiOperations) search(id string) (bool, error) {
+	this.Id = id
+	has, err := DB().Get(this)
+	return has, err
+}
+
+func SelectAllJobsByOperation(op string, every *[]*SapiConfigJobs) error {
+	if err := DB().Where("operation_id=?", op).Asc("id").Find(every); err != nil {
+		return err
+	}
+	return nil
+}
+
+//Operation is the progress of a request on the switches it touches.
+type Operation struct {
+	Id       string            `json:"id"`
+	Kind     string            `json:"kind"`
+	Status   string            `json:"status"`
+	Attempts int               `json:"attempts"`
+	Created  time.Time         `json:"created"`
+	Started  *time.Time        `json:"started,omitempty"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Batches  []int64           `json:"batches,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Jobs     []*SapiConfigJobs `json:"jobs"`
+}
+
+func newOperationId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//newOperation records an operation, jobs enqueued with its id belong to it.
+func newOperation(kind string) (string, error) {
+	op := &SapiOperations{Id: newOperationId(), Kind: kind}
+	if err := op.insert(); err != nil {
+		return "", err
+	}
+	return op.Id, nil
+}
+
+//failOperation records that the request of an operation failed, the
+//operation is failed whatever its jobs do.
+func failOperation(id string, err error) {
+	if _, e := DB().Id(id).Cols("error").Update(&SapiOperations{Error: err.Error()}); e != nil {
+		Log().Error(e)
+	}
+}
+
+//summarize derives the operation status from its jobs, an operation
+//without jobs had nothing to push and is done unless its request failed.
+func (o *Operation) summarize() {
+	var done, dead, started int
+	batches := make(map[int64]bool)
+	for _, job := range o.Jobs {
+		o.Attempts += job.Attempts
+		if job.BatchId != 0 && !batches[job.BatchId] {
+			batches[job.BatchId] = true
+			o.Batches = append(o.Batches, job.BatchId)
+		}
+		switch job.State {
+		case JobDone:
+			done++
+		case JobDead:
+			dead++
+		}
+		if job.Attempts > 0 {
+			started++
+			if !job.Started.IsZero() && (o.Started == nil || job.Started.Before(*o.Started)) {
+				t := job.Started
+				o.Started = &t
+			}
+		}
+		if !job.Finished.IsZero() && (o.Finished == nil || job.Finished.After(*o.Finished)) {
+			t := job.Finished
+			o.Finished = &t
+		}
+	}
+
+	switch {
+	case o.Error != "":
+		o.Status = OpFailed
+	case dead > 0 && done+dead == len(o.Jobs):
+		o.Status = OpFailed
+	case done == len(o.Jobs):
+		o.Status = OpSucceeded
+	case started > 0:
+		o.Status = OpRunning
+	default:
+		o.Status = OpPending
+	}
+	if o.Status != OpSucceeded && o.Status != OpFailed {
+		o.Finished = nil
+	}
+}
+
+func (o *Operation) finished() bool {
+	return o.Status == OpSucceeded || o.Status == OpFailed
+}
+
+func getOperation(id string) (*Operation, bool, error) {
+	op := new(SapiOperations)
+	has, err := op.search(id)
+	if err != nil || !has {
+		return nil, has, err
+	}
+	every := make([]*SapiConfigJobs, 0)
+	if err := SelectAllJobsByOperation(id, &every); err != nil {
+		return nil, true, err
+	}
+	o := &Operation{Id: op.Id, Kind: op.Kind, Error: op.Error, Created: op.Created, Jobs: every}
+	o.summarize()
+	return o, true, nil
+}
+
+//waitOperation polls the operation until it finished or timeout passed.
+func waitOperation(id string, timeout time.Duration) (*Operation, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		o, _, err := getOperation(id)
+		if err != nil {
+			return nil, err
+		}
+		if o == nil || o.finished() || time.Now().After(deadline) {
+			return o, nil
+		}
+		time.Sleep(opWaitPoll)
+	}
+}
+
+//waitParam returns how long the client asked to wait, ?wait=30s
+func waitParam(r *http.Request) time.Duration {
+	d, err := time.ParseDuration(r.URL.Query().Get(opWaitParam))
+	if err != nil || d <= 0 {
+		return 0
+	}
+	if d > opWaitMax {
+		return opWaitMax
+	}
+	return d
+}
+
+//operationCode maps the operation of a request waited for to its response
+//code, an operation still in flight when the wait is over is accepted.
+func operationCode(o *Operation) int {
+	switch {
+	case o == nil || o.Status == OpSucceeded:
+		return http.StatusOK
+	case o.Status == OpFailed:
+		return http.StatusBadGateway
+	}
+	return http.StatusAccepted
+}
+
+//finishOperation writes the operation id header and, if the client asked
+//to, waits for the operation. It returns the response code to use.
+func finishOperation(rw http.ResponseWriter, r *http.Request, id string) (*Operation, int) {
+	rw.Header().Set(opIdHeader, id)
+	wait := waitParam(r)
+	if wait == 0 {
+		return nil, http.StatusOK
+	}
+	o, err := waitOperation(id, wait)
+	if err != nil {
+		Log().Error(err)
+		return nil, http.StatusAccepted
+	}
+	return o, operationCode(o)
+}
+
+//operationMessage is the message of a response, OK unless the client waited
+//for an operation that did not succeed.
+func operationMessage(o *Operation) string {
+	if o == nil || o.Status == OpSucceeded {
+		return "OK"
+	}
+	return o.Status
+}
+
+func showOperation(rw http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	o, has, err := getOperation(id)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if !has {
+		HttpError(rw, "Not Found", nil, http.StatusNotFound)
+		return
+	}
+	if wait := waitParam(r); wait > 0 && !o.finished() {
+		if o, err = waitOperation(id, wait); err != nil {
+			HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rw.Header().Set("Content/Type", "application/json")
+	ret, _ := json.MarshalIndent(struct {
+		Operation *Operation `json:"operation"`
+	}{
+		Operation: o,
+	}, "", "    ")
+	rw.Write(ret)
+}
+
+func init() {
+	Regist(MakeApiEndpoints("GET", operations+"{id}", http.HandlerFunc(showOperation)))
+}
@@ -0,0 +1,77 @@
+package sapi
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOperationSummarize(t *testing.T) {
+	t1 := time.Now()
+	t2 := t1.Add(time.Second)
+	cases := []struct {
+		jobs     []*SapiConfigJobs
+		expected string
+	}{
+		{[]*SapiConfigJobs{}, OpSucceeded},
+		{[]*SapiConfigJobs{{State: JobPending}, {State: JobPending}}, OpPending},
+		{[]*SapiConfigJobs{{State: JobDone, Attempts: 1}, {State: JobPending}}, OpRunning},
+		{[]*SapiConfigJobs{{State: JobPending, Attempts: 2}}, OpRunning},
+		{[]*SapiConfigJobs{{State: JobDead, Attempts: 10}, {State: JobPending}}, OpRunning},
+		{[]*SapiConfigJobs{{State: JobDead, Attempts: 10}, {State: JobDone, Attempts: 1}}, OpFailed},
+		{[]*SapiConfigJobs{
+			{State: JobDone, Attempts: 1, Started: t1, Finished: t1},
+			{State: JobDone, Attempts: 2, Started: t1, Finished: t2}}, OpSucceeded},
+	}
+	for i, c := range cases {
+		o := &Operation{Jobs: c.jobs}
+		o.summarize()
+		if o.Status != c.expected {
+			t.Errorf("Case %d: expected status %s, got %s", i, c.expected, o.Status)
+		}
+	}
+
+	o := &Operation{Jobs: []*SapiConfigJobs{}, Error: "No avaliable id to allocate"}
+	o.summarize()
+	if o.Status != OpFailed {
+		t.Errorf("Expected a failed request %s, got %s", OpFailed, o.Status)
+	}
+
+	o = &Operation{Jobs: cases[len(cases)-1].jobs}
+	o.summarize()
+	if o.Attempts != 3 {
+		t.Errorf("Expected %d attempts, got %d", 3, o.Attempts)
+	}
+	if o.Started == nil || !o.Started.Equal(t1) || o.Finished == nil || !o.Finished.Equal(t2) {
+		t.Errorf("Unexpected timings %v - %v", o.Started, o.Finished)
+	}
+}
+
+func TestWaitParam(t *testing.T) {
+	cases := map[string]time.Duration{
+		"/localvlan/":          0,
+		"/localvlan/?wait=2s":  time.Second * 2,
+		"/localvlan/?wait=bad": 0,
+		"/localvlan/?wait=1h":  opWaitMax,
+	}
+	for url, expected := range cases {
+		r, _ := http.NewRequest("POST", url, nil)
+		if got := waitParam(r); got != expected {
+			t.Errorf("Expected wait %s for %s, got %s", expected, url, got)
+		}
+	}
+}
+
+func TestOperationCode(t *testing.T) {
+	cases := map[string]int{
+		OpSucceeded: http.StatusOK,
+		OpFailed:    http.StatusBadGateway,
+		OpRunning:   http.StatusAccepted,
+		OpPending:   http.StatusAccepted,
+	}
+	for status, expected := range cases {
+		if got := operationCode(&Operation{Status: status}); got != expected {
+			t.Errorf("Expected code %d for %s, got %d", expected, status, got)
+		}
+	}
+}
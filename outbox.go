@@ -0,0 +1,586 @@
+package sapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-xorm/xorm"
+	"github.com/gorilla/mux"
+)
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	//given up after MaxAttempts, kept for inspection and manual retry
+	JobDead = "dead"
+
+	JobTunnel       = "tunnel"
+	JobTunnelDelete = "untunnel"
+	JobTsync        = "tsync"
+	JobEnsure       = "ensure"
+	JobVlanMap      = "vlan2vxlan"
+	JobVlanUnmap    = "unvlan2vxlan"
+	JobTrunk        = "trunk"
+	JobUntrunk      = "untrunk"
+)
+
+var (
+	jobs           = "/jobs"
+	jobMaxAttempts = 10
+	jobBackoffMin  = time.Second * 2
+	jobBackoffMax  = time.Minute * 5
+	jobPoll        = time.Second * 5
+
+	jobWakeup = make(chan bool, 1)
+	//a wakeup is set for the earliest open batch
+	jobTimer *time.Timer
+
+	//run after the switch accepted a job, a hook error fails the attempt
+	jobHooks = map[string]func(*SapiConfigJobs, string) error{
+		JobTunnel:       tunnelDone,
+		JobTunnelDelete: tunnelDeleted,
+		JobTsync:        tsyncDone,
+	}
+
+	ErrorJobState = errors.New("Job is not dead")
+)
+
+//SapiConfigJobs is the outbox of switch driver calls, jobs of one tor are
+//issued in id order, mapping changes in batches. BatchId is the first job
+//of the batch a job last ran in. A dead job does not hold back later jobs.
+type SapiConfigJobs struct {
+	Id          int64     `json:"id" xorm:"pk autoincr"`
+	OperationId string    `json:"operation" xorm:"index varchar(36)"`
+	TorIp       string    `json:"tor" xorm:"index varchar(45)"`
+	Kind        string    `json:"kind" xorm:"varchar(32)"`
+	Payload     string    `json:"payload" xorm:"text"`
+	State       string    `json:"state" xorm:"index varchar(16)"`
+	Attempts    int       `json:"attempts"`
+	MaxAttempts int       `json:"max_attempts"`
+	NextRun     time.Time `json:"next_run"`
+	LastError   string    `json:"last_error" xorm:"text"`
+	Response    string    `json:"response" xorm:"text"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	BatchId     int64     `json:"batch" xorm:"index"`
+	Created     time.Time `json:"created" xorm:"created"`
+	Updated     time.Time `json:"updated" xorm:"updated"`
+}
+
+func (this *SapiConfigJobs) insert() error {
+	_, err := DB().Insert(this)
+	return err
+}
+
+func (this *SapiConfigJobs) search(id int64) (bool, error) {
+	this.Id = id
+	has, err := DB().Get(this)
+	return has, err
+}
+
+func (this *SapiConfigJobs) update() error {
+	_, err := DB().Id(this.Id).AllCols().Update(this)
+	return err
+}
+
+func SelectAllPendingJobs(every *[]*SapiConfigJobs) error {
+	if err := DB().Where("state=?", JobPending).Asc("id").Find(every); err != nil {
+		return err
+	}
+	return nil
+}
+
+//vlanUnmapJob is the payload of a JobVlanUnmap
+type vlanUnmapJob struct {
+	VlanMap
+	OnlyIndex bool `json:"only_index"`
+}
+
+//enqueueJob stores a driver call for the tor as part of operation op in the
+//transaction of s, it is issued by the outbox once committed.
+func enqueueJob(s *xorm.Session, op, tor, kind string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	job := &SapiConfigJobs{
+		OperationId: op,
+		TorIp:       tor,
+		Kind:        kind,
+		Payload:     string(b),
+		State:       JobPending,
+		MaxAttempts: jobMaxAttempts,
+		NextRun:     time.Now(),
+	}
+	if _, err := s.Insert(job); err != nil {
+		Log().WithFields(logrus.Fields{
+			"Tor":   tor,
+			"Kind":  kind,
+			"Error": err,
+		}).Error("enqueueJob: insert error")
+		return err
+	}
+	return nil
+}
+
+//queueJobs runs fn in one transaction, the state fn changes and the jobs
+//it queues are stored together or not at all. The jobs are dispatched once
+//committed.
+func queueJobs(fn func(s *xorm.Session) error) error {
+	session := DB().NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	if err := fn(session); err != nil {
+		session.Rollback()
+		return err
+	}
+	if err := session.Commit(); err != nil {
+		return err
+	}
+	wakeupJobs()
+	return nil
+}
+
+func wakeupJobs() {
+	select {
+	case jobWakeup <- true:
+	default:
+	}
+}
+
+//jobBackoff returns the delay before the next attempt, doubling from
+//jobBackoffMin up to jobBackoffMax.
+func jobBackoff(attempts int) time.Duration {
+	d := jobBackoffMin
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= jobBackoffMax {
+			return jobBackoffMax
+		}
+	}
+	return d
+}
+
+//resumeJobs puts jobs interrupted by a restart back in the queue.
+func resumeJobs() {
+	affected, err := DB().Where("state=?", JobRunning).Cols("state").Update(&SapiConfigJobs{State: JobPending})
+	if err != nil {
+		Log().Error(fmt.Sprintf("resumeJobs: %s", err))
+		return
+	}
+	if affected > 0 {
+		Log().Info(fmt.Sprintf("resumeJobs: %d interrupted jobs resumed", affected))
+	}
+}
+
+//dispatchJobs starts the batches every tor may run now and sets a wakeup
+//for the batches still open.
+func dispatchJobs() {
+	pending := make([]*SapiConfigJobs, 0)
+	if err := SelectAllPendingJobs(&pending); err != nil {
+		Log().Error(fmt.Sprintf("dispatchJobs: %s", err))
+		return
+	}
+	byTor := make(map[string][]*SapiConfigJobs)
+	order := []string{}
+	for _, job := range pending {
+		if _, ok := byTor[job.TorIp]; !ok {
+			order = append(order, job.TorIp)
+		}
+		byTor[job.TorIp] = append(byTor[job.TorIp], job)
+	}
+
+	now := time.Now()
+	var next time.Duration
+	jobFlightMu.Lock()
+	for _, tor := range order {
+		f, ok := jobFlights[tor]
+		if !ok {
+			f = newFlight()
+		}
+		batches, wait := nextBatches(byTor[tor], f, now)
+		if f.batches > 0 {
+			jobFlights[tor] = f
+		}
+		if wait > 0 && (next == 0 || wait < next) {
+			next = wait
+		}
+		for _, batch := range batches {
+			go runBatch(batch)
+		}
+	}
+	if next > 0 {
+		if jobTimer != nil {
+			jobTimer.Stop()
+		}
+		jobTimer = time.AfterFunc(next, wakeupJobs)
+	}
+	jobFlightMu.Unlock()
+}
+
+//execJob issues the job through the driver of its tor and returns the
+//result as json. Tunnel ids and vsis are read at run time so jobs queued
+//behind tunnel creation see the new tunnels.
+func execJob(job *SapiConfigJobs) (string, error) {
+	var result interface{}
+
+	tor, err := torByIp(job.TorIp)
+	if err != nil {
+		return "", err
+	}
+	d, err := driverFor(tor)
+	if err != nil {
+		return "", err
+	}
+
+	switch job.Kind {
+	case JobTsync:
+		var endpoints []string
+		if endpoints, err = d.TunnelEndpoints(tor); err == nil {
+			result = struct {
+				Endpoints []string `json:"endpoints"`
+			}{endpoints}
+		}
+	case JobTunnel:
+		var tunnel Tunnel
+		if err = json.Unmarshal([]byte(job.Payload), &tunnel); err != nil {
+			return "", err
+		}
+		if tunnel.Id, err = d.CreateTunnel(tor, tunnel.Src, tunnel.Dst); err == nil {
+			result = tunnel
+		}
+	case JobTunnelDelete:
+		var tunnel Tunnel
+		if err = json.Unmarshal([]byte(job.Payload), &tunnel); err != nil {
+			return "", err
+		}
+		if err = d.DeleteTunnel(tor, tunnel.Id); err == nil {
+			result = tunnel
+		}
+	case JobEnsure:
+		var state *SwitchConfig
+		if state, err = desiredState(tor); err != nil {
+			return "", err
+		}
+		ids := []int{}
+		for _, t := range state.Tunnels {
+			ids = append(ids, t.Id)
+		}
+		err = d.EnsureVsi(tor, state.Vsis, ids)
+	case JobVlanMap:
+		var m VlanMap
+		if err = json.Unmarshal([]byte(job.Payload), &m); err != nil {
+			return "", err
+		}
+		m.TunnelIds = getTunnelIds(tor.TorIp)
+		err = d.MapVlan(tor, m)
+	case JobVlanUnmap:
+		var m vlanUnmapJob
+		if err = json.Unmarshal([]byte(job.Payload), &m); err != nil {
+			return "", err
+		}
+		err = d.UnmapVlan(tor, m.VlanMap, m.OnlyIndex)
+	case JobTrunk, JobUntrunk:
+		var t Trunk
+		if err = json.Unmarshal([]byte(job.Payload), &t); err != nil {
+			return "", err
+		}
+		if job.Kind == JobTrunk {
+			err = d.Trunk(tor, t)
+		} else {
+			err = d.Untrunk(tor, t)
+		}
+	default:
+		return "", fmt.Errorf("Unknown job kind %s", job.Kind)
+	}
+	if err != nil || result == nil {
+		return "", err
+	}
+	b, err := json.Marshal(result)
+	return string(b), err
+}
+
+//runJob issues one job and reports whether the switch took it
+func runJob(job *SapiConfigJobs) bool {
+	if err := startJob(job); err != nil {
+		return false
+	}
+	body, err := execJob(job)
+	return finishJob(job, body, err)
+}
+
+func startJob(job *SapiConfigJobs) error {
+	job.State = JobRunning
+	job.Attempts++
+	if job.Started.IsZero() {
+		job.Started = time.Now()
+	}
+	if err := job.update(); err != nil {
+		Log().Error(fmt.Sprintf("runJob: %s", err))
+		return err
+	}
+	return nil
+}
+
+//unstartJob puts a job started but never sent back to pending
+func unstartJob(job *SapiConfigJobs) {
+	job.State = JobPending
+	if job.Attempts--; job.Attempts == 0 {
+		job.Started = time.Time{}
+	}
+	if _, err := DB().Id(job.Id).Cols("state", "attempts", "started").Update(job); err != nil {
+		Log().Error(fmt.Sprintf("runJob: %s", err))
+	}
+}
+
+//finishJob runs the hook of a job the switch took and records the outcome
+func finishJob(job *SapiConfigJobs, body string, err error) bool {
+	if hook, ok := jobHooks[job.Kind]; ok && err == nil {
+		err = hook(job, body)
+	}
+
+	job.Response = body
+	entry := Log().WithFields(logrus.Fields{
+		"Job":      job.Id,
+		"Batch":    job.BatchId,
+		"Tor":      job.TorIp,
+		"Kind":     job.Kind,
+		"Attempts": job.Attempts,
+	})
+	if err == nil {
+		job.State = JobDone
+		job.LastError = ""
+		job.Finished = time.Now()
+		entry.Info("runJob: job done")
+	} else if job.Attempts >= job.MaxAttempts {
+		job.State = JobDead
+		job.LastError = err.Error()
+		job.Finished = time.Now()
+		entry.WithField("Error", err).Error("runJob: job dead")
+	} else {
+		job.State = JobPending
+		job.LastError = err.Error()
+		job.NextRun = time.Now().Add(jobBackoff(job.Attempts))
+		entry.WithField("Error", err).Warn("runJob: job failed, retry later")
+	}
+	if err := job.update(); err != nil {
+		Log().Error(fmt.Sprintf("runJob: %s", err))
+	}
+	return err == nil
+}
+
+func tunnelDone(job *SapiConfigJobs, body string) error {
+	var tunnel Tunnel
+	if err := json.Unmarshal([]byte(body), &tunnel); err != nil {
+		return err
+	}
+	if tunnel.Id == 0 {
+		return fmt.Errorf("no tunnel id for %s to %s", job.TorIp, tunnel.Dst)
+	}
+	//one tunnel per destination, a rebuilt tunnel replaces the old record
+	err := queueJobs(func(s *xorm.Session) error {
+		if _, err := s.Where("tor_ip=? AND dst_addr=?", job.TorIp, tunnel.Dst).Delete(new(SapiTorTunnels)); err != nil {
+			return err
+		}
+		return addNewTunnel(s, job.TorIp, tunnel.Dst, tunnel.Id)
+	})
+	if err != nil {
+		return err
+	}
+	Log().WithFields(logrus.Fields{
+		"Switch":     job.TorIp,
+		"Source":     tunnel.Src,
+		"Destnation": tunnel.Dst,
+		"TunnelId":   tunnel.Id,
+	}).Info("registerTor: New vxlan tunnel")
+	return nil
+}
+
+func tunnelDeleted(job *SapiConfigJobs, body string) error {
+	var tunnel Tunnel
+	if err := json.Unmarshal([]byte(body), &tunnel); err != nil {
+		return err
+	}
+	if _, err := (&SapiTorTunnels{TorIp: job.TorIp, TunnelId: tunnel.Id}).delete(); err != nil {
+		return err
+	}
+	Log().WithFields(logrus.Fields{
+		"Switch":     job.TorIp,
+		"Destnation": tunnel.Dst,
+		"TunnelId":   tunnel.Id,
+	}).Info("deregisterTor: vxlan tunnel removed")
+	return nil
+}
+
+//tsyncDone builds tunnels between the newly registered tor and every tunnel
+//endpoint its switch and sapi know about, endpoints outside sapi are stored
+//for the mesh of the tor. It runs again when a step fails, tunnels already
+//queued are not queued twice.
+func tsyncDone(job *SapiConfigJobs, body string) error {
+	sapiTors := make([]*SapiTor, 0)
+	if err := SelectAllTors(&sapiTors); err != nil {
+		return err
+	}
+	var newTor *SapiTor
+	for _, tor := range sapiTors {
+		if tor.TorIp == job.TorIp {
+			newTor = tor
+		}
+	}
+	if newTor == nil {
+		return fmt.Errorf("tor %s not registered", job.TorIp)
+	}
+
+	var resp struct {
+		Endpoints []string `json:"endpoints"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		return err
+	}
+	//endpoints outside sapi are kept, the mesh reconciliation keeps their
+	//tunnels
+	registered := make(map[string]bool)
+	for _, tor := range sapiTors {
+		registered[tor.TunnelSrcIp] = true
+	}
+	outside := []string{}
+	for _, ip := range resp.Endpoints {
+		if ip != "" && !registered[ip] {
+			outside = append(outside, ip)
+		}
+	}
+	return queueJobs(func(s *xorm.Session) error {
+		if err := recordEndpoints(s, newTor.TorIp, outside); err != nil {
+			return err
+		}
+		for _, ip := range resp.Endpoints {
+			if ip != "" && ip != newTor.TunnelSrcIp {
+				//new tunnel with existing tunnel src ip.
+				if err := syncTunnelOnce(s, job.OperationId, newTor.TorIp, newTor.TunnelSrcIp, ip); err != nil {
+					return err
+				}
+			}
+		}
+		for _, tor := range sapiTors {
+			if tor.TorIp == newTor.TorIp {
+				continue
+			}
+			//new tunnel form existing tunnel src ip to new tunnel src ip.
+			if err := syncTunnelOnce(s, job.OperationId, tor.TorIp, tor.TunnelSrcIp, newTor.TunnelSrcIp); err != nil {
+				return err
+			}
+		}
+		Log().Info("registerTor: tunnel sync queued, ensure every tor")
+		return ensureTors(s, job.OperationId)
+	})
+}
+
+//syncTunnelOnce queues a tunnel unless it is recorded or the operation
+//queued it already, a retried tsync queues every tunnel once.
+func syncTunnelOnce(s *xorm.Session, op, tor, src, dst string) error {
+	has, err := s.Get(&SapiTorTunnels{TorIp: tor, DstAddr: dst})
+	if err != nil || has {
+		return err
+	}
+	jobs := make([]*SapiConfigJobs, 0)
+	if err := s.Where("operation_id=? AND tor_ip=? AND kind=? AND state<>?",
+		op, tor, JobTunnel, JobDead).Find(&jobs); err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		var tunnel Tunnel
+		if json.Unmarshal([]byte(job.Payload), &tunnel) == nil && tunnel.Dst == dst {
+			return nil
+		}
+	}
+	return goTunnelSync(s, op, tor, src, dst)
+}
+
+//run the outbox, jobs interrupted by a restart are resumed first
+func GoOutbox(done chan struct{}) {
+	resumeJobs()
+	go func() {
+		Seconds := time.NewTimer(jobPoll)
+		for {
+			select {
+			case <-Seconds.C:
+				dispatchJobs()
+				Seconds.Reset(jobPoll)
+			case <-jobWakeup:
+				dispatchJobs()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func listJobs(rw http.ResponseWriter, r *http.Request) {
+	every := make([]*SapiConfigJobs, 0)
+	session := DB().Where("1=1")
+	if state := r.URL.Query().Get("state"); state != "" {
+		session = session.And("state=?", state)
+	}
+	if tor := r.URL.Query().Get("tor"); tor != "" {
+		session = session.And("tor_ip=?", tor)
+	}
+	if err := session.Desc("id").Limit(500).Find(&every); err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content/Type", "application/json")
+	ret, _ := json.MarshalIndent(struct {
+		Jobs []*SapiConfigJobs `json:"jobs"`
+	}{
+		Jobs: every,
+	}, "", "    ")
+	rw.Write(ret)
+}
+
+//retryJob resumes a dead job from scratch.
+func retryJob(rw http.ResponseWriter, r *http.Request) {
+	var job = new(SapiConfigJobs)
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		HttpError(rw, "Bad Request", nil, http.StatusBadRequest)
+		return
+	}
+	has, err := job.search(id)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if !has {
+		HttpError(rw, "Not Found", nil, http.StatusNotFound)
+		return
+	}
+	if job.State != JobDead {
+		HttpError(rw, "Job is not dead", ErrorJobState, http.StatusConflict)
+		return
+	}
+
+	job.State = JobPending
+	job.Attempts = 0
+	job.NextRun = time.Now()
+	job.Finished = time.Time{}
+	if err := job.update(); err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	wakeupJobs()
+	rw.Write([]byte("OK"))
+}
+
+func init() {
+	Regist(MakeApiEndpoints("GET", jobs, http.HandlerFunc(listJobs)))
+	Regist(MakeApiEndpoints("POST", jobs+"/{id}/retry", http.HandlerFunc(retryJob)))
+}
@@ -0,0 +1,20 @@
+package sapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:  jobBackoffMin,
+		2:  jobBackoffMin * 2,
+		4:  jobBackoffMin * 8,
+		30: jobBackoffMax,
+	}
+	for attempts, expected := range cases {
+		if got := jobBackoff(attempts); got != expected {
+			t.Errorf("Expected backoff %s after %d attempts, got %s", expected, attempts, got)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package sapi
+
+import (
+	"errors"
+	"math/rand"
+	gosync "sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	//tors polled at once
+	pollWorkers = 16
+	//snmp request timeout and the bound of a whole poll
+	pollTimeout  = time.Second * 10
+	pollDeadline = time.Second * 20
+	//a poll starts up to pollJitter late so tors are not hit at once
+	pollJitter   = time.Second * 2
+	pollInterval = time.Second * 30
+	//the last known topology of a tor failing to poll is served this
+	//long after its last success, 0 serves it until the tor answers
+	pollStaleAfter = time.Minute * 5
+	//community of tors without snmp credentials, see SetSnmp
+	pollCommunity = "public"
+
+	//tpMu guards tp and ts, tpKeys is the tp and ts entries each polled
+	//tor contributed
+	tpMu   gosync.RWMutex
+	tpKeys = make(map[string][]string)
+
+	ErrorPollDeadline = errors.New("lldp poll deadline exceeded")
+)
+
+//SetPolling sets the topology poll worker pool, the deadline of one poll,
+//its start jitter and the interval between poll cycles.
+func SetPolling(workers int, deadline, jitter, interval time.Duration) {
+	if workers < 1 {
+		workers = 1
+	}
+	pollWorkers, pollDeadline, pollJitter, pollInterval = workers, deadline, jitter, interval
+	if pollTimeout > deadline {
+		pollTimeout = deadline
+	}
+}
+
+//pollAll runs poll for every tor on at most pollWorkers workers and returns
+//once all are done.
+func pollAll(tors []string, poll func(tor string)) {
+	queue := make(chan string)
+	var wg gosync.WaitGroup
+	workers := pollWorkers
+	if workers > len(tors) {
+		workers = len(tors)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tor := range queue {
+				if pollJitter > 0 {
+					time.Sleep(time.Duration(rand.Int63n(int64(pollJitter))))
+				}
+				poll(tor)
+			}
+		}()
+	}
+	for _, tor := range tors {
+		queue <- tor
+	}
+	close(queue)
+	wg.Wait()
+}
+
+//mergeTopology replaces what a tor contributed to the topology snapshot
+func mergeTopology(tor string, tp1 map[string][]*Topology, tp2 map[string][]string) {
+	tpMu.Lock()
+	defer tpMu.Unlock()
+	if tp == nil {
+		tp = make(map[string][]*Topology)
+	}
+	if ts == nil {
+		ts = make(map[string][]string)
+	}
+	for _, key := range tpKeys[tor] {
+		delete(tp, key)
+		delete(ts, key)
+	}
+	keys := []string{}
+	for k, v := range tp1 {
+		tp[k] = v
+		keys = append(keys, k)
+	}
+	for k, v := range tp2 {
+		if _, ok := tp1[k]; !ok {
+			keys = append(keys, k)
+		}
+		ts[k] = v
+	}
+	if len(keys) == 0 {
+		delete(tpKeys, tor)
+		return
+	}
+	tpKeys[tor] = keys
+}
+
+//SetPollStaleness sets how long the last known topology of a tor failing
+//to poll is kept.
+func SetPollStaleness(d time.Duration) {
+	pollStaleAfter = d
+}
+
+//expired tells whether the last known topology of a tor is too old to use
+func expired(status PollStatus, now time.Time) bool {
+	if status.LastSuccess == nil {
+		return true
+	}
+	return pollStaleAfter > 0 && now.Sub(*status.LastSuccess) > pollStaleAfter
+}
+
+//pollDone merges the result of a poll into the snapshot, a failed poll
+//keeps the last known hosts of the tor until they expire.
+func pollDone(tor string, tp1 map[string][]*Topology, tp2 map[string][]string, err error) {
+	prior := lastPoll(tor)
+	status := recordPoll(tor, err)
+	if err == nil {
+		if err := storeLinks(tor, tp1, status.Time); err != nil {
+			Log().WithFields(logrus.Fields{
+				"Tor":   tor,
+				"Error": err,
+			}).Error("refreshTopology: links not stored")
+		}
+		mergeTopology(tor, tp1, tp2)
+		if prior != nil && prior.Failures > 0 {
+			emitEvents([]*TopologyEvent{{Kind: EventTorReachable, Tor: tor}})
+		}
+		return
+	}
+	if status.Failures == 1 {
+		emitEvents([]*TopologyEvent{{Kind: EventTorUnreachable, Tor: tor, Error: err.Error()}})
+	}
+	entry := Log().WithFields(logrus.Fields{
+		"Tor":      tor,
+		"Failures": status.Failures,
+		"Error":    err,
+	})
+	if !expired(status, status.Time) {
+		entry.Warn("refreshTopology: poll failed, last known topology kept")
+		return
+	}
+	entry.Warn("refreshTopology: poll failed, topology dropped")
+	expirePoll(tor)
+	mergeTopology(tor, nil, nil)
+	if err := dropLinks(tor); err != nil {
+		Log().WithFields(logrus.Fields{
+			"Tor":   tor,
+			"Error": err,
+		}).Error("refreshTopology: links not dropped")
+	}
+}
+
+//pruneTopology drops what tors no longer registered contributed
+func pruneTopology(tors []string) {
+	registered := make(map[string]bool)
+	for _, tor := range tors {
+		registered[tor] = true
+	}
+	tpMu.RLock()
+	gone := []string{}
+	for tor := range tpKeys {
+		if !registered[tor] {
+			gone = append(gone, tor)
+		}
+	}
+	tpMu.RUnlock()
+	for _, tor := range gone {
+		mergeTopology(tor, nil, nil)
+		forgetPoll(tor)
+		forgetNeighbors(tor)
+		dropLinks(tor)
+	}
+}
+
+//refreshTopology polls every registered tor, each result is merged into
+//the snapshot as soon as its tor answered. The hosts that changed over the
+//cycle are emitted as events.
+func refreshTopology() {
+	tors := registeredTors()
+	before := attachments()
+	pruneTopology(tors)
+	start := time.Now()
+	pollAll(tors, func(tor string) {
+		tp1, tp2, err := pollTor(tor, pollTimeout, pollDeadline)
+		pollDone(tor, tp1, tp2, err)
+	})
+	emitEvents(diffTopology(before, attachments()))
+	pruneEvents()
+	Log().WithFields(logrus.Fields{
+		"Tors":     len(tors),
+		"Duration": time.Since(start),
+	}).Debug("refreshTopology: poll cycle done")
+}
+
+//torHosts returns the hosts the topology has behind a tor
+func torHosts(tor string) []*Topology {
+	tpMu.RLock()
+	defer tpMu.RUnlock()
+	return tp[tor]
+}
@@ -0,0 +1,104 @@
+package sapi
+
+import (
+	"errors"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+func TestPollAll(t *testing.T) {
+	savedWorkers, savedJitter := pollWorkers, pollJitter
+	defer func() { pollWorkers, pollJitter = savedWorkers, savedJitter }()
+	pollWorkers, pollJitter = 3, 0
+
+	var mu gosync.Mutex
+	running, most := 0, 0
+	polled := make(map[string]bool)
+	tors := []string{"tor1", "tor2", "tor3", "tor4", "tor5", "tor6", "tor7"}
+	pollAll(tors, func(tor string) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		polled[tor] = true
+		mu.Unlock()
+		time.Sleep(time.Millisecond * 10)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	if len(polled) != len(tors) {
+		t.Errorf("Expected %d tors polled, got %d", len(tors), len(polled))
+	}
+	if most > pollWorkers || most < 2 {
+		t.Errorf("Expected at most %d concurrent polls, got %d", pollWorkers, most)
+	}
+}
+
+func TestMergeTopology(t *testing.T) {
+	savedTp, savedTs, savedKeys := tp, ts, tpKeys
+	defer func() { tp, ts, tpKeys = savedTp, savedTs, savedKeys }()
+	tp, ts, tpKeys = nil, nil, make(map[string][]string)
+
+	host := func(name string) map[string][]*Topology {
+		return map[string][]*Topology{"tor1": {{TorIp: "tor1", Host: name, Index: "1"}}}
+	}
+	mergeTopology("tor1", host("host1"), map[string][]string{"tor1": {"host1"}})
+	mergeTopology("tor2", map[string][]*Topology{"tor2": {{TorIp: "tor2", Host: "host2"}}},
+		map[string][]string{"tor2": {"host2"}})
+	if hosts := torHosts("tor1"); len(hosts) != 1 || hosts[0].Host != "host1" {
+		t.Fatalf("Expected host1 behind tor1, got %v", hosts)
+	}
+
+	mergeTopology("tor1", host("host3"), map[string][]string{"tor1": {"host3"}})
+	if hosts := torHosts("tor1"); len(hosts) != 1 || hosts[0].Host != "host3" {
+		t.Errorf("Expected host3 replacing host1, got %v", hosts)
+	}
+	if len(torHosts("tor2")) != 1 {
+		t.Error("Expected tor2 untouched by the poll of tor1")
+	}
+
+	mergeTopology("tor1", nil, nil)
+	if len(torHosts("tor1")) != 0 || len(ts["tor1"]) != 0 {
+		t.Error("Expected the hosts of tor1 gone after a failed poll")
+	}
+	pruneTopology([]string{"tor1"})
+	if len(torHosts("tor2")) != 0 || len(tpKeys) != 0 {
+		t.Error("Expected the hosts of the unregistered tor2 pruned")
+	}
+}
+
+func TestPollDone(t *testing.T) {
+	savedTp, savedTs, savedKeys := tp, ts, tpKeys
+	defer func() { tp, ts, tpKeys = savedTp, savedTs, savedKeys }()
+	tp, ts, tpKeys = nil, nil, make(map[string][]string)
+	defer forgetPoll("tor1")
+	timeout := errors.New("timeout")
+
+	pollDone("tor1", nil, nil, timeout)
+	if p := lastPoll("tor1"); p.Failures != 1 || p.Stale || p.LastSuccess != nil {
+		t.Errorf("Expected a failed first poll without topology, got %+v", p)
+	}
+	pollDone("tor1", map[string][]*Topology{"tor1": {{TorIp: "tor1", Host: "host1"}}},
+		map[string][]string{"tor1": {"host1"}}, nil)
+	pollDone("tor1", nil, nil, timeout)
+	pollDone("tor1", nil, nil, timeout)
+	p := lastPoll("tor1")
+	if p.Failures != 2 || p.TotalFailures != 3 || !p.Stale {
+		t.Errorf("Expected 2 failures in a row of 3 and a stale topology, got %+v", p)
+	}
+	if len(torHosts("tor1")) != 1 {
+		t.Fatal("Expected the last known hosts of tor1 kept")
+	}
+
+	pollsMu.Lock()
+	long := time.Now().Add(-pollStaleAfter * 2)
+	polls["tor1"].LastSuccess = &long
+	pollsMu.Unlock()
+	pollDone("tor1", nil, nil, timeout)
+	if p := lastPoll("tor1"); len(torHosts("tor1")) != 0 || p.Stale {
+		t.Errorf("Expected the expired hosts of tor1 dropped, got %+v", p)
+	}
+}
@@ -0,0 +1,51 @@
+package sapi
+
+import (
+	"sort"
+	gosync "sync"
+)
+
+//tplv is the registry of tors, a tor is known to the topology poller and
+//the vlan allocator once it has local vlan pools. tplvMu guards the
+//membership, vlansMu the bitmaps.
+var tplvMu gosync.RWMutex
+
+//registerPools gives a tor its local vlan pools, pools of a tor already
+//registered are kept. It reports whether the tor is new.
+func registerPools(tor string) bool {
+	tplvMu.Lock()
+	defer tplvMu.Unlock()
+	if _, ok := tplv[tor]; ok {
+		return false
+	}
+	tplv[tor] = &LocalVlan{
+		Shared:   NewBitmap(uint32(vlanSharedMin), uint32(vlanSharedMax)),
+		Unshared: NewBitmap(uint32(vlanVpcMin), uint32(vlanVpcMax)),
+	}
+	return true
+}
+
+func unregisterPools(tor string) {
+	tplvMu.Lock()
+	delete(tplv, tor)
+	tplvMu.Unlock()
+}
+
+func torPools(tor string) (*LocalVlan, bool) {
+	tplvMu.RLock()
+	defer tplvMu.RUnlock()
+	lv, ok := tplv[tor]
+	return lv, ok
+}
+
+//registeredTors returns every registered tor in order
+func registeredTors() []string {
+	tplvMu.RLock()
+	all := make([]string, 0, len(tplv))
+	for tor := range tplv {
+		all = append(all, tor)
+	}
+	tplvMu.RUnlock()
+	sort.Strings(all)
+	return all
+}
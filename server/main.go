@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/codegangsta/negroni"
 	"github.com/wangtaoX/sapi"
@@ -20,6 +22,31 @@ func main() {
 
 	db := flag.String("db", "127.0.0.1", "default database for sapi")
 	logFile := flag.String("log", "/var/log/sapi/sapi.log", "log file for sapi")
+	sharedVlan := flag.String("shared-vlan", sapi.SharedVlanPerTor, "shared network vlan policy, tor or fabric")
+	torconf := flag.String("torconf", "http://10.216.25.51:8081", "default tor configuration service")
+	torconfPods := flag.String("torconf-pods", "", "per pod tor configuration service, pod=url[,pod=url]")
+	netconfUser := flag.String("netconf-user", "sapi", "ssh user of netconf switches")
+	netconfPassword := flag.String("netconf-password", os.Getenv("SAPI_NETCONF_PASSWORD"), "ssh password of netconf switches, defaults to $SAPI_NETCONF_PASSWORD")
+	netconfPort := flag.Int("netconf-port", 830, "netconf port of switches")
+	netconfKnownHosts := flag.String("netconf-known-hosts", "", "known_hosts file checking switch host keys")
+	netconfInsecure := flag.Bool("netconf-insecure", false, "dial netconf switches without checking their host keys when no known_hosts is given")
+	netconfStub := flag.Bool("netconf-stub", false, "configure tors of type netconf through the sapi model only fakenetconf serves, for development")
+	meshInterval := flag.Duration("mesh-interval", 10*time.Minute, "tunnel mesh reconciliation interval, 0 disables")
+	reconcileInterval := flag.Duration("reconcile-interval", 10*time.Minute, "desired state reconciliation interval, 0 disables")
+	snmpKey := flag.String("snmp-key", os.Getenv("SAPI_SNMP_KEY"), "key sealing stored snmp credentials, defaults to $SAPI_SNMP_KEY")
+	snmpV2c := flag.Bool("snmp-v2c", true, "allow snmp v2c, tors without credentials are polled with -snmp-community")
+	snmpCommunity := flag.String("snmp-community", "public", "snmp v2c community of tors without credentials")
+	pollWorkers := flag.Int("poll-workers", 16, "tors polled for lldp at once")
+	pollDeadline := flag.Duration("poll-deadline", 20*time.Second, "bound of one lldp poll of a tor")
+	pollJitter := flag.Duration("poll-jitter", 2*time.Second, "random delay spreading the start of lldp polls")
+	pollInterval := flag.Duration("poll-interval", 30*time.Second, "lldp topology poll interval")
+	pollStaleAfter := flag.Duration("poll-stale-after", 5*time.Minute, "how long the last known topology of a tor failing to poll is kept, 0 keeps it")
+	hooks := flag.String("webhooks", "", "urls topology events are posted to, url[,url]")
+	hookAttempts := flag.Int("webhook-attempts", 5, "attempts delivering a topology event to a webhook")
+	eventRetention := flag.Duration("event-retention", 7*24*time.Hour, "how long topology events are kept, 0 keeps them")
+	batchWindow := flag.Duration("batch-window", 200*time.Millisecond, "how long mapping changes of a tor are gathered into one push")
+	batchMax := flag.Int("batch-max", 100, "mapping changes in one push at most")
+	torConcurrency := flag.Int("tor-concurrency", 1, "pushes in flight per tor")
 	flag.Parse()
 
 	if err := sapi.InitLog(*logFile); err != nil {
@@ -33,8 +60,51 @@ func main() {
 		os.Exit(1)
 	}
 
-	sapi.InitInmemoryData(sapi.GetTors())
+	if err := sapi.SetSharedVlanPolicy(*sharedVlan); err != nil {
+		fmt.Printf("Init shared vlan policy error: %s\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	sapi.SetTorconf(*torconf)
+	if err := sapi.SetTorconfPods(*torconfPods); err != nil {
+		fmt.Printf("Init torconf error: %s\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	if err := sapi.SetNetconf(*netconfUser, *netconfPassword, *netconfPort, *netconfKnownHosts, *netconfInsecure); err != nil {
+		fmt.Printf("Init netconf error: %s\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	if *netconfStub {
+		sapi.RegisterNetconfStub()
+	}
+	sapi.SetMeshInterval(*meshInterval)
+	sapi.SetReconcileInterval(*reconcileInterval)
+	sapi.SetSnmp(*snmpKey, *snmpV2c, *snmpCommunity)
+	sapi.SetPolling(*pollWorkers, *pollDeadline, *pollJitter, *pollInterval)
+	sapi.SetPollStaleness(*pollStaleAfter)
+	sapi.SetWebhooks(strings.Split(*hooks, ","), *hookAttempts, *eventRetention)
+	sapi.SetJobBatching(*batchWindow, *batchMax, *torConcurrency)
+	if err := sapi.RecountVsis(); err != nil {
+		fmt.Printf("Init vsi references error: %s\n\n", err)
+		os.Exit(1)
+	}
+	if err := sapi.InitInmemoryData(sapi.GetTors()); err != nil {
+		fmt.Printf("Init in memory data error: %s\n\n", err)
+		os.Exit(1)
+	}
+	sapi.GoWebhooks(done)
+	if err := sapi.LoadHostRules(); err != nil {
+		fmt.Printf("Load host rules error: %s\n\n", err)
+	}
+	if err := sapi.LoadTopology(); err != nil {
+		fmt.Printf("Load stored topology error: %s\n\n", err)
+	}
 	sapi.GoTopology(done)
+	sapi.GoOutbox(done)
+	sapi.GoMesh(done)
+	sapi.GoReconcile(done)
 	r := sapi.Router()
 	server := negroni.New(
 		middleware.NewBasicAuth(),
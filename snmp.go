@@ -34,3 +34,34 @@ func (sa *SnmpAgent) Timeout(t time.Duration) *SnmpAgent {
 func (sa *SnmpAgent) GS() *g.GoSNMP {
 	return sa.gs
 }
+
+func (sa *SnmpAgent) Port(port uint16) *SnmpAgent {
+	sa.gs.Port = port
+	return sa
+}
+
+func (sa *SnmpAgent) Retries(n int) *SnmpAgent {
+	sa.gs.Retries = n
+	return sa
+}
+
+//Usm switches the agent to SNMPv3 with the user security model, privacy
+//is only used with authPriv.
+func (sa *SnmpAgent) Usm(user string, flags g.SnmpV3MsgFlags, auth g.SnmpV3AuthProtocol, authPass string,
+	priv g.SnmpV3PrivProtocol, privPass string) *SnmpAgent {
+	usm := &g.UsmSecurityParameters{
+		UserName:                 user,
+		AuthenticationProtocol:   auth,
+		AuthenticationPassphrase: authPass,
+		PrivacyProtocol:          g.NoPriv,
+	}
+	if flags == g.AuthPriv {
+		usm.PrivacyProtocol = priv
+		usm.PrivacyPassphrase = privPass
+	}
+	sa.gs.Version = g.Version3
+	sa.gs.SecurityModel = g.UserSecurityModel
+	sa.gs.MsgFlags = flags
+	sa.gs.SecurityParameters = usm
+	return sa
+}
@@ -34,3 +34,18 @@ func TestSnmpAgent(t *testing.T) {
 		t.Errorf("Expected Version %s, got %s", c2.Version, c1.Version)
 	}
 }
+
+func TestSnmpAgentUsm(t *testing.T) {
+	gs := NewSnmpAgent().Port(1161).Retries(2).
+		Usm("sapi", g.AuthNoPriv, g.SHA, "authpass", g.AES, "privpass").GS()
+	if gs.Port != 1161 || gs.Retries != 2 {
+		t.Errorf("Expected port 1161 and 2 retries, got %d %d", gs.Port, gs.Retries)
+	}
+	usm := gs.SecurityParameters.(*g.UsmSecurityParameters)
+	if gs.Version != g.Version3 || gs.SecurityModel != g.UserSecurityModel {
+		t.Errorf("Expected SNMPv3 with the user security model, got %s %d", gs.Version, gs.SecurityModel)
+	}
+	if usm.PrivacyProtocol != g.NoPriv || usm.PrivacyPassphrase != "" {
+		t.Error("Expected no privacy with authNoPriv")
+	}
+}
@@ -0,0 +1,351 @@
+package sapi
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	g "github.com/soniah/gosnmp"
+)
+
+const (
+	SnmpV2c = "v2c"
+	SnmpV3  = "v3"
+
+	SnmpAuthNoPriv = "authNoPriv"
+	SnmpAuthPriv   = "authPriv"
+
+	SnmpSHA = "SHA"
+	SnmpAES = "AES"
+)
+
+var (
+	//key sealing the stored snmp secrets, see SetSnmp
+	snmpKey []byte
+	//tors without credentials are polled with v2c and snmpCommunity
+	snmpAllowV2c = true
+
+	ErrorSnmpKey    = errors.New("No snmp key to seal credentials")
+	ErrorSnmpSecret = errors.New("Snmp secret can not be opened")
+	ErrorSnmpV2c    = errors.New("Snmp v2c is not allowed")
+	ErrorSnmpCreds  = errors.New("Invalid snmp credentials")
+)
+
+//SapiTorSnmp is how a tor is polled, the passwords and the community are
+//sealed in Secret.
+type SapiTorSnmp struct {
+	TorIp        string `xorm:"pk varchar(45)"`
+	Version      string `xorm:"varchar(8)"`
+	Port         int
+	Retries      int
+	User         string    `xorm:"varchar(64)"`
+	Level        string    `xorm:"varchar(16)"`
+	AuthProtocol string    `xorm:"varchar(8)"`
+	PrivProtocol string    `xorm:"varchar(8)"`
+	Secret       string    `xorm:"text"`
+	Updated      time.Time `xorm:"updated"`
+}
+
+//SnmpCredentials are the snmp settings of a tor as given to the api
+type SnmpCredentials struct {
+	Version      string `json:"version"`
+	Port         int    `json:"port,omitempty"`
+	Retries      int    `json:"retries,omitempty"`
+	User         string `json:"user,omitempty"`
+	Level        string `json:"level,omitempty"`
+	AuthProtocol string `json:"auth_protocol,omitempty"`
+	PrivProtocol string `json:"priv_protocol,omitempty"`
+	Community    string `json:"community,omitempty"`
+	AuthPassword string `json:"auth_password,omitempty"`
+	PrivPassword string `json:"priv_password,omitempty"`
+}
+
+type snmpSecret struct {
+	Community    string `json:"community,omitempty"`
+	AuthPassword string `json:"auth,omitempty"`
+	PrivPassword string `json:"priv,omitempty"`
+}
+
+//SetSnmp sets the key sealing stored credentials, whether tors may be
+//polled with v2c and the community of tors without credentials.
+func SetSnmp(key string, allowV2c bool, community string) {
+	snmpKey = nil
+	if key != "" {
+		sum := sha256.Sum256([]byte(key))
+		snmpKey = sum[:]
+	}
+	snmpAllowV2c = allowV2c
+	pollCommunity = community
+}
+
+func sealSecret(plain []byte) (string, error) {
+	if snmpKey == nil {
+		return "", ErrorSnmpKey
+	}
+	block, err := aes.NewCipher(snmpKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func openSecret(sealed string) ([]byte, error) {
+	if snmpKey == nil {
+		return nil, ErrorSnmpKey
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, ErrorSnmpSecret
+	}
+	block, err := aes.NewCipher(snmpKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, ErrorSnmpSecret
+	}
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrorSnmpSecret
+	}
+	return plain, nil
+}
+
+//normalize fills in the defaults and checks the credentials, v3 uses SHA
+//authentication and AES privacy.
+func (c *SnmpCredentials) normalize() error {
+	if c.Port == 0 {
+		c.Port = 161
+	}
+	if c.Port < 0 || c.Port > 65535 || c.Retries < 0 {
+		return ErrorSnmpCreds
+	}
+	switch c.Version {
+	case SnmpV2c:
+		if !snmpAllowV2c {
+			return ErrorSnmpV2c
+		}
+		if c.Community == "" {
+			return ErrorSnmpCreds
+		}
+		c.User, c.Level, c.AuthProtocol, c.PrivProtocol = "", "", "", ""
+		c.AuthPassword, c.PrivPassword = "", ""
+	case SnmpV3:
+		if c.Level == "" {
+			c.Level = SnmpAuthPriv
+		}
+		if c.AuthProtocol == "" {
+			c.AuthProtocol = SnmpSHA
+		}
+		if c.User == "" || c.AuthProtocol != SnmpSHA || len(c.AuthPassword) < 8 {
+			return ErrorSnmpCreds
+		}
+		switch c.Level {
+		case SnmpAuthNoPriv:
+			c.PrivProtocol, c.PrivPassword = "", ""
+		case SnmpAuthPriv:
+			if c.PrivProtocol == "" {
+				c.PrivProtocol = SnmpAES
+			}
+			if c.PrivProtocol != SnmpAES || len(c.PrivPassword) < 8 {
+				return ErrorSnmpCreds
+			}
+		default:
+			return ErrorSnmpCreds
+		}
+		c.Community = ""
+	default:
+		return ErrorSnmpCreds
+	}
+	return nil
+}
+
+//storeSnmp seals and stores the credentials of a tor
+func storeSnmp(tor string, c *SnmpCredentials) error {
+	plain, _ := json.Marshal(snmpSecret{
+		Community:    c.Community,
+		AuthPassword: c.AuthPassword,
+		PrivPassword: c.PrivPassword})
+	secret, err := sealSecret(plain)
+	if err != nil {
+		return err
+	}
+	row := &SapiTorSnmp{
+		TorIp:        tor,
+		Version:      c.Version,
+		Port:         c.Port,
+		Retries:      c.Retries,
+		User:         c.User,
+		Level:        c.Level,
+		AuthProtocol: c.AuthProtocol,
+		PrivProtocol: c.PrivProtocol,
+		Secret:       secret}
+	has, err := DB().Get(&SapiTorSnmp{TorIp: tor})
+	if err != nil {
+		return err
+	}
+	if has {
+		_, err = DB().Id(tor).AllCols().Update(row)
+	} else {
+		_, err = DB().Insert(row)
+	}
+	return err
+}
+
+//snmpCredentials returns how a tor is polled, a tor without credentials
+//uses v2c and the default community.
+func snmpCredentials(tor string) (*SnmpCredentials, error) {
+	row := &SapiTorSnmp{TorIp: tor}
+	has, err := DB().Get(row)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		if !snmpAllowV2c {
+			return nil, ErrorSnmpV2c
+		}
+		return &SnmpCredentials{Version: SnmpV2c, Port: 161, Community: pollCommunity}, nil
+	}
+	if row.Version == SnmpV2c && !snmpAllowV2c {
+		return nil, ErrorSnmpV2c
+	}
+	plain, err := openSecret(row.Secret)
+	if err != nil {
+		return nil, err
+	}
+	var secret snmpSecret
+	if err := json.Unmarshal(plain, &secret); err != nil {
+		return nil, ErrorSnmpSecret
+	}
+	return &SnmpCredentials{
+		Version:      row.Version,
+		Port:         row.Port,
+		Retries:      row.Retries,
+		User:         row.User,
+		Level:        row.Level,
+		AuthProtocol: row.AuthProtocol,
+		PrivProtocol: row.PrivProtocol,
+		Community:    secret.Community,
+		AuthPassword: secret.AuthPassword,
+		PrivPassword: secret.PrivPassword}, nil
+}
+
+//agent returns an snmp agent polling target with the credentials
+func (c *SnmpCredentials) agent(target string, t time.Duration) *SnmpAgent {
+	sa := NewSnmpAgent().
+		Target(target).
+		Port(uint16(c.Port)).
+		Retries(c.Retries).
+		Timeout(t)
+	if c.Version != SnmpV3 {
+		return sa.Community(c.Community).Version(g.Version2c)
+	}
+	flags := g.AuthPriv
+	if c.Level == SnmpAuthNoPriv {
+		flags = g.AuthNoPriv
+	}
+	return sa.Usm(c.User, flags, g.SHA, c.AuthPassword, g.AES, c.PrivPassword)
+}
+
+//redacted is what the api shows of the credentials
+func (c *SnmpCredentials) redacted() *SnmpCredentials {
+	shown := *c
+	shown.Community, shown.AuthPassword, shown.PrivPassword = "", "", ""
+	return &shown
+}
+
+func snmpTor(rw http.ResponseWriter, r *http.Request) (string, bool) {
+	tor := new(SapiTor)
+	has, err := tor.search(mux.Vars(r)["ip"])
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return "", false
+	}
+	if !has {
+		HttpError(rw, "Not Found", nil, http.StatusNotFound)
+		return "", false
+	}
+	return tor.TorIp, true
+}
+
+//showSnmp shows how a tor is polled, secrets left out
+func showSnmp(rw http.ResponseWriter, r *http.Request) {
+	tor, ok := snmpTor(rw, r)
+	if !ok {
+		return
+	}
+	c, err := snmpCredentials(tor)
+	if err != nil {
+		HttpError(rw, "Snmp Credentials Error", err, http.StatusInternalServerError)
+		return
+	}
+	writeJson(rw, c.redacted())
+}
+
+//updateSnmp stores the snmp credentials of a tor, the next poll uses them
+func updateSnmp(rw http.ResponseWriter, r *http.Request) {
+	tor, ok := snmpTor(rw, r)
+	if !ok {
+		return
+	}
+	c := new(SnmpCredentials)
+	if err := json.NewDecoder(r.Body).Decode(c); err != nil {
+		HttpError(rw, "Bad Request", nil, http.StatusBadRequest)
+		return
+	}
+	if err := c.normalize(); err != nil {
+		HttpError(rw, err.Error(), err, http.StatusBadRequest)
+		return
+	}
+	if err := storeSnmp(tor, c); err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	Log().WithFields(logrus.Fields{
+		"Tor":     tor,
+		"Version": c.Version,
+		"Level":   c.Level,
+	}).Info("updateSnmp: snmp credentials changed")
+	requestRefresh()
+	rw.Write([]byte("OK"))
+}
+
+//deleteSnmp puts a tor back on the default credentials
+func deleteSnmp(rw http.ResponseWriter, r *http.Request) {
+	tor, ok := snmpTor(rw, r)
+	if !ok {
+		return
+	}
+	if _, err := DB().Delete(&SapiTorSnmp{TorIp: tor}); err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	rw.Write([]byte("OK"))
+}
+
+func init() {
+	Regist(MakeApiEndpoints("GET", torsPath+"{ip}/snmp", http.HandlerFunc(showSnmp)))
+	Regist(MakeApiEndpoints("PUT", torsPath+"{ip}/snmp", http.HandlerFunc(updateSnmp)))
+	Regist(MakeApiEndpoints("DELETE", torsPath+"{ip}/snmp", http.HandlerFunc(deleteSnmp)))
+}
@@ -0,0 +1,66 @@
+package sapi
+
+import (
+	"testing"
+
+	g "github.com/soniah/gosnmp"
+)
+
+func TestSealSecret(t *testing.T) {
+	savedKey := snmpKey
+	defer func() { snmpKey = savedKey }()
+
+	snmpKey = nil
+	if _, err := sealSecret([]byte("secret")); err != ErrorSnmpKey {
+		t.Errorf("Expected %s without a key, got %v", ErrorSnmpKey, err)
+	}
+
+	SetSnmp("key1", true, "public")
+	sealed, err := sealSecret([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if plain, err := openSecret(sealed); err != nil || string(plain) != "secret" {
+		t.Errorf("Expected secret opened, got %q %v", plain, err)
+	}
+	SetSnmp("key2", true, "public")
+	if _, err := openSecret(sealed); err != ErrorSnmpSecret {
+		t.Errorf("Expected %s with another key, got %v", ErrorSnmpSecret, err)
+	}
+}
+
+func TestSnmpCredentials(t *testing.T) {
+	defer SetSnmp("", true, "public")
+
+	c := &SnmpCredentials{Version: SnmpV3, User: "sapi", AuthPassword: "authpass", PrivPassword: "privpass"}
+	if err := c.normalize(); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if c.Level != SnmpAuthPriv || c.AuthProtocol != SnmpSHA || c.PrivProtocol != SnmpAES || c.Port != 161 {
+		t.Errorf("Expected authPriv with SHA and AES on port 161, got %+v", c)
+	}
+	gs := c.agent("127.0.0.1", pollTimeout).GS()
+	usm, ok := gs.SecurityParameters.(*g.UsmSecurityParameters)
+	if gs.Version != g.Version3 || gs.MsgFlags != g.AuthPriv || !ok || usm.PrivacyProtocol != g.AES {
+		t.Errorf("Expected a v3 authPriv agent, got %+v", gs)
+	}
+
+	bad := []*SnmpCredentials{
+		{Version: SnmpV3, AuthPassword: "authpass"},
+		{Version: SnmpV3, User: "sapi", AuthPassword: "short"},
+		{Version: SnmpV3, User: "sapi", AuthPassword: "authpass", AuthProtocol: "MD5"},
+		{Version: SnmpV3, User: "sapi", AuthPassword: "authpass", Level: "noAuthNoPriv"},
+		{Version: SnmpV2c},
+		{Version: "v1", Community: "public"},
+	}
+	for _, c := range bad {
+		if err := c.normalize(); err == nil {
+			t.Errorf("Expected %+v refused", c)
+		}
+	}
+
+	SetSnmp("", false, "public")
+	if err := (&SnmpCredentials{Version: SnmpV2c, Community: "private"}).normalize(); err != ErrorSnmpV2c {
+		t.Errorf("Expected %s, got %v", ErrorSnmpV2c, err)
+	}
+}
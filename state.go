@@ -0,0 +1,481 @@
+package sapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-xorm/xorm"
+	"github.com/gorilla/mux"
+)
+
+const (
+	//operation kind of a desired state reconciliation
+	OpReconcile = "reconcile"
+)
+
+var (
+	reconcilePath     = "/reconcile"
+	reconcileInterval = time.Minute * 10
+)
+
+//statePlan is the delta between the desired state of a tor and its switch
+type statePlan struct {
+	Mesh *meshPlan `json:"mesh"`
+	//vsis missing on the switch or missing tunnels, one ensure fixes all
+	Ensure  []int          `json:"ensure"`
+	Map     []VlanMap      `json:"map"`
+	Unmap   []vlanUnmapJob `json:"unmap"`
+	Trunk   []Trunk        `json:"trunk"`
+	Untrunk []Trunk        `json:"untrunk"`
+	//vsis sapi does not want but no stale mapping takes away, left alone
+	Stray []int `json:"stray"`
+}
+
+func (p *statePlan) empty() bool {
+	return p.Mesh.empty() &&
+		len(p.Ensure)+len(p.Map)+len(p.Unmap)+len(p.Trunk)+len(p.Untrunk) == 0
+}
+
+//StateReport is the reconciliation result of one tor
+type StateReport struct {
+	Tor     string        `json:"tor"`
+	Desired *SwitchConfig `json:"desired,omitempty"`
+	Actual  *SwitchConfig `json:"actual,omitempty"`
+	Plan    *statePlan    `json:"plan,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+//SetReconcileInterval sets how often the desired state of every tor is
+//reconciled, 0 only reconciles on demand.
+func SetReconcileInterval(d time.Duration) {
+	reconcileInterval = d
+}
+
+func mapKey(m VlanMap) string {
+	return fmt.Sprintf("map:%d/%d/%d", m.Index, m.Vlan, m.Vxlan)
+}
+
+func trunkKey(t Trunk) string {
+	return fmt.Sprintf("trunk:%d/%d/%t", t.Index, t.Vlan, t.Untagged)
+}
+
+func provisionedNets() (map[string]*SapiProvisionedNets, error) {
+	every := make([]*SapiProvisionedNets, 0)
+	if err := DB().Find(&every); err != nil {
+		return nil, err
+	}
+	nets := make(map[string]*SapiProvisionedNets)
+	for _, net := range every {
+		nets[net.NetworkId] = net
+	}
+	return nets, nil
+}
+
+//desiredBindings derives the mappings and trunks of a tor from its port
+//mappings, ports sharing an interface share the entry.
+func desiredBindings(pvms []*SapiPortVlanMapping, nets map[string]*SapiProvisionedNets,
+	tunnelIds []int) ([]VlanMap, []Trunk) {
+	mappings := []VlanMap{}
+	trunks := []Trunk{}
+	seen := make(map[string]bool)
+	for _, pvm := range pvms {
+		net, ok := nets[pvm.NetworkId]
+		if !ok {
+			continue
+		}
+		if netType(net) == NetTypeVxlan {
+			m := VlanMap{Vlan: pvm.VlanId, Vxlan: net.SegmentationId, Index: pvm.Index, TunnelIds: tunnelIds}
+			if !seen[mapKey(m)] {
+				seen[mapKey(m)] = true
+				mappings = append(mappings, m)
+			}
+			continue
+		}
+		_, untagged, err := providerVlan(net)
+		if err != nil {
+			continue
+		}
+		t := Trunk{Vlan: pvm.VlanId, Index: pvm.Index, Untagged: untagged}
+		if !seen[trunkKey(t)] {
+			seen[trunkKey(t)] = true
+			trunks = append(trunks, t)
+		}
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		a, b := mappings[i], mappings[j]
+		return a.Index < b.Index || a.Index == b.Index && a.Vlan < b.Vlan
+	})
+	sort.Slice(trunks, func(i, j int) bool {
+		a, b := trunks[i], trunks[j]
+		return a.Index < b.Index || a.Index == b.Index && a.Vlan < b.Vlan
+	})
+	return mappings, trunks
+}
+
+//desiredState is what the switch of a tor should have according to the
+//database: the recorded tunnels, the referenced vsis, and the mappings and
+//trunks of the ports bound through the tor.
+func desiredState(tor *SapiTor) (*SwitchConfig, error) {
+	state := &SwitchConfig{Tunnels: []Tunnel{}, Vsis: getVsis(tor.TorIp)}
+
+	records := make([]*SapiTorTunnels, 0)
+	if err := SelectAllTunnelByTor(tor.TorIp, &records); err != nil {
+		return nil, err
+	}
+	tunnelIds := []int{}
+	for _, r := range records {
+		state.Tunnels = append(state.Tunnels, Tunnel{Id: r.TunnelId, Src: tor.TunnelSrcIp, Dst: r.DstAddr})
+		tunnelIds = append(tunnelIds, r.TunnelId)
+	}
+	sort.Ints(tunnelIds)
+
+	pvms := make([]*SapiPortVlanMapping, 0)
+	if err := DB().Where("tor_ip=?", tor.TorIp).Find(&pvms); err != nil {
+		return nil, err
+	}
+	nets, err := provisionedNets()
+	if err != nil {
+		return nil, err
+	}
+	state.Mappings, state.Trunks = desiredBindings(pvms, nets, tunnelIds)
+	return state, nil
+}
+
+//planState compares the desired state of a tor without its tunnels with
+//the switch. Changes with a job queued are left to the job.
+func planState(desired, actual *SwitchConfig, queued map[string]bool) *statePlan {
+	plan := &statePlan{
+		Mesh:    new(meshPlan),
+		Ensure:  []int{},
+		Map:     []VlanMap{},
+		Unmap:   []vlanUnmapJob{},
+		Trunk:   []Trunk{},
+		Untrunk: []Trunk{},
+		Stray:   []int{}}
+
+	want := make(map[int]bool)
+	for _, vxlan := range desired.Vsis {
+		want[vxlan] = true
+	}
+	tunnels := make(map[int]bool)
+	for _, t := range desired.Tunnels {
+		tunnels[t.Id] = true
+	}
+	has := make(map[int]bool)
+	for _, vxlan := range actual.Vsis {
+		has[vxlan] = true
+	}
+	//the tunnels of a vsi show on its mappings only
+	short := make(map[int]bool)
+	for _, m := range actual.Mappings {
+		ids := make(map[int]bool)
+		for _, id := range m.TunnelIds {
+			ids[id] = true
+		}
+		for id := range tunnels {
+			if !ids[id] {
+				short[m.Vxlan] = true
+			}
+		}
+	}
+	if !queued[JobEnsure] {
+		for _, vxlan := range desired.Vsis {
+			if !has[vxlan] || short[vxlan] {
+				plan.Ensure = append(plan.Ensure, vxlan)
+			}
+		}
+	}
+
+	mapped := make(map[string]bool)
+	for _, m := range actual.Mappings {
+		mapped[mapKey(m)] = true
+	}
+	wanted := make(map[string]bool)
+	for _, m := range desired.Mappings {
+		wanted[mapKey(m)] = true
+		if !mapped[mapKey(m)] && !queued[mapKey(m)] {
+			plan.Map = append(plan.Map, m)
+		}
+	}
+	//the last stale mapping of an unwanted vsi takes the vsi along
+	stale := make(map[int]int)
+	for _, m := range actual.Mappings {
+		if !wanted[mapKey(m)] && !queued[mapKey(m)] {
+			stale[m.Vxlan]++
+		}
+	}
+	removed := make(map[int]bool)
+	for _, m := range actual.Mappings {
+		if wanted[mapKey(m)] || queued[mapKey(m)] {
+			continue
+		}
+		stale[m.Vxlan]--
+		last := stale[m.Vxlan] == 0 && !want[m.Vxlan]
+		if last {
+			removed[m.Vxlan] = true
+		}
+		plan.Unmap = append(plan.Unmap, vlanUnmapJob{
+			VlanMap:   VlanMap{Vlan: m.Vlan, Vxlan: m.Vxlan, Index: m.Index},
+			OnlyIndex: !last})
+	}
+	for _, vxlan := range actual.Vsis {
+		if !want[vxlan] && !removed[vxlan] {
+			plan.Stray = append(plan.Stray, vxlan)
+		}
+	}
+
+	trunked := make(map[string]bool)
+	for _, t := range actual.Trunks {
+		trunked[trunkKey(t)] = true
+	}
+	wanted = make(map[string]bool)
+	for _, t := range desired.Trunks {
+		wanted[trunkKey(t)] = true
+		if !trunked[trunkKey(t)] && !queued[trunkKey(t)] {
+			plan.Trunk = append(plan.Trunk, t)
+		}
+	}
+	for _, t := range actual.Trunks {
+		if !wanted[trunkKey(t)] && !queued[trunkKey(t)] {
+			plan.Untrunk = append(plan.Untrunk, t)
+		}
+	}
+	return plan
+}
+
+//queuedChanges returns the mapping changes of a tor not finished yet
+func queuedChanges(tor string) (map[string]bool, error) {
+	queued := make(map[string]bool)
+	every := make([]*SapiConfigJobs, 0)
+	err := DB().Where("tor_ip=?", tor).In("state", []string{JobPending, JobRunning}).
+		In("kind", []string{JobEnsure, JobVlanMap, JobVlanUnmap, JobTrunk, JobUntrunk}).Find(&every)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range every {
+		switch job.Kind {
+		case JobEnsure:
+			queued[JobEnsure] = true
+		case JobVlanMap, JobVlanUnmap:
+			var m VlanMap
+			if json.Unmarshal([]byte(job.Payload), &m) == nil {
+				queued[mapKey(m)] = true
+			}
+		case JobTrunk, JobUntrunk:
+			var t Trunk
+			if json.Unmarshal([]byte(job.Payload), &t) == nil {
+				queued[trunkKey(t)] = true
+			}
+		}
+	}
+	return queued, nil
+}
+
+//torStatePlan reads the switch of a tor and plans its delta, tunnels are
+//planned as the mesh reconciliation does.
+func torStatePlan(tor *SapiTor, sapiTors []*SapiTor) (*StateReport, error) {
+	d, err := driverFor(tor)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := d.ReadConfig(tor)
+	if err != nil {
+		return nil, err
+	}
+	desired, err := desiredState(tor)
+	if err != nil {
+		return nil, err
+	}
+	queued, err := queuedChanges(tor.TorIp)
+	if err != nil {
+		return nil, err
+	}
+	recorded := make([]*SapiTorTunnels, 0)
+	if err := SelectAllTunnelByTor(tor.TorIp, &recorded); err != nil {
+		return nil, err
+	}
+	creating, deleting, err := queuedTunnels(tor.TorIp)
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := meshOf(tor, sapiTors)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := planState(desired, actual, queued)
+	plan.Mesh = planMesh(tor, expected, recorded, actual.Tunnels, creating, deleting)
+	return &StateReport{Tor: tor.TorIp, Desired: desired, Actual: actual, Plan: plan}, nil
+}
+
+//applyState queues the delta of a tor in the transaction of s, stale
+//mappings go before new ones so an interface vlan can move to another vni.
+func applyState(s *xorm.Session, op string, tor *SapiTor, plan *statePlan) error {
+	if !plan.Mesh.empty() {
+		if err := applyMesh(s, op, tor, plan.Mesh); err != nil {
+			return err
+		}
+	}
+	for _, m := range plan.Unmap {
+		if err := enqueueJob(s, op, tor.TorIp, JobVlanUnmap, m); err != nil {
+			return err
+		}
+	}
+	for _, t := range plan.Untrunk {
+		if err := enqueueJob(s, op, tor.TorIp, JobUntrunk, t); err != nil {
+			return err
+		}
+	}
+	for _, m := range plan.Map {
+		if err := enqueueJob(s, op, tor.TorIp, JobVlanMap, m); err != nil {
+			return err
+		}
+	}
+	for _, t := range plan.Trunk {
+		if err := enqueueJob(s, op, tor.TorIp, JobTrunk, t); err != nil {
+			return err
+		}
+	}
+	if len(plan.Ensure) != 0 && len(plan.Mesh.Create) == 0 {
+		return enqueueJob(s, op, tor.TorIp, JobEnsure, struct{}{})
+	}
+	return nil
+}
+
+//reconcileState plans, and unless dryRun applies, the desired state of the
+//tor ip or of every tor if ip is empty. A tor whose switch cannot be read
+//is left alone.
+func reconcileState(ip string, dryRun bool) (string, []*StateReport, error) {
+	var op string
+	meshMu.Lock()
+	defer meshMu.Unlock()
+
+	sapiTors := make([]*SapiTor, 0)
+	if err := SelectAllTors(&sapiTors); err != nil {
+		return "", nil, err
+	}
+	sort.Slice(sapiTors, func(i, j int) bool { return sapiTors[i].TorIp < sapiTors[j].TorIp })
+
+	reports := []*StateReport{}
+	for _, tor := range sapiTors {
+		if ip != "" && tor.TorIp != ip {
+			continue
+		}
+		report, err := torStatePlan(tor, sapiTors)
+		if err != nil {
+			reports = append(reports, &StateReport{Tor: tor.TorIp, Error: err.Error()})
+			Log().WithFields(logrus.Fields{
+				"Tor":   tor.TorIp,
+				"Error": err,
+			}).Warn("reconcileState: tor skipped")
+			continue
+		}
+		reports = append(reports, report)
+		plan := report.Plan
+		if plan.empty() || dryRun {
+			continue
+		}
+		Log().WithFields(logrus.Fields{
+			"Tor":     tor.TorIp,
+			"Ensure":  len(plan.Ensure),
+			"Map":     len(plan.Map),
+			"Unmap":   len(plan.Unmap),
+			"Trunk":   len(plan.Trunk),
+			"Untrunk": len(plan.Untrunk),
+		}).Info("reconcileState: repair drift")
+		if op == "" {
+			var err error
+			if op, err = newOperation(OpReconcile); err != nil {
+				return "", nil, err
+			}
+		}
+		if err := queueJobs(func(s *xorm.Session) error {
+			return applyState(s, op, tor, plan)
+		}); err != nil {
+			return "", nil, err
+		}
+	}
+	return op, reports, nil
+}
+
+//GoReconcile reconciles the desired state of every tor every
+//reconcileInterval
+func GoReconcile(done chan struct{}) {
+	if reconcileInterval <= 0 {
+		return
+	}
+	go func() {
+		Seconds := time.NewTimer(reconcileInterval)
+		for {
+			select {
+			case <-Seconds.C:
+				if _, _, err := reconcileState("", false); err != nil {
+					Log().WithFields(logrus.Fields{"Error": err}).Error("GoReconcile: reconcile error")
+				}
+				Seconds.Reset(reconcileInterval)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func writeState(rw http.ResponseWriter, code int, op string, reports []*StateReport) {
+	rw.Header().Set("Content/Type", "application/json")
+	ret, _ := json.MarshalIndent(struct {
+		Operation string         `json:"operation,omitempty"`
+		Tors      []*StateReport `json:"tors"`
+	}{
+		Operation: op,
+		Tors:      reports,
+	}, "", "    ")
+	rw.WriteHeader(code)
+	rw.Write(ret)
+}
+
+//showState reports the desired and actual state of the tors and the delta
+func showState(rw http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	_, reports, err := reconcileState(ip, true)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if ip != "" && len(reports) == 0 {
+		HttpError(rw, "Tor Not Found", nil, http.StatusNotFound)
+		return
+	}
+	writeState(rw, http.StatusOK, "", reports)
+}
+
+//repairState applies the delta now, the response carries the operation of
+//the repairs if any were needed.
+func repairState(rw http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	op, reports, err := reconcileState(ip, false)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if ip != "" && len(reports) == 0 {
+		HttpError(rw, "Tor Not Found", nil, http.StatusNotFound)
+		return
+	}
+	code := http.StatusOK
+	if op != "" {
+		_, code = finishOperation(rw, r, op)
+	}
+	writeState(rw, code, op, reports)
+}
+
+func init() {
+	Regist(MakeApiEndpoints("GET", reconcilePath, http.HandlerFunc(showState)))
+	Regist(MakeApiEndpoints("POST", reconcilePath, http.HandlerFunc(repairState)))
+	Regist(MakeApiEndpoints("GET", torsPath+"{ip}/state", http.HandlerFunc(showState)))
+	Regist(MakeApiEndpoints("POST", torsPath+"{ip}/reconcile", http.HandlerFunc(repairState)))
+}
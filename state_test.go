@@ -0,0 +1,71 @@
+package sapi
+
+import (
+	"testing"
+)
+
+func TestDesiredBindings(t *testing.T) {
+	nets := map[string]*SapiProvisionedNets{
+		"vx":   {NetworkId: "vx", SegmentationId: 100},
+		"prov": {NetworkId: "prov", SegmentationType: NetTypeVlan, SegmentationId: 30},
+	}
+	pvms := []*SapiPortVlanMapping{
+		{PortId: "p1", NetworkId: "vx", TorIp: "tor1", VlanId: 2, Index: 3},
+		{PortId: "p2", NetworkId: "vx", TorIp: "tor1", VlanId: 2, Index: 3},
+		{PortId: "p3", NetworkId: "prov", TorIp: "tor1", VlanId: 30, Index: 4},
+		{PortId: "p4", NetworkId: "gone", TorIp: "tor1", VlanId: 5, Index: 4},
+	}
+	mappings, trunks := desiredBindings(pvms, nets, []int{1})
+	if len(mappings) != 1 || mappings[0].Vxlan != 100 || len(mappings[0].TunnelIds) != 1 {
+		t.Errorf("Expected one mapping to vxlan 100, got %+v", mappings)
+	}
+	if len(trunks) != 1 || trunks[0].Vlan != 30 || trunks[0].Index != 4 {
+		t.Errorf("Expected vlan 30 trunked on index 4, got %+v", trunks)
+	}
+}
+
+func TestPlanState(t *testing.T) {
+	desired := &SwitchConfig{
+		Tunnels:  []Tunnel{{Id: 1}, {Id: 2}},
+		Vsis:     []int{100, 200},
+		Mappings: []VlanMap{{Vlan: 2, Vxlan: 100, Index: 3}, {Vlan: 3, Vxlan: 200, Index: 3}},
+		Trunks:   []Trunk{{Vlan: 30, Index: 4}},
+	}
+	actual := &SwitchConfig{
+		Vsis: []int{100, 300, 400},
+		Mappings: []VlanMap{
+			{Vlan: 2, Vxlan: 100, Index: 3, TunnelIds: []int{1}},
+			{Vlan: 4, Vxlan: 300, Index: 3, TunnelIds: []int{1, 2}},
+			{Vlan: 4, Vxlan: 300, Index: 5, TunnelIds: []int{1, 2}},
+		},
+		Trunks: []Trunk{{Vlan: 31, Index: 4}},
+	}
+
+	plan := planState(desired, actual, map[string]bool{})
+	if len(plan.Ensure) != 2 {
+		t.Errorf("Expected vsi 100 short of a tunnel and vsi 200 missing, got %v", plan.Ensure)
+	}
+	if len(plan.Map) != 1 || plan.Map[0].Vxlan != 200 {
+		t.Errorf("Expected vlan 3 mapped to vxlan 200, got %+v", plan.Map)
+	}
+	if len(plan.Unmap) != 2 || !plan.Unmap[0].OnlyIndex || plan.Unmap[1].OnlyIndex {
+		t.Errorf("Expected vsi 300 removed with its last mapping, got %+v", plan.Unmap)
+	}
+	if len(plan.Stray) != 1 || plan.Stray[0] != 400 {
+		t.Errorf("Expected vsi 400 stray, got %v", plan.Stray)
+	}
+	if len(plan.Trunk) != 1 || len(plan.Untrunk) != 1 {
+		t.Errorf("Expected vlan 30 trunked instead of 31, got %+v %+v", plan.Trunk, plan.Untrunk)
+	}
+
+	queued := map[string]bool{
+		JobEnsure:                   true,
+		mapKey(desired.Mappings[1]): true,
+		trunkKey(desired.Trunks[0]): true,
+		trunkKey(actual.Trunks[0]):  true,
+	}
+	plan = planState(desired, actual, queued)
+	if len(plan.Ensure)+len(plan.Map)+len(plan.Trunk)+len(plan.Untrunk) != 0 {
+		t.Errorf("Expected queued changes left to their jobs, got %+v", plan)
+	}
+}
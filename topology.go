@@ -2,26 +2,27 @@ package sapi
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
+	gosync "sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	sjson "github.com/bitly/go-simplejson"
+	"github.com/go-xorm/xorm"
 	"github.com/gorilla/mux"
 )
 
 var (
-	tors           = []string{}
-	tp             map[string][]*Topology
-	ts             map[string][]string
-	refresh        = make(chan bool)
-	tunnelSyncDone = make(chan bool)
-	tplv           = make(map[string]*LocalVlan)
-	tplvCache      = make(map[string]int)
+	tp        = make(map[string][]*Topology)
+	ts        = make(map[string][]string)
+	refresh   = make(chan bool, 1)
+	tplv      = make(map[string]*LocalVlan)
+	tplvCache = make(map[string]int)
+	//vlansMu guards tplvCache and the bitmaps of the vlan pools, it is
+	//held around the allocation helpers below
+	vlansMu gosync.Mutex
 
 	lv            = "/localvlan/"
 	vlanVpcMin    = 2
@@ -29,7 +30,21 @@ var (
 	vlanSharedMin = 4002
 	vlanSharedMax = 4094
 
-	torconf = "http://10.216.25.51:8081"
+	//shared networks vlan allocation, see SetSharedVlanPolicy
+	sharedVlanPolicy = SharedVlanPerTor
+	fabricShared     = NewBitmap(uint32(vlanSharedMin), uint32(vlanSharedMax))
+
+	ErrorVlanPolicy = errors.New("Unknown shared vlan policy")
+)
+
+const (
+	//every tor allocates shared vlans from its own pool
+	SharedVlanPerTor = "tor"
+	//shared vlans come from one pool reserved on every tor
+	SharedVlanFabric = "fabric"
+
+	//tor ip recorded in SapiVlanAllocations for fabric-wide allocations
+	fabricTor = "fabric"
 )
 
 type LocalVlan struct {
@@ -37,10 +52,11 @@ type LocalVlan struct {
 }
 
 type VlanMapping struct {
-	VlanId int    `json:"vlan_id"`
-	NetId  string `json:"netid"`
-	Host   string `json:"host"`
-	Tor    string `json:"tor"`
+	VlanId  int      `json:"vlan_id"`
+	NetId   string   `json:"netid"`
+	Host    string   `json:"host"`
+	Tor     string   `json:"tor"`
+	Uplinks []Uplink `json:"uplinks"`
 }
 
 func getId(tor, netid string, shared bool) (id string) {
@@ -85,126 +101,150 @@ func GetTors() []string {
 	return ret
 }
 
-func allocateVlanId(tor string, vid *uint32, shared bool) bool {
-	//allocate a new local vlan id.
-	if shared {
-		return tplv[tor].Shared.GetUnusedBit(vid)
-	} else {
-		return tplv[tor].Unshared.GetUnusedBit(vid)
+//SetSharedVlanPolicy selects where shared networks get their vlan from,
+//must be called before InitInmemoryData.
+func SetSharedVlanPolicy(policy string) error {
+	switch policy {
+	case SharedVlanPerTor, SharedVlanFabric:
+		sharedVlanPolicy = policy
+		return nil
 	}
+	return ErrorVlanPolicy
 }
 
-func releaseVlanId(tor string, vid uint32, shared bool) {
-	if shared {
-		tplv[tor].Shared.UnsetBit(vid)
-	} else {
-		tplv[tor].Unshared.UnsetBit(vid)
+//allocationTor returns the scope a vlan allocation is accounted to, shared
+//networks under fabric policy are accounted to the whole fabric and tors
+//in a mlag pair share one scope.
+func allocationTor(tor string, shared bool) string {
+	if shared && sharedVlanPolicy == SharedVlanFabric {
+		return fabricTor
+	}
+	if pair := torPair(tor); pair != "" {
+		return pairScope(pair)
 	}
+	return tor
 }
 
-func deleteSva(netid, tor string, vlanId int, shared bool) {
+//scopeTors returns the tors an allocation scope covers.
+func scopeTors(scope string) []string {
+	if scope == fabricTor {
+		return registeredTors()
+	}
+	if strings.HasPrefix(scope, pairPrefix) {
+		return pairMembers(strings.TrimPrefix(scope, pairPrefix))
+	}
+	return []string{scope}
+}
+
+//scopePools returns every bitmap a vlan id must be free in for the scope.
+func scopePools(scope string, shared bool) []*BitMap {
+	pools := []*BitMap{}
+	if scope == fabricTor {
+		pools = append(pools, fabricShared)
+	}
+	for _, tor := range scopeTors(scope) {
+		lv, ok := torPools(tor)
+		if !ok {
+			continue
+		}
+		if shared {
+			pools = append(pools, lv.Shared)
+		} else {
+			pools = append(pools, lv.Unshared)
+		}
+	}
+	return pools
+}
+
+func allocateVlanId(scope string, vid *uint32, shared bool) bool {
+	//allocate a new local vlan id, free on every tor of the scope.
+	pools := scopePools(scope, shared)
+	if len(pools) == 0 {
+		return false
+	}
+	for i := pools[0].Min; i <= pools[0].Max; i++ {
+		used := false
+		for _, pool := range pools {
+			if pool.bitOn(i) {
+				used = true
+				break
+			}
+		}
+		if used {
+			continue
+		}
+		for _, pool := range pools {
+			pool.Setbit(i)
+		}
+		*vid = i
+		return true
+	}
+	return false
+}
+
+func reserveVlanId(scope string, vid uint32, shared bool) {
+	for _, pool := range scopePools(scope, shared) {
+		pool.Setbit(vid)
+	}
+}
+
+func releaseVlanId(scope string, vid uint32, shared bool) {
+	for _, pool := range scopePools(scope, shared) {
+		pool.UnsetBit(vid)
+	}
+}
+
+func deleteSva(s *xorm.Session, netid, tor string, vlanId int, shared bool) error {
 	sva := new(SapiVlanAllocations)
 	sva.NetworkId = netid
 	sva.TorIp = tor
 	sva.VlanId = vlanId
 	sva.Allocated = true
 	sva.Shared = shared
-	sva.delete()
+	_, err := s.Delete(sva)
+	return err
 }
 
-func addNewSva(netid, tor string, vlanId int, shared bool) {
+func addNewSva(s *xorm.Session, netid, tor string, vlanId int, shared bool) error {
 	sva := new(SapiVlanAllocations)
 	sva.NetworkId = netid
 	sva.TorIp = tor
 	sva.VlanId = vlanId
 	sva.Allocated = true
 	sva.Shared = shared
-	sva.insert()
-}
-
-func addNewVsi(tor string, vxlan int) {
-	vsi := new(SapiTorVsis)
-	vsi.TorIp = tor
-	vsi.Vxlan = vxlan
-	vsi.insert()
-}
-
-func deleteVsi(tor string, vxlan int) {
-	vsi := new(SapiTorVsis)
-	vsi.TorIp = tor
-	vsi.Vxlan = vxlan
-	vsi.delete()
+	_, err := s.Insert(sva)
+	return err
 }
 
-func addNewPvm(portid, netid, tor string, vlanId, index int) {
+func addNewPvm(s *xorm.Session, portid, netid, tor string, vlanId, index int) error {
 	pvm := new(SapiPortVlanMapping)
+	pvm.PortId = portid
 	pvm.NetworkId = netid
 	pvm.TorIp = tor
 	pvm.VlanId = vlanId
 	pvm.Index = index
-	pvm.insert()
+	_, err := s.Insert(pvm)
+	return err
 }
 
-func addNewTunnel(tor, dst string, id int) {
+func addNewTunnel(s *xorm.Session, tor, dst string, id int) error {
 	tunnel := new(SapiTorTunnels)
 	tunnel.TorIp = tor
 	tunnel.TunnelId = id
 	tunnel.DstAddr = dst
-	tunnel.insert()
-}
-
-func selectUptor(h string) string {
-	for torIp, hosts := range ts {
-		for _, host := range hosts {
-			if h == host {
-				return torIp
-				break
-			}
-		}
-	}
-	return ""
+	_, err := s.Insert(tunnel)
+	return err
 }
 
-func selectIndex(h, tor string) (index int) {
-	indexs, _ := tp[tor]
-	for _, item := range indexs {
-		if h == item.Host {
-			index, _ = strconv.Atoi(item.Index)
-			break
-		}
-	}
-	return index
-}
-
-func goTunnelSync(torType, tor, src, dst string) {
-	tunnel_id := struct {
-		TunnelId int `json:"tunnel_id"`
-	}{}
-	client := NewHttpAgent()
-	_, bodystr, _ := client.Post(torconf + "/tunnel").ReqData(
-		struct {
-			Type string `json:"type"`
-			Mgr  string `json:"mgr"`
-			Src  string `json:"src"`
-			Dst  string `json:"dst"`
-		}{
-			Type: torType,
-			Mgr:  tor,
-			Src:  src,
-			Dst:  dst},
-	).Issue()
-	if err := json.Unmarshal([]byte(bodystr), &tunnel_id); err != nil {
-		Log().WithFields(logrus.Fields{
-			"Error": err,
-			"Body":  bodystr,
-		}).Error("registerTor: /tunnel response error")
-	}
-	addNewTunnel(tor, dst, tunnel_id.TunnelId)
+func goTunnelSync(s *xorm.Session, op, tor, src, dst string) error {
 	Log().WithFields(logrus.Fields{
 		"Switch":     tor,
 		"Source":     src,
 		"Destnation": dst,
-	}).Info("registerTor: New vxlan tunnel")
+	}).Info("registerTor: queue vxlan tunnel")
+	return enqueueJob(s, op, tor, JobTunnel, Tunnel{
+		Src: src,
+		Dst: dst})
 }
 
 func registerTor(rw http.ResponseWriter, r *http.Request) {
@@ -213,9 +253,13 @@ func registerTor(rw http.ResponseWriter, r *http.Request) {
 			Type string `json:"switch_type"`
 			Mgr  string `json:"mgr"`
 			Src  string `json:"tunnel_src"`
+			//left out, a registered tor keeps the stored value
+			Pair *string `json:"pair_id"`
+			Pod  *string `json:"pod"`
+			Conf *string `json:"torconf"`
 		}
 		sapiTor  = new(SapiTor)
-		sapiTors = make([]*SapiTor, 0)
+		existing = new(SapiTor)
 	)
 
 	decoder := json.NewDecoder(r.Body)
@@ -228,58 +272,117 @@ func registerTor(rw http.ResponseWriter, r *http.Request) {
 		HttpError(rw, "Bad Request", nil, http.StatusBadRequest)
 		return
 	}
-	if err := SelectAllTors(&sapiTors); err != nil {
-		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+	if !hasDriver(data.Type) {
+		HttpError(rw, "Unknown switch type", nil, http.StatusBadRequest)
 		return
 	}
 
+	//registering a tor again is an update, a no-op if nothing changed
+	has, err := existing.search(data.Mgr)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if has {
+		*sapiTor = *existing
+	}
 	sapiTor.TorIp = data.Mgr
 	sapiTor.TunnelSrcIp = data.Src
 	sapiTor.Type = data.Type
+	if data.Pair != nil {
+		sapiTor.PairId = *data.Pair
+	}
+	if data.Pod != nil {
+		sapiTor.Pod = *data.Pod
+	}
+	if data.Conf != nil {
+		sapiTor.Torconf = *data.Conf
+	}
+
+	if has {
+		op, err := changeTor(existing, sapiTor)
+		if err == ErrorTorInUse {
+			HttpError(rw, "Tor has bound ports, unbind them to change its pair", err, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+			return
+		}
+		if err := InitInmemoryData([]string{sapiTor.TorIp}); err != nil {
+			HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+			return
+		}
+		if op == "" {
+			rw.Write([]byte("OK"))
+			return
+		}
+		o, code := finishOperation(rw, r, op)
+		rw.WriteHeader(code)
+		rw.Write([]byte(operationMessage(o)))
+		return
+	}
+
 	Log().Info(fmt.Sprintf("registerTor: Tor %s", sapiTor))
-	sapiTor.insert()
+	op, err := newOperation(JobTsync)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	//tunnels are built once the switch told us the existing endpoints, see tsyncDone
+	err = queueJobs(func(s *xorm.Session) error {
+		if _, err := s.Insert(sapiTor); err != nil {
+			return err
+		}
+		Log().Info(fmt.Sprintf("registerTor: queue tunnel sync for %s", sapiTor.TorIp))
+		return enqueueJob(s, op, sapiTor.TorIp, JobTsync, struct{}{})
+	})
+	if err != nil {
+		failOperation(op, err)
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
 
 	//need refresh topology
-	tors = append(tors, sapiTor.TorIp)
-	InitInmemoryData([]string{sapiTor.TorIp})
-	refresh <- true
+	if err := InitInmemoryData([]string{sapiTor.TorIp}); err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	requestRefresh()
 
-	//TODO: tunnel sync
-	go func() {
-		client := NewHttpAgent()
-		Log().Info(fmt.Sprintf("registerTor: make tunnel sync request %s", torconf+"/tsync"))
-		_, bodystr, _ := client.Post(torconf + "/tsync").ReqData(
-			struct {
-				Src        string `json:"src"`
-				TunnelType string `json:"tunnel_type"`
-			}{
-				Src:        sapiTor.TunnelSrcIp,
-				TunnelType: "vxlan",
-			},
-		).Issue()
-		Log().Info(fmt.Sprintf("registerTor: request got response %s", bodystr))
-
-		respj, _ := sjson.NewFromReader(strings.NewReader(bodystr))
-		tunnels, _ := respj.CheckGet("tunnels")
-		all, _ := tunnels.Array()
-		for _, tunnel := range all {
-			if m, ok := tunnel.(map[string]interface{}); ok {
-				ip, _ := m["ip_address"].(string)
-				if ip != sapiTor.TunnelSrcIp {
-					//new tunnel with existing tunnel src ip.
-					goTunnelSync(sapiTor.Type, sapiTor.TorIp, sapiTor.TunnelSrcIp, ip)
-				}
-			}
-		}
+	o, code := finishOperation(rw, r, op)
+	rw.WriteHeader(code)
+	rw.Write([]byte(operationMessage(o)))
+}
 
-		for _, tor := range sapiTors {
-			//new tunnel form existing tunnel src ip to new tunnel src ip.
-			goTunnelSync(tor.Type, tor.TorIp, tor.TunnelSrcIp, sapiTor.TunnelSrcIp)
-		}
-		Log().Info(fmt.Sprintf("registerTor: tunnel sync done, send signal to channel tunnelSyncDone"))
-		tunnelSyncDone <- true
-	}()
-	rw.Write([]byte("OK"))
+func goVlanMap(s *xorm.Session, op, tor string, vlanId, vxlan, index int) error {
+	Log().WithFields(logrus.Fields{
+		"Tor":   tor,
+		"Vxlan": vxlan,
+		"Vlan":  vlanId,
+		"Index": index,
+	}).Info("makeLocalvlanMap: queue vlan2vxlan")
+	//tunnel ids are filled in when the job runs, see execJob
+	return enqueueJob(s, op, tor, JobVlanMap, VlanMap{
+		Vlan:  vlanId,
+		Vxlan: vxlan,
+		Index: index})
+}
+
+func goVlanUnmap(s *xorm.Session, op, tor string, vlanId, vxlan, index int, onlyIndex bool) error {
+	Log().WithFields(logrus.Fields{
+		"Tor":       tor,
+		"Vxlan":     vxlan,
+		"Vlan":      vlanId,
+		"Index":     index,
+		"OnlyIndex": onlyIndex,
+	}).Info("deleteLocalvlanMap: queue vlan2vxlan removal.")
+	return enqueueJob(s, op, tor, JobVlanUnmap, vlanUnmapJob{
+		VlanMap: VlanMap{
+			Vlan:  vlanId,
+			Vxlan: vxlan,
+			Index: index},
+		OnlyIndex: onlyIndex})
 }
 
 func makeLocalvlanMap(rw http.ResponseWriter, r *http.Request) {
@@ -290,10 +393,10 @@ func makeLocalvlanMap(rw http.ResponseWriter, r *http.Request) {
 			PortId string `json:"portid"`
 		}
 		vlanmapping VlanMapping
-		upTor       string
-		id          string
+		uplinks     []Uplink
 		message     string
-		vid         uint32
+		vlanId      int
+		err         error
 	)
 
 	rw.Header().Set("Content/Type", "application/json")
@@ -306,8 +409,8 @@ func makeLocalvlanMap(rw http.ResponseWriter, r *http.Request) {
 		HttpError(rw, "Bad Request", nil, http.StatusBadRequest)
 		return
 	}
-	upTor = selectUptor(data.Host)
-	if upTor == "" {
+	uplinks = selectUplinks(data.Host)
+	if len(uplinks) == 0 {
 		HttpError(rw, "Host not found", nil, http.StatusNotFound)
 		return
 	}
@@ -323,260 +426,215 @@ func makeLocalvlanMap(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id = getId(upTor, data.NetId, net.Shared)
-	vlanId, ok := tplvCache[id]
-	if !ok {
-		if !allocateVlanId(upTor, &vid, net.Shared) {
-			HttpError(rw, "No avaliable id to allocate", nil, http.StatusBadRequest)
-			return
-		}
-		//add corrsponding records in database
-		vlanId = int(vid)
-		tplvCache[id] = vlanId
-		addNewSva(data.NetId, upTor, vlanId, net.Shared)
-		addNewVsi(upTor, net.SegmentationId)
-		Log().WithFields(logrus.Fields{
-			"Tor":   upTor,
-			"Vlan":  vlanId,
-			"Vxlan": net.SegmentationId,
-		}).Info("makeLocalvlanMap: New SapiVlanAllocations.")
-		Log().WithFields(logrus.Fields{
-			"Tor": upTor,
-			"Vsi": net.SegmentationId,
-		}).Info("makeLocalvlanMap: New SapiTorVsis.")
+	switch netType(net) {
+	case NetTypeVxlan, NetTypeVlan, NetTypeFlat:
+	default:
+		HttpError(rw, "Unsupported network type", nil, http.StatusBadRequest)
+		return
 	}
 
-	index := selectIndex(data.Host, upTor)
-	tunnel_ids := getTunnelIds(upTor)
-	addNewPvm(data.PortId, data.NetId, upTor, vlanId, index)
-	Log().WithFields(logrus.Fields{
-		"Tor":   upTor,
-		"Vxlan": net.SegmentationId,
-		"Vlan":  vlanId,
-		"Port":  data.PortId,
-		"Index": index,
-	}).Info("makeLocalvlanMap: New SapiPortVlanMapping.")
-
-	//config tor
-	go func() {
-		client := NewHttpAgent()
-		Log().WithFields(logrus.Fields{
-			"Tor":     upTor,
-			"Vxlan":   net.SegmentationId,
-			"Vlan":    vlanId,
-			"Tunnels": tunnel_ids,
-			"Index":   index,
-		}).Info("makeLocalvlanMap: request torconf /vlan2vxlan")
-		client.Post(torconf + "/vlan2vxlan").ReqData(
-			struct {
-				Type      string `json:"type"`
-				Vlan      int    `json:"vlan"`
-				Vxlan     int    `json:"vxlan"`
-				TunnelIds []int  `json:"tunnel_ids"`
-				Mgr       string `json:"mgr"`
-				Index     int    `json:"index"`
-			}{
-				Type:      "h3c",
-				Vlan:      vlanId,
-				Vxlan:     net.SegmentationId,
-				TunnelIds: tunnel_ids,
-				Mgr:       upTor,
-				Index:     index},
-		).Issue()
-	}()
+	op, err := newOperation(JobVlanMap)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if netType(net) == NetTypeVxlan {
+		vlanId, err = bindVxlan(op, data.PortId, net, uplinks)
+	} else {
+		vlanId, err = bindProvider(op, data.PortId, net, uplinks)
+	}
+	if err != nil {
+		//nothing was recorded nor queued, the operation tells the request
+		//failed
+		failOperation(op, err)
+		rw.Header().Set(opIdHeader, op)
+	}
+	switch err {
+	case nil:
+	case ErrorUplinkScope:
+		HttpError(rw, "Host uplinks not in one tor pair", err, http.StatusConflict)
+		return
+	case ErrorProviderVlanInUse:
+		HttpError(rw, "Provider vlan in use as local vlan", err, http.StatusConflict)
+		return
+	case ErrorNoVlanId, ErrorProviderVlan:
+		HttpError(rw, err.Error(), nil, http.StatusBadRequest)
+		return
+	default:
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
 
-	message = "OK"
+	o, code := finishOperation(rw, r, op)
+	message = operationMessage(o)
 	vlanmapping.VlanId = vlanId
-	vlanmapping.Tor = upTor
+	vlanmapping.Tor = uplinks[0].Tor
+	vlanmapping.Uplinks = uplinks
 	vlanmapping.NetId = data.NetId
 	vlanmapping.Host = data.Host
 
 	ret, _ := json.MarshalIndent(
 		struct {
-			Vm      VlanMapping `json:"vlanmapping"`
-			Message string      `json:"message"`
+			Vm        VlanMapping `json:"vlanmapping"`
+			Message   string      `json:"message"`
+			Operation string      `json:"operation"`
 		}{
-			Vm:      vlanmapping,
-			Message: message,
+			Vm:        vlanmapping,
+			Message:   message,
+			Operation: op,
 		}, "", "    ")
+	rw.WriteHeader(code)
 	rw.Write(ret)
 }
 
 func deleteLocalvlanMap(rw http.ResponseWriter, r *http.Request) {
-	var pvm = new(SapiPortVlanMapping)
+	var pvms = make([]*SapiPortVlanMapping, 0)
 	var net = new(SapiProvisionedNets)
-	var id string
-	var onlyIndex = true
 	portId, _ := mux.Vars(r)["id"]
 
-	if has, _ := pvm.search(portId); !has {
+	if err := SelectAllPvmByPort(portId, &pvms); err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if len(pvms) == 0 {
 		HttpError(rw, "Not found", nil, http.StatusNotFound)
 		return
 	}
 
-	if pvm.count() == 1 {
-		onlyIndex = false
-		net.search(pvm.NetworkId)
-		id = getId(pvm.TorIp, pvm.NetworkId, net.Shared)
-		//release this vlan id
-		releaseVlanId(pvm.TorIp, uint32(pvm.VlanId), net.Shared)
-		//delete key in tplvCache
-		delete(tplvCache, id)
-		//delete corrsponding record in database
-		deleteSva(pvm.NetworkId, pvm.TorIp, pvm.VlanId, net.Shared)
-		deleteVsi(pvm.TorIp, net.SegmentationId)
-		Log().WithFields(logrus.Fields{
-			"Tor":   pvm.TorIp,
-			"Vxlan": net.SegmentationId,
-			"Vlan":  pvm.VlanId,
-		}).Info("deleteLocalvlanMap: release SapiVlanAllocations.")
-		Log().WithFields(logrus.Fields{
-			"Tor": pvm.TorIp,
-			"Vsi": net.SegmentationId,
-		}).Info("deleteLocalvlanMap: release SapiTorVsis.")
+	if _, err := net.search(pvms[0].NetworkId); err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
 	}
-	//delete port mapping record
-	vlanId := pvm.VlanId
-	index := pvm.Index
-	upTor := pvm.TorIp
-	pvm.delete()
 
-	go func() {
-		client := NewHttpAgent()
-		Log().WithFields(logrus.Fields{
-			"Tor":       pvm.TorIp,
-			"Vxlan":     net.SegmentationId,
-			"Vlan":      vlanId,
-			"Index":     index,
-			"OnlyIndex": onlyIndex,
-		}).Info("deleteLocalvlanMap: request torconf /vlan2vxlan.")
-		client.Delete(torconf + "/vlan2vxlan").ReqData(
-			struct {
-				Type  string `json:"type"`
-				Vlan  int    `json:"vlan"`
-				Vxlan int    `json:"vxlan"`
-				Mgr   string `json:"mgr"`
-				Index int    `json:"index"`
-				Only  bool   `json:"delete_on_index"`
-			}{
-				Type:  "h3c",
-				Vlan:  vlanId,
-				Vxlan: net.SegmentationId,
-				Mgr:   upTor,
-				Index: index,
-				Only:  onlyIndex},
-		).Issue()
-	}()
+	op, err := newOperation(JobVlanUnmap)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	switch netType(net) {
+	case NetTypeVlan, NetTypeFlat:
+		err = unbindProvider(op, net, pvms)
+	default:
+		err = unbindVxlan(op, net, pvms)
+	}
+	if err != nil {
+		failOperation(op, err)
+		rw.Header().Set(opIdHeader, op)
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
 
-	rw.Write([]byte("OK"))
+	o, code := finishOperation(rw, r, op)
+	rw.WriteHeader(code)
+	rw.Write([]byte(operationMessage(o)))
 }
 
 func getTopology(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content/Type", "application/json")
 
+	tpMu.RLock()
+	defer tpMu.RUnlock()
 	ret, _ := json.MarshalIndent(
 		struct {
 			Topology       map[string][]*Topology `json:"topology"`
 			TopologySimple map[string][]string    `json:"topology_simple"`
+			Polls          map[string]*PollStatus `json:"polls"`
 		}{
 			Topology:       tp,
-			TopologySimple: ts}, "", "  ")
+			TopologySimple: ts,
+			Polls:          allPolls()}, "", "  ")
 	w.Write(ret)
 }
 
+//requestRefresh asks the poller for a new topology, requests made while one
+//is pending are merged.
+func requestRefresh() {
+	select {
+	case refresh <- true:
+	default:
+	}
+}
+
 func emptyTopology(w http.ResponseWriter, r *http.Request) {
-	refresh <- true
+	requestRefresh()
 	w.Write([]byte("Ready to refresh."))
 }
 
-//init in memory data, eg: tplvCache and initialized data in database
-func InitInmemoryData(inputs []string) {
+//init in memory data, eg: tplvCache and initialized data in database. It
+//registers the inputs and may be called again, pools of known tors are kept.
+func InitInmemoryData(inputs []string) error {
 	for _, input := range inputs {
-		tors = append(tors, input)
-	}
-	for _, tor := range tors {
-		tplv[tor] = &LocalVlan{}
-		tplv[tor].Shared = NewBitmap(uint32(vlanSharedMin), uint32(vlanSharedMax))
-		tplv[tor].Unshared = NewBitmap(uint32(vlanVpcMin), uint32(vlanVpcMax))
+		registerPools(input)
 	}
 
+	loadTorPairs()
+	loadTorconfRoutes()
+
 	everyAlloctions := make([]*SapiVlanAllocations, 0)
 	if err := SelectAllVlanAlloctions(&everyAlloctions); err != nil {
 		Log().Error(fmt.Sprintf("%s", err))
-		os.Exit(0)
+		return err
 	}
+	vlansMu.Lock()
+	defer vlansMu.Unlock()
 	for _, alloction := range everyAlloctions {
-		if alloction.Shared {
-			tplv[alloction.TorIp].Shared.Setbit(uint32(alloction.VlanId))
-			tplvCache[alloction.TorIp+alloction.NetworkId+"-1"] = alloction.VlanId
-		} else {
-			tplv[alloction.TorIp].Unshared.Setbit(uint32(alloction.VlanId))
-			tplvCache[alloction.TorIp+alloction.NetworkId+"-0"] = alloction.VlanId
-		}
+		//fabric and pair scoped vlans are reserved on every tor of the
+		//scope, including tors registered after the allocation was made.
+		reserveVlanId(alloction.TorIp, uint32(alloction.VlanId), alloction.Shared)
+		tplvCache[getId(alloction.TorIp, alloction.NetworkId, alloction.Shared)] = alloction.VlanId
+	}
+	//trunked provider vlans are kept out of the local vlans
+	if err := reserveProviderVlans(); err != nil {
+		Log().Error(fmt.Sprintf("%s", err))
+		return err
 	}
+	return nil
 }
 
-//run periodic updata for topology
+//run periodic updata for topology, the stored topology is served until
+//the first poll cycle is done
 func GoTopology(done chan struct{}) {
-	tp, ts = GetTopology(tors, "public", time.Second*10)
 	go func() {
-		Seconds := time.NewTimer(time.Second * 30)
+		refreshTopology()
+		Seconds := time.NewTimer(pollInterval)
 		for {
 			select {
 			case <-Seconds.C:
-				tp, ts = GetTopology(tors, "public", time.Second*10)
-				Seconds.Reset(time.Second * 30)
+				refreshTopology()
+				Seconds.Reset(pollInterval)
 			case <-refresh:
 				Log().WithFields(logrus.Fields{
 					"Time": time.Now(),
 				}).Info("updateTopology: refresh received")
-				tp, ts = GetTopology(tors, "public", time.Second*10)
+				refreshTopology()
 			case <-done:
 				return
 			}
 		}
 	}()
+}
 
-	go func() {
-		for {
-			select {
-			case <-tunnelSyncDone:
-				//ensure all vxlan associated with all tunnels
-				Log().Info("tunnelSyncDone: receive signal from master, gogo")
-				tors := make([]*SapiTor, 0)
-				if err := SelectAllTors(&tors); err != nil {
-					Log().WithFields(logrus.Fields{
-						"Error": err,
-					}).Info("tunnelSyncDone: SelectAllTors error.")
-					continue
-				}
-				for _, tor := range tors {
-					ids := getTunnelIds(tor.TorIp)
-					vsis := getVsis(tor.TorIp)
-					Log().WithFields(logrus.Fields{
-						"Switch":    tor.TorIp,
-						"Vsis":      vsis,
-						"TunnelIds": ids,
-					}).Info("tunnelSyncDone: sync switch vxlan with tunnels")
-					client := NewHttpAgent()
-					client.Post(torconf + "/ensure").ReqData(
-						struct {
-							Type    string `json:"type"`
-							Mgr     string `json:"mgr"`
-							Vxlans  []int  `json:"vxlans"`
-							Tunnels []int  `json:"tunnels"`
-						}{
-							Type:    tor.Type,
-							Vxlans:  vsis,
-							Mgr:     tor.TorIp,
-							Tunnels: ids},
-					).Issue()
-				}
-			case <-done:
-				return
-			}
+//ensureTors queues a vxlan with tunnels sync for every tor
+func ensureTors(s *xorm.Session, op string) error {
+	//ensure all vxlan associated with all tunnels
+	tors := make([]*SapiTor, 0)
+	if err := SelectAllTors(&tors); err != nil {
+		Log().WithFields(logrus.Fields{
+			"Error": err,
+		}).Info("ensureTors: SelectAllTors error.")
+		return err
+	}
+	for _, tor := range tors {
+		Log().WithFields(logrus.Fields{
+			"Switch": tor.TorIp,
+		}).Info("ensureTors: queue sync switch vxlan with tunnels")
+		//vsis and tunnel ids are filled in when the job runs,
+		//after the tunnels queued before it on this tor.
+		if err := enqueueJob(s, op, tor.TorIp, JobEnsure, struct{}{}); err != nil {
+			return err
 		}
-	}()
+	}
+	return nil
 }
 
 func init() {
@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/codegangsta/negroni"
+	"github.com/wangtaoX/sapi/faketorconf"
 )
 
 var (
@@ -43,7 +44,7 @@ func NewNet(id string, sid int, shared bool, s *SapiProvisionedNets) {
 func init() {
 	var shared bool
 
-	InitDb("sapi", "sapi", "10.216.25.57", "sapi")
+	InitDb("sapi", "sapi", "10.216.25.57", "sapi", make(chan struct{}))
 	Truncate([]string{"sapi_provisioned_nets",
 		"sapi_provisioned_ports",
 		"sapi_port_vlan_mapping",
@@ -52,6 +53,14 @@ func init() {
 		"tor1": []string{"compute1", "compute2"},
 		"tor2": []string{"compute3", "compute4"},
 	}
+	tp = map[string][]*Topology{
+		"tor1": []*Topology{
+			&Topology{TorIp: "tor1", Host: "compute1", Index: "1"},
+			&Topology{TorIp: "tor1", Host: "compute2", Index: "2"}},
+		"tor2": []*Topology{
+			&Topology{TorIp: "tor2", Host: "compute3", Index: "1"},
+			&Topology{TorIp: "tor2", Host: "compute4", Index: "2"}},
+	}
 
 	for i := 1; i <= 4; i++ {
 		if i%2 == 0 {
@@ -69,10 +78,14 @@ func init() {
 		ports[i].insert()
 	}
 
-	InitInmemoryData([]string{"tor1", "tor2"})
+	if err := InitInmemoryData([]string{"tor1", "tor2"}); err != nil {
+		panic(err)
+	}
 	m = negroni.New()
 	Regist(MakeApiEndpoints("POST", lv, http.HandlerFunc(makeLocalvlanMap)))
 	Regist(MakeApiEndpoints("DELETE", lv+"{id}", http.HandlerFunc(deleteLocalvlanMap)))
+	Regist(MakeApiEndpoints("DELETE", torsPath+"{ip}", http.HandlerFunc(deregisterTor)))
+	Regist(MakeApiEndpoints("POST", "/tsync", http.HandlerFunc(registerTor)))
 	m.UseHandler(gRouter)
 }
 
@@ -182,9 +195,202 @@ func TestReAllocateVlan(t *testing.T) {
 	}
 }
 
+func TestFabricSharedVlan(t *testing.T) {
+	var vid, vid2 uint32
+	saved := tplv
+	defer func() { tplv = saved }()
+	tplv = map[string]*LocalVlan{
+		"tor1": &LocalVlan{Shared: NewBitmap(uint32(vlanSharedMin), uint32(vlanSharedMax))},
+		"tor2": &LocalVlan{Shared: NewBitmap(uint32(vlanSharedMin), uint32(vlanSharedMax))},
+	}
+	//a per-tor allocation on tor2 must not be handed out fabric-wide
+	tplv["tor2"].Shared.Setbit(4002)
+
+	if !allocateVlanId(fabricTor, &vid, true) {
+		t.Fatal("Cant allocate fabric shared vlan")
+	}
+	if vid != 4003 {
+		t.Errorf("Expected vlan id %d, but got %d", 4003, vid)
+	}
+	for tor, lv := range tplv {
+		if !lv.Shared.bitOn(vid) {
+			t.Errorf("Expected vlan id %d reserved on %s", vid, tor)
+		}
+	}
+
+	releaseVlanId(fabricTor, vid, true)
+	if tplv["tor1"].Shared.bitOn(vid) || fabricShared.bitOn(vid) {
+		t.Errorf("Expected vlan id %d released", vid)
+	}
+	allocateVlanId(fabricTor, &vid2, true)
+	if vid2 != vid {
+		t.Errorf("Expected vlan id %d, but got %d", vid, vid2)
+	}
+	releaseVlanId(fabricTor, vid2, true)
+}
+
+//runPendingJobs issues queued jobs in order until the outbox is empty
+func runPendingJobs() {
+	for {
+		pending := make([]*SapiConfigJobs, 0)
+		SelectAllPendingJobs(&pending)
+		if len(pending) == 0 {
+			return
+		}
+		for _, job := range pending {
+			job.MaxAttempts = 1
+			runJob(job)
+		}
+	}
+}
+
+func TestLocalvlanConfiguresTor(t *testing.T) {
+	fake := faketorconf.NewServer()
+	defer fake.Close()
+	saved := torconf
+	defer func() { torconf = saved }()
+	SetTorconf(fake.URL)
+	(&SapiTor{TorIp: "tor2", TunnelSrcIp: "2.2.2.2", Type: "h3c"}).insert()
+
+	r, _ := http.NewRequest("POST", "/localvlan/", strings.NewReader(`{"portid":"port7","netid":"network3","host":"compute3"}`))
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, r)
+	resp, err := getresp(recorder)
+	if err != nil {
+		t.Fatalf("resp decode error %s", err)
+	}
+
+	runPendingJobs()
+	if !fake.HasMapping("tor2", 1, resp.Vm.VlanId, 3) {
+		t.Errorf("Expected vlan %d mapped to vxlan %d on tor2", resp.Vm.VlanId, 3)
+	}
+
+	r, _ = http.NewRequest("DELETE", "/localvlan/port7", nil)
+	m.ServeHTTP(httptest.NewRecorder(), r)
+	runPendingJobs()
+	if fake.HasMapping("tor2", 1, resp.Vm.VlanId, 3) {
+		t.Errorf("Expected vlan %d unmapped on tor2", resp.Vm.VlanId)
+	}
+}
+
+func TestDeregisterTor(t *testing.T) {
+	r, _ := http.NewRequest("POST", "/localvlan/", strings.NewReader(`{"portid":"port8","netid":"network3","host":"compute4"}`))
+	m.ServeHTTP(httptest.NewRecorder(), r)
+
+	r, _ = http.NewRequest("DELETE", "/tors/tor2", nil)
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected %d with bound ports, got %d", http.StatusConflict, recorder.Code)
+	}
+
+	r, _ = http.NewRequest("DELETE", "/tors/tor2?force=true", nil)
+	recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %d when forced, got %d", http.StatusOK, recorder.Code)
+	}
+	if _, ok := tplv["tor2"]; ok {
+		t.Error("Expected tor2 vlan pools dropped")
+	}
+	for _, tor := range registeredTors() {
+		if tor == "tor2" {
+			t.Error("Expected tor2 no longer polled")
+		}
+	}
+	if has, _ := new(SapiPortVlanMapping).search("port8"); has {
+		t.Error("Expected port8 binding dropped")
+	}
+}
+
+func TestReRegisterTor(t *testing.T) {
+	body := `{"switch_type":"h3c","mgr":"tor3","tunnel_src":"3.3.3.3"}`
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("POST", "/tsync", strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, r)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Expected %d, got %d", http.StatusOK, recorder.Code)
+		}
+	}
+	jobs, _ := DB().Where("tor_ip=?", "tor3").Count(new(SapiConfigJobs))
+	if jobs != 1 {
+		t.Errorf("Expected 1 job for tor3, got %d", jobs)
+	}
+	registered := 0
+	for _, tor := range registeredTors() {
+		if tor == "tor3" {
+			registered++
+		}
+	}
+	if registered != 1 {
+		t.Errorf("Expected tor3 registered once, got %d", registered)
+	}
+}
+
+func TestReRegisterTorKeepsPair(t *testing.T) {
+	body := `{"switch_type":"h3c","mgr":"tor4","tunnel_src":"4.4.4.4","pair_id":"pair4","pod":"pod4"}`
+	r, _ := http.NewRequest("POST", "/tsync", strings.NewReader(body))
+	m.ServeHTTP(httptest.NewRecorder(), r)
+
+	//pair and pod are left out, the tunnel source changes
+	body = `{"switch_type":"h3c","mgr":"tor4","tunnel_src":"4.4.4.5"}`
+	r, _ = http.NewRequest("POST", "/tsync", strings.NewReader(body))
+	m.ServeHTTP(httptest.NewRecorder(), r)
+
+	tor := new(SapiTor)
+	if has, err := tor.search("tor4"); !has || err != nil {
+		t.Fatalf("Expected tor4 stored, got %v", err)
+	}
+	if tor.PairId != "pair4" || tor.Pod != "pod4" {
+		t.Errorf("Expected pair4/pod4 kept, got %s/%s", tor.PairId, tor.Pod)
+	}
+	if tor.TunnelSrcIp != "4.4.4.5" {
+		t.Errorf("Expected tunnel source 4.4.4.5, got %s", tor.TunnelSrcIp)
+	}
+}
+
+func TestTsyncTunnelsSurviveMesh(t *testing.T) {
+	fake := faketorconf.NewServer()
+	defer fake.Close()
+	saved := torconf
+	defer func() { torconf = saved }()
+	SetTorconf(fake.URL)
+	//a switch outside sapi
+	fake.AddEndpoint("9.9.9.9")
+
+	body := `{"switch_type":"h3c","mgr":"tor5","tunnel_src":"5.5.5.5"}`
+	r, _ := http.NewRequest("POST", "/tsync", strings.NewReader(body))
+	m.ServeHTTP(httptest.NewRecorder(), r)
+	runPendingJobs()
+	if !fake.HasTunnel("tor5", "5.5.5.5", "9.9.9.9") {
+		t.Fatal("Expected tsync to build the tunnel to 9.9.9.9")
+	}
+
+	_, reports, err := reconcileMesh(false)
+	if err != nil {
+		t.Fatalf("reconcile error %s", err)
+	}
+	runPendingJobs()
+	for _, report := range reports {
+		if report.Tor == "tor5" && report.Plan != nil && len(report.Plan.Delete) != 0 {
+			t.Errorf("Expected no tunnel of tor5 deleted, got %v", report.Plan.Delete)
+		}
+	}
+	if !fake.HasTunnel("tor5", "5.5.5.5", "9.9.9.9") {
+		t.Error("Expected the tunnel to 9.9.9.9 kept by the reconciliation")
+	}
+}
+
 func TestClean(t *testing.T) {
 	Truncate([]string{"sapi_provisioned_nets",
 		"sapi_provisioned_ports",
 		"sapi_port_vlan_mapping",
-		"sapi_vlan_allocations"})
+		"sapi_vlan_allocations",
+		"sapi_tor",
+		"sapi_tor_vsis",
+		"sapi_tor_tunnels",
+		"sapi_tunnel_endpoints",
+		"sapi_config_jobs",
+		"sapi_operations"})
 }
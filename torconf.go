@@ -0,0 +1,284 @@
+package sapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+var (
+	//torconf serving tors without a more specific endpoint
+	torconf = "http://10.216.25.51:8081"
+	//pod -> torconf endpoint, see SetTorconfPods
+	torconfPods = make(map[string]string)
+	//tor ip -> torconf endpoint given at registration
+	torconfTors = make(map[string]string)
+	//tor ip -> pod
+	torPods = make(map[string]string)
+	//guards the endpoint maps, tors are reloaded while jobs run
+	torconfMu gosync.RWMutex
+
+	ErrorTorconfPods = errors.New("Bad torconf pod mapping, want pod=url[,pod=url]")
+)
+
+//SetTorconf sets the default torconf endpoint.
+func SetTorconf(url string) {
+	torconf = strings.TrimSuffix(url, "/")
+}
+
+//SetTorconfPods maps pods to their own torconf, spec is a comma separated
+//list of pod=url pairs.
+func SetTorconfPods(spec string) error {
+	pods := make(map[string]string)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return ErrorTorconfPods
+		}
+		pods[kv[0]] = strings.TrimSuffix(kv[1], "/")
+	}
+	torconfMu.Lock()
+	torconfPods = pods
+	torconfMu.Unlock()
+	return nil
+}
+
+func loadTorconfRoutes() {
+	sapiTors := make([]*SapiTor, 0)
+	if err := SelectAllTors(&sapiTors); err != nil {
+		Log().Error(fmt.Sprintf("loadTorconfRoutes: %s", err))
+		return
+	}
+	tors := make(map[string]string)
+	pods := make(map[string]string)
+	for _, tor := range sapiTors {
+		if tor.Torconf != "" {
+			tors[tor.TorIp] = strings.TrimSuffix(tor.Torconf, "/")
+		}
+		if tor.Pod != "" {
+			pods[tor.TorIp] = tor.Pod
+		}
+	}
+	torconfMu.Lock()
+	torconfTors, torPods = tors, pods
+	torconfMu.Unlock()
+}
+
+//torconfFor returns the torconf endpoint of a tor, an endpoint given at
+//registration wins over the pod endpoint, which wins over the default.
+func torconfFor(tor string) string {
+	torconfMu.RLock()
+	defer torconfMu.RUnlock()
+	if url, ok := torconfTors[tor]; ok {
+		return url
+	}
+	if url, ok := torconfPods[torPods[tor]]; ok {
+		return url
+	}
+	return torconf
+}
+
+//torconfDriver configures switches through the torconf service of their pod
+type torconfDriver struct{}
+
+//torconf request bodies
+type tunnelReq struct {
+	Type string `json:"type"`
+	Mgr  string `json:"mgr"`
+	Src  string `json:"src"`
+	Dst  string `json:"dst"`
+}
+
+type tunnelDelReq struct {
+	Type     string `json:"type"`
+	Mgr      string `json:"mgr"`
+	TunnelId int    `json:"tunnel_id"`
+}
+
+type tsyncReq struct {
+	Src        string `json:"src"`
+	TunnelType string `json:"tunnel_type"`
+}
+
+type ensureReq struct {
+	Type    string `json:"type"`
+	Mgr     string `json:"mgr"`
+	Vxlans  []int  `json:"vxlans"`
+	Tunnels []int  `json:"tunnels"`
+}
+
+type vlanMapReq struct {
+	Type      string `json:"type"`
+	Vlan      int    `json:"vlan"`
+	Vxlan     int    `json:"vxlan"`
+	TunnelIds []int  `json:"tunnel_ids"`
+	Mgr       string `json:"mgr"`
+	Index     int    `json:"index"`
+}
+
+type vlanUnmapReq struct {
+	Type  string `json:"type"`
+	Vlan  int    `json:"vlan"`
+	Vxlan int    `json:"vxlan"`
+	Mgr   string `json:"mgr"`
+	Index int    `json:"index"`
+	Only  bool   `json:"delete_on_index"`
+}
+
+type trunkReq struct {
+	Type     string `json:"type"`
+	Vlan     int    `json:"vlan"`
+	Mgr      string `json:"mgr"`
+	Index    int    `json:"index"`
+	Untagged bool   `json:"untagged"`
+}
+
+//issue sends a request to the torconf of tor, non 2xx answers are errors.
+func (d *torconfDriver) issue(tor *SapiTor, method, path string, data interface{}) (string, error) {
+	client := NewHttpAgent().Timeout(time.Second * 30)
+	target := torconfFor(tor.TorIp) + path
+	switch method {
+	case POST:
+		client.Post(target)
+	case DELETE:
+		client.Delete(target)
+	default:
+		client.Get(target)
+	}
+	resp, body, err := client.ReqData(data).Issue()
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode/100 != 2 {
+		return body, fmt.Errorf("torconf %s %s: %s %s", method, path, resp.Status, body)
+	}
+	return body, nil
+}
+
+func (d *torconfDriver) TunnelEndpoints(tor *SapiTor) ([]string, error) {
+	var resp struct {
+		Tunnels []struct {
+			Ip string `json:"ip_address"`
+		} `json:"tunnels"`
+	}
+	body, err := d.issue(tor, POST, "/tsync", tsyncReq{
+		Src:        tor.TunnelSrcIp,
+		TunnelType: "vxlan"})
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	for _, tunnel := range resp.Tunnels {
+		ips = append(ips, tunnel.Ip)
+	}
+	return ips, nil
+}
+
+func (d *torconfDriver) CreateTunnel(tor *SapiTor, src, dst string) (int, error) {
+	var resp struct {
+		TunnelId int `json:"tunnel_id"`
+	}
+	body, err := d.issue(tor, POST, "/tunnel", tunnelReq{
+		Type: tor.Type,
+		Mgr:  tor.TorIp,
+		Src:  src,
+		Dst:  dst})
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		return 0, err
+	}
+	if resp.TunnelId == 0 {
+		return 0, fmt.Errorf("torconf /tunnel: no tunnel id in %q", body)
+	}
+	return resp.TunnelId, nil
+}
+
+func (d *torconfDriver) DeleteTunnel(tor *SapiTor, id int) error {
+	_, err := d.issue(tor, DELETE, "/tunnel", tunnelDelReq{
+		Type:     tor.Type,
+		Mgr:      tor.TorIp,
+		TunnelId: id})
+	return err
+}
+
+func (d *torconfDriver) EnsureVsi(tor *SapiTor, vxlans, tunnels []int) error {
+	_, err := d.issue(tor, POST, "/ensure", ensureReq{
+		Type:    tor.Type,
+		Mgr:     tor.TorIp,
+		Vxlans:  vxlans,
+		Tunnels: tunnels})
+	return err
+}
+
+func (d *torconfDriver) MapVlan(tor *SapiTor, m VlanMap) error {
+	_, err := d.issue(tor, POST, "/vlan2vxlan", vlanMapReq{
+		Type:      tor.Type,
+		Vlan:      m.Vlan,
+		Vxlan:     m.Vxlan,
+		TunnelIds: m.TunnelIds,
+		Mgr:       tor.TorIp,
+		Index:     m.Index})
+	return err
+}
+
+func (d *torconfDriver) UnmapVlan(tor *SapiTor, m VlanMap, onlyIndex bool) error {
+	_, err := d.issue(tor, DELETE, "/vlan2vxlan", vlanUnmapReq{
+		Type:  tor.Type,
+		Vlan:  m.Vlan,
+		Vxlan: m.Vxlan,
+		Mgr:   tor.TorIp,
+		Index: m.Index,
+		Only:  onlyIndex})
+	return err
+}
+
+func (d *torconfDriver) Trunk(tor *SapiTor, t Trunk) error {
+	_, err := d.issue(tor, POST, "/trunk", trunkReq{
+		Type:     tor.Type,
+		Vlan:     t.Vlan,
+		Mgr:      tor.TorIp,
+		Index:    t.Index,
+		Untagged: t.Untagged})
+	return err
+}
+
+func (d *torconfDriver) Untrunk(tor *SapiTor, t Trunk) error {
+	_, err := d.issue(tor, DELETE, "/trunk", trunkReq{
+		Type:     tor.Type,
+		Vlan:     t.Vlan,
+		Mgr:      tor.TorIp,
+		Index:    t.Index,
+		Untagged: t.Untagged})
+	return err
+}
+
+func (d *torconfDriver) ReadConfig(tor *SapiTor) (*SwitchConfig, error) {
+	conf := new(SwitchConfig)
+	q := url.Values{"type": {tor.Type}, "mgr": {tor.TorIp}}
+	body, err := d.issue(tor, GET, "/config?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(body), conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func init() {
+	//torconf takes every switch type, as it did before drivers
+	RegisterDefaultDriver(new(torconfDriver))
+}
@@ -0,0 +1,148 @@
+package sapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wangtaoX/sapi/faketorconf"
+)
+
+func TestSetTorconfPods(t *testing.T) {
+	defer SetTorconfPods("")
+	if err := SetTorconfPods("pod1=http://10.0.0.1:8081/, pod2=http://10.0.0.2:8081"); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if torconfPods["pod1"] != "http://10.0.0.1:8081" || torconfPods["pod2"] != "http://10.0.0.2:8081" {
+		t.Errorf("Unexpected pod mapping %v", torconfPods)
+	}
+	for _, spec := range []string{"pod1", "=http://10.0.0.1:8081", "pod1="} {
+		if err := SetTorconfPods(spec); err != ErrorTorconfPods {
+			t.Errorf("Expected error %s for %q, got %v", ErrorTorconfPods, spec, err)
+		}
+	}
+}
+
+func TestTorconfFor(t *testing.T) {
+	savedDefault, savedTors, savedPods := torconf, torconfTors, torPods
+	defer func() {
+		torconf, torconfTors, torPods = savedDefault, savedTors, savedPods
+		SetTorconfPods("")
+	}()
+	SetTorconf("http://default:8081/")
+	SetTorconfPods("pod1=http://pod1:8081")
+	torconfTors = map[string]string{"tor1": "http://tor1:8081"}
+	torPods = map[string]string{"tor1": "pod1", "tor2": "pod1", "tor3": "pod9"}
+
+	cases := map[string]string{
+		"tor1": "http://tor1:8081",
+		"tor2": "http://pod1:8081",
+		"tor3": "http://default:8081",
+		"tor4": "http://default:8081",
+	}
+	for tor, expected := range cases {
+		if got := torconfFor(tor); got != expected {
+			t.Errorf("Expected torconf %s for %s, got %s", expected, tor, got)
+		}
+	}
+}
+
+func TestTorconfDriver(t *testing.T) {
+	var got vlanMapReq
+	tserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tunnel":
+			w.Write([]byte(`{"tunnel_id": 7}`))
+		case "/vlan2vxlan":
+			json.NewDecoder(r.Body).Decode(&got)
+		default:
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}
+	}))
+	defer tserver.Close()
+	saved := torconf
+	defer func() { torconf = saved }()
+	SetTorconf(tserver.URL)
+
+	tor := &SapiTor{TorIp: "tor9", TunnelSrcIp: "1.1.1.1", Type: "huawei"}
+	d := new(torconfDriver)
+	id, err := d.CreateTunnel(tor, "1.1.1.1", "2.2.2.2")
+	if err != nil || id != 7 {
+		t.Errorf("Expected tunnel id %d, got %d (%v)", 7, id, err)
+	}
+	if err := d.MapVlan(tor, VlanMap{Vlan: 2, Vxlan: 100, Index: 3, TunnelIds: []int{7}}); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if got.Type != "huawei" || got.Mgr != "tor9" || got.Vlan != 2 || got.Vxlan != 100 || got.Index != 3 {
+		t.Errorf("Unexpected /vlan2vxlan request %+v", got)
+	}
+	if err := d.EnsureVsi(tor, []int{100}, []int{7}); err == nil {
+		t.Error("Expected error on status 500")
+	}
+}
+
+func TestDriverFor(t *testing.T) {
+	for _, kind := range []string{"h3c", "huawei"} {
+		if d, err := driverFor(&SapiTor{Type: kind}); err != nil || d == nil {
+			t.Errorf("Expected %s configured through torconf, got %v", kind, err)
+		} else if _, ok := d.(*torconfDriver); !ok {
+			t.Errorf("Expected the torconf driver for %s, got %T", kind, d)
+		}
+	}
+	RegisterNetconfStub()
+	if d, err := driverFor(&SapiTor{Type: NetconfStubType}); err != nil || d == nil {
+		t.Errorf("Expected netconf driver, got %v", err)
+	} else if _, ok := d.(*torconfDriver); ok {
+		t.Error("Expected netconf tors not sent to torconf")
+	}
+
+	saved := defaultDriver
+	defer RegisterDefaultDriver(saved)
+	RegisterDefaultDriver(nil)
+	if _, err := driverFor(&SapiTor{Type: "nosuch"}); err == nil {
+		t.Error("Expected error for unknown switch type")
+	}
+	if hasDriver("nosuch") {
+		t.Error("Expected no driver for unknown switch type")
+	}
+}
+
+func TestTorconfDriverFake(t *testing.T) {
+	fake := faketorconf.NewServer()
+	defer fake.Close()
+	saved := torconf
+	defer func() { torconf = saved }()
+	SetTorconf(fake.URL)
+	fake.AddEndpoint("2.2.2.2")
+
+	tor := &SapiTor{TorIp: "tor1", TunnelSrcIp: "1.1.1.1", Type: "h3c"}
+	d := new(torconfDriver)
+	endpoints, err := d.TunnelEndpoints(tor)
+	if err != nil || len(endpoints) != 2 {
+		t.Fatalf("Expected %d endpoints, got %v (%v)", 2, endpoints, err)
+	}
+	id, _ := d.CreateTunnel(tor, "1.1.1.1", "2.2.2.2")
+	d.MapVlan(tor, VlanMap{Vlan: 2, Vxlan: 100, Index: 3, TunnelIds: []int{id}})
+	d.Trunk(tor, Trunk{Vlan: 200, Index: 4})
+	if !fake.HasTunnel("tor1", "1.1.1.1", "2.2.2.2") || !fake.HasMapping("tor1", 3, 2, 100) || !fake.HasVsi("tor1", 100, id) {
+		t.Error("Expected tunnel, mapping and vsi configured on tor1")
+	}
+
+	conf, err := d.ReadConfig(tor)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if len(conf.Tunnels) != 1 || conf.Tunnels[0].Dst != "2.2.2.2" || len(conf.Vsis) != 1 ||
+		len(conf.Mappings) != 1 || len(conf.Trunks) != 1 || conf.Trunks[0].Vlan != 200 {
+		t.Errorf("Unexpected config read back %+v", conf)
+	}
+
+	fake.FailNext("/vlan2vxlan", 1, http.StatusInternalServerError)
+	if err := d.UnmapVlan(tor, VlanMap{Vlan: 2, Vxlan: 100, Index: 3}, false); err == nil {
+		t.Error("Expected injected failure")
+	}
+	if err := d.UnmapVlan(tor, VlanMap{Vlan: 2, Vxlan: 100, Index: 3}, false); err != nil || fake.HasMapping("tor1", 3, 2, 100) {
+		t.Errorf("Expected mapping removed, got %v", err)
+	}
+}
@@ -0,0 +1,547 @@
+package sapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-xorm/xorm"
+	"github.com/gorilla/mux"
+)
+
+const (
+	//operation kind of a tor deregistration
+	OpDeregister = "deregister"
+	//operation kind of a tor type or tunnel source change
+	OpRetunnel = "retunnel"
+)
+
+var (
+	torsPath = "/tors/"
+
+	ErrorTorInUse = errors.New("Tor has bound ports")
+)
+
+//VlanPoolUsage tells how many vlans of a pool are taken
+type VlanPoolUsage struct {
+	Min  int `json:"min"`
+	Max  int `json:"max"`
+	Used int `json:"used"`
+}
+
+func poolUsage(b *BitMap) *VlanPoolUsage {
+	if b == nil {
+		return nil
+	}
+	return &VlanPoolUsage{Min: int(b.Min), Max: int(b.Max), Used: b.Used()}
+}
+
+//TorInventory is what sapi knows about a registered tor
+type TorInventory struct {
+	TorIp       string            `json:"tor"`
+	Type        string            `json:"switch_type"`
+	TunnelSrcIp string            `json:"tunnel_src"`
+	PairId      string            `json:"pair_id,omitempty"`
+	Pod         string            `json:"pod,omitempty"`
+	Torconf     string            `json:"torconf,omitempty"`
+	Tunnels     []Tunnel          `json:"tunnels"`
+	Vsis        []int             `json:"vsis"`
+	Shared      *VlanPoolUsage    `json:"shared_vlans"`
+	Unshared    *VlanPoolUsage    `json:"unshared_vlans"`
+	Hosts       []*Topology       `json:"hosts"`
+	LastPoll    *PollStatus       `json:"last_poll"`
+	PendingJobs []*SapiConfigJobs `json:"pending_jobs"`
+}
+
+func torInventory(tor *SapiTor) (*TorInventory, error) {
+	inv := &TorInventory{
+		TorIp:       tor.TorIp,
+		Type:        tor.Type,
+		TunnelSrcIp: tor.TunnelSrcIp,
+		PairId:      tor.PairId,
+		Pod:         tor.Pod,
+		Torconf:     tor.Torconf,
+		Tunnels:     []Tunnel{},
+		Vsis:        getVsis(tor.TorIp),
+		Hosts:       []*Topology{},
+		LastPoll:    lastPoll(tor.TorIp),
+		PendingJobs: make([]*SapiConfigJobs, 0),
+	}
+
+	tunnels := make([]*SapiTorTunnels, 0)
+	if err := SelectAllTunnelByTor(tor.TorIp, &tunnels); err != nil {
+		return nil, err
+	}
+	for _, tunnel := range tunnels {
+		inv.Tunnels = append(inv.Tunnels, Tunnel{Id: tunnel.TunnelId, Src: tor.TunnelSrcIp, Dst: tunnel.DstAddr})
+	}
+	if lv, ok := torPools(tor.TorIp); ok {
+		inv.Shared = poolUsage(lv.Shared)
+		inv.Unshared = poolUsage(lv.Unshared)
+	}
+	if hosts := torHosts(tor.TorIp); hosts != nil {
+		inv.Hosts = hosts
+	}
+	err := DB().Where("tor_ip=?", tor.TorIp).In("state", []string{JobPending, JobRunning}).
+		Asc("id").Find(&inv.PendingJobs)
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+func writeJson(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content/Type", "application/json")
+	ret, _ := json.MarshalIndent(v, "", "    ")
+	rw.Write(ret)
+}
+
+func listTors(rw http.ResponseWriter, r *http.Request) {
+	sapiTors := make([]*SapiTor, 0)
+	if err := SelectAllTors(&sapiTors); err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	every := []*TorInventory{}
+	for _, tor := range sapiTors {
+		inv, err := torInventory(tor)
+		if err != nil {
+			HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+			return
+		}
+		every = append(every, inv)
+	}
+	writeJson(rw, struct {
+		Tors []*TorInventory `json:"tors"`
+	}{
+		Tors: every,
+	})
+}
+
+func showTor(rw http.ResponseWriter, r *http.Request) {
+	tor := new(SapiTor)
+	has, err := tor.search(mux.Vars(r)["ip"])
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if !has {
+		HttpError(rw, "Not Found", nil, http.StatusNotFound)
+		return
+	}
+	inv, err := torInventory(tor)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	writeJson(rw, inv)
+}
+
+//goRetunnel rebuilds the tunnels a tunnel source change of tor affects, old
+//is the tor as registered before the change. The tunnels of the tor are
+//rebuilt from the new source and peers are pointed to it.
+func goRetunnel(s *xorm.Session, op string, old, tor *SapiTor) error {
+	sapiTors := make([]*SapiTor, 0)
+	if err := SelectAllTors(&sapiTors); err != nil {
+		return err
+	}
+	tunnels := make([]*SapiTorTunnels, 0)
+	if err := SelectAllTunnelByTor(tor.TorIp, &tunnels); err != nil {
+		return err
+	}
+	for _, tunnel := range tunnels {
+		err := enqueueJob(s, op, tor.TorIp, JobTunnelDelete, Tunnel{
+			Id:  tunnel.TunnelId,
+			Src: old.TunnelSrcIp,
+			Dst: tunnel.DstAddr})
+		if err != nil {
+			return err
+		}
+	}
+	if err := goTunnelDelete(s, op, old); err != nil {
+		return err
+	}
+
+	others := []*SapiTor{}
+	for _, peer := range sapiTors {
+		if peer.TorIp != tor.TorIp {
+			others = append(others, peer)
+		}
+	}
+	expected, err := meshOf(tor, others)
+	if err != nil {
+		return err
+	}
+	for _, dst := range expected {
+		if err := goTunnelSync(s, op, tor.TorIp, tor.TunnelSrcIp, dst); err != nil {
+			return err
+		}
+	}
+	for _, peer := range others {
+		if peer.TunnelSrcIp == "" || peer.TunnelSrcIp == tor.TunnelSrcIp {
+			continue
+		}
+		//tunnel creation reuses a tunnel the peer already has to the source
+		if err := goTunnelSync(s, op, peer.TorIp, peer.TunnelSrcIp, tor.TunnelSrcIp); err != nil {
+			return err
+		}
+	}
+	return ensureTors(s, op)
+}
+
+//goReattach rebuilds the tunnels of a tor through the driver of its new
+//type, tunnel creation reuses what is already on the switch.
+func goReattach(s *xorm.Session, op string, tor *SapiTor) error {
+	sapiTors := make([]*SapiTor, 0)
+	if err := SelectAllTors(&sapiTors); err != nil {
+		return err
+	}
+	expected, err := meshOf(tor, sapiTors)
+	if err != nil {
+		return err
+	}
+	for _, dst := range expected {
+		if err := goTunnelSync(s, op, tor.TorIp, tor.TunnelSrcIp, dst); err != nil {
+			return err
+		}
+	}
+	return enqueueJob(s, op, tor.TorIp, JobEnsure, struct{}{})
+}
+
+//updateTor changes the switch type or tunnel source of a tor.
+func updateTor(rw http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Type string `json:"switch_type"`
+		Src  string `json:"tunnel_src"`
+	}
+
+	old := new(SapiTor)
+	has, err := old.search(mux.Vars(r)["ip"])
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if !has {
+		HttpError(rw, "Not Found", nil, http.StatusNotFound)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		HttpError(rw, "Bad Request", nil, http.StatusBadRequest)
+		return
+	}
+	if data.Type != "" && !hasDriver(data.Type) {
+		HttpError(rw, "Unknown switch type", nil, http.StatusBadRequest)
+		return
+	}
+
+	tor := *old
+	if data.Type != "" {
+		tor.Type = data.Type
+	}
+	if data.Src != "" {
+		tor.TunnelSrcIp = data.Src
+	}
+	op, err := changeTor(old, &tor)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if op == "" {
+		rw.Write([]byte("OK"))
+		return
+	}
+	o, code := finishOperation(rw, r, op)
+	rw.WriteHeader(code)
+	rw.Write([]byte(operationMessage(o)))
+}
+
+//changeTor stores tor over old and queues the switch rework the change
+//implies. It returns the operation of the rework, none if the switches
+//need no change. A pair change of a tor with bound ports is refused with
+//ErrorTorInUse.
+func changeTor(old, tor *SapiTor) (string, error) {
+	if *tor == *old {
+		return "", nil
+	}
+	//vlans of a tor are allocated in the scope of its pair, a tor must be
+	//unbound before it changes pair
+	if tor.PairId != old.PairId {
+		bound, err := DB().Where("tor_ip=?", tor.TorIp).Count(new(SapiPortVlanMapping))
+		if err != nil {
+			return "", err
+		}
+		allocated, err := DB().Where("tor_ip=?", tor.TorIp).Count(new(SapiVlanAllocations))
+		if err != nil {
+			return "", err
+		}
+		if bound > 0 || allocated > 0 {
+			return "", ErrorTorInUse
+		}
+	}
+	//the tor is stored with the rework it implies, jobs run with the tor as
+	//stored so old tunnels are removed through the new driver
+	var op string
+	retunnel := tor.Type != old.Type || tor.TunnelSrcIp != old.TunnelSrcIp
+	if retunnel {
+		var err error
+		if op, err = newOperation(OpRetunnel); err != nil {
+			return "", err
+		}
+	}
+	err := queueJobs(func(s *xorm.Session) error {
+		if _, err := s.Id(tor.TorIp).Cols("type", "tunnel_src_ip", "pair_id", "pod", "torconf").Update(tor); err != nil {
+			return err
+		}
+		switch {
+		case !retunnel:
+			return nil
+		case tor.TunnelSrcIp != old.TunnelSrcIp:
+			return goRetunnel(s, op, old, tor)
+		default:
+			return goReattach(s, op, tor)
+		}
+	})
+	if err != nil {
+		if op != "" {
+			failOperation(op, err)
+		}
+		return "", err
+	}
+	Log().WithFields(logrus.Fields{
+		"Tor":       tor.TorIp,
+		"Type":      tor.Type,
+		"TunnelSrc": tor.TunnelSrcIp,
+		"Pair":      tor.PairId,
+		"Pod":       tor.Pod,
+	}).Info("changeTor: tor changed")
+	loadTorPairs()
+	loadTorconfRoutes()
+	return op, nil
+}
+
+//forgetTor drops the in memory state of a tor, it is no longer polled nor
+//offered for vlan allocation.
+func forgetTor(ip string, allocations []*SapiVlanAllocations) {
+	unregisterPools(ip)
+	vlansMu.Lock()
+	for _, alloction := range allocations {
+		delete(tplvCache, getId(alloction.TorIp, alloction.NetworkId, alloction.Shared))
+	}
+	vlansMu.Unlock()
+	providerMu.Lock()
+	for key := range providerVlans {
+		if strings.HasPrefix(key, ip+"/") {
+			delete(providerVlans, key)
+		}
+	}
+	providerMu.Unlock()
+	loadTorPairs()
+	loadTorconfRoutes()
+}
+
+//goTunnelDelete removes the tunnels of peers ending at the tunnel source of
+//a deregistered tor. A source still used by another tor, eg. the shared
+//source of a mlag pair, is kept.
+func goTunnelDelete(s *xorm.Session, op string, gone *SapiTor) error {
+	sapiTors := make([]*SapiTor, 0)
+	if err := SelectAllTors(&sapiTors); err != nil {
+		return err
+	}
+	for _, tor := range sapiTors {
+		if tor.TorIp != gone.TorIp && tor.TunnelSrcIp == gone.TunnelSrcIp {
+			return nil
+		}
+	}
+	for _, tor := range sapiTors {
+		if tor.TorIp == gone.TorIp {
+			continue
+		}
+		tunnels := make([]*SapiTorTunnels, 0)
+		if err := SelectAllTunnelByTor(tor.TorIp, &tunnels); err != nil {
+			return err
+		}
+		for _, tunnel := range tunnels {
+			if tunnel.DstAddr != gone.TunnelSrcIp {
+				continue
+			}
+			Log().WithFields(logrus.Fields{
+				"Switch":     tor.TorIp,
+				"Destnation": tunnel.DstAddr,
+				"TunnelId":   tunnel.TunnelId,
+			}).Info("deregisterTor: queue vxlan tunnel removal")
+			err := enqueueJob(s, op, tor.TorIp, JobTunnelDelete, Tunnel{
+				Id:  tunnel.TunnelId,
+				Src: tor.TunnelSrcIp,
+				Dst: tunnel.DstAddr})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//dropTor deletes everything sapi recorded for the tor in the transaction
+//s, allocations of a pair or the fabric stay with the remaining tors while
+//they have ports. It returns the allocations of the tor and the orphaned
+//ones of its scopes, their vlans are released once s is committed.
+func dropTor(s *xorm.Session, ip string) ([]*SapiVlanAllocations, []*SapiVlanAllocations, error) {
+	allocations := make([]*SapiVlanAllocations, 0)
+	if err := s.Where("tor_ip=?", ip).Find(&allocations); err != nil {
+		return nil, nil, err
+	}
+	pvms := make([]*SapiPortVlanMapping, 0)
+	if err := s.Where("tor_ip=?", ip).Find(&pvms); err != nil {
+		return nil, nil, err
+	}
+	for _, bean := range []interface{}{
+		new(SapiVlanAllocations),
+		new(SapiPortVlanMapping),
+		new(SapiTorTunnels),
+		new(SapiTorVsis),
+		new(SapiTorSnmp),
+		new(SapiTunnelEndpoints),
+	} {
+		if _, err := s.Where("tor_ip=?", ip).Delete(bean); err != nil {
+			return nil, nil, err
+		}
+	}
+	//jobs of the tor can never run again
+	dead := &SapiConfigJobs{State: JobDead, LastError: "tor deregistered"}
+	if _, err := s.Where("tor_ip=? AND state=?", ip, JobPending).Cols("state", "last_error").Update(dead); err != nil {
+		return nil, nil, err
+	}
+	if _, err := s.Delete(&SapiTor{TorIp: ip}); err != nil {
+		return nil, nil, err
+	}
+	orphans, err := releaseOrphans(s, ip, pvms)
+	if err != nil {
+		return nil, nil, err
+	}
+	return allocations, orphans, nil
+}
+
+//releaseOrphans deletes the pair or fabric scoped local vlans whose last
+//ports were bound through a dropped tor. It returns the deleted ones.
+func releaseOrphans(s *xorm.Session, ip string, pvms []*SapiPortVlanMapping) ([]*SapiVlanAllocations, error) {
+	released := make([]*SapiVlanAllocations, 0)
+	seen := make(map[string]bool)
+	for _, pvm := range pvms {
+		if seen[pvm.NetworkId] {
+			continue
+		}
+		seen[pvm.NetworkId] = true
+		net := new(SapiProvisionedNets)
+		has, err := net.search(pvm.NetworkId)
+		if err != nil {
+			return nil, err
+		}
+		if !has || netType(net) != NetTypeVxlan {
+			continue
+		}
+		scope := allocationTor(ip, net.Shared)
+		if scope == ip {
+			continue
+		}
+		left, err := pvm.countByTors(s, scopeTors(scope))
+		if err != nil {
+			return nil, err
+		}
+		if left > 0 {
+			continue
+		}
+		sva := &SapiVlanAllocations{NetworkId: net.NetworkId, TorIp: scope, Shared: net.Shared}
+		has, err = s.Get(sva)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			continue
+		}
+		if _, err := s.Delete(sva); err != nil {
+			return nil, err
+		}
+		Log().WithFields(logrus.Fields{
+			"Tor":     ip,
+			"Scope":   scope,
+			"Network": net.NetworkId,
+			"Vlan":    sva.VlanId,
+		}).Info("dropTor: release SapiVlanAllocations.")
+		released = append(released, sva)
+	}
+	return released, nil
+}
+
+//deregisterTor decommissions a tor, ?force=true drops its bound ports too.
+func deregisterTor(rw http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+
+	tor := new(SapiTor)
+	has, err := tor.search(ip)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if !has {
+		HttpError(rw, "Not Found", nil, http.StatusNotFound)
+		return
+	}
+	bound, err := DB().Where("tor_ip=?", ip).Count(new(SapiPortVlanMapping))
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	if bound > 0 && !force {
+		HttpError(rw, fmt.Sprintf("Tor has %d bound ports", bound), ErrorTorInUse, http.StatusConflict)
+		return
+	}
+
+	op, err := newOperation(OpDeregister)
+	if err != nil {
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	//the tor goes with the jobs removing its tunnels or not at all
+	var allocations, orphans []*SapiVlanAllocations
+	if err := queueJobs(func(s *xorm.Session) error {
+		if err := goTunnelDelete(s, op, tor); err != nil {
+			return err
+		}
+		allocations, orphans, err = dropTor(s, ip)
+		return err
+	}); err != nil {
+		failOperation(op, err)
+		HttpError(rw, "Database Error", err, http.StatusInternalServerError)
+		return
+	}
+	vlansMu.Lock()
+	for _, sva := range orphans {
+		releaseVlanId(sva.TorIp, uint32(sva.VlanId), sva.Shared)
+	}
+	vlansMu.Unlock()
+	allocations = append(allocations, orphans...)
+	Log().WithFields(logrus.Fields{
+		"Tor":         ip,
+		"BoundPorts":  bound,
+		"Allocations": len(allocations),
+	}).Info("deregisterTor: tor removed")
+
+	forgetTor(ip, allocations)
+	requestRefresh()
+
+	o, code := finishOperation(rw, r, op)
+	rw.WriteHeader(code)
+	rw.Write([]byte(operationMessage(o)))
+}
+
+func init() {
+	Regist(MakeApiEndpoints("GET", "/tors", http.HandlerFunc(listTors)))
+	Regist(MakeApiEndpoints("GET", torsPath+"{ip}", http.HandlerFunc(showTor)))
+	Regist(MakeApiEndpoints("PUT", torsPath+"{ip}", http.HandlerFunc(updateTor)))
+	Regist(MakeApiEndpoints("DELETE", torsPath+"{ip}", http.HandlerFunc(deregisterTor)))
+}
@@ -0,0 +1,56 @@
+package sapi
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	saved := tplv
+	defer func() { tplv = saved }()
+	tplv = make(map[string]*LocalVlan)
+
+	if !registerPools("tor2") || !registerPools("tor1") {
+		t.Fatal("Expected new tors registered")
+	}
+	lv, _ := torPools("tor1")
+	lv.Unshared.Setbit(10)
+	//registering again keeps the allocations
+	if registerPools("tor1") {
+		t.Error("Unexpected second registration of tor1")
+	}
+	if lv, _ := torPools("tor1"); !lv.Unshared.bitOn(10) {
+		t.Error("Expected vlan 10 still allocated on tor1")
+	}
+	if got := registeredTors(); !reflect.DeepEqual(got, []string{"tor1", "tor2"}) {
+		t.Errorf("Expected [tor1 tor2], got %v", got)
+	}
+	unregisterPools("tor2")
+	if got := registeredTors(); !reflect.DeepEqual(got, []string{"tor1"}) {
+		t.Errorf("Expected [tor1], got %v", got)
+	}
+}
+
+func TestPoolUsage(t *testing.T) {
+	if poolUsage(nil) != nil {
+		t.Error("Expected no usage without a pool")
+	}
+	b := NewBitmap(uint32(vlanVpcMin), uint32(vlanVpcMax))
+	b.Setbit(10)
+	usage := poolUsage(b)
+	if usage.Used != 1 || usage.Min != vlanVpcMin || usage.Max != vlanVpcMax {
+		t.Errorf("Expected 1 of %d-%d used, got %+v", vlanVpcMin, vlanVpcMax, usage)
+	}
+}
+
+func TestRecordPoll(t *testing.T) {
+	recordPoll("tor9", errors.New("timeout"))
+	if p := lastPoll("tor9"); p == nil || p.Error != "timeout" {
+		t.Errorf("Expected failed poll of tor9, got %+v", p)
+	}
+	recordPoll("tor9", nil)
+	if p := lastPoll("tor9"); p == nil || p.Error != "" {
+		t.Errorf("Expected successful poll of tor9, got %+v", p)
+	}
+}
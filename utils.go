@@ -32,6 +32,17 @@ func (b *BitMap) GetUnusedBit(value *uint32) bool {
 	return false
 }
 
+//Used counts the bits set
+func (b *BitMap) Used() int {
+	used := 0
+	for i := b.Min; i <= b.Max; i++ {
+		if b.bitOn(i) {
+			used++
+		}
+	}
+	return used
+}
+
 func (b *BitMap) UnsetBit(bit uint32) error {
 	if bit > b.Max || bit < b.Min {
 		return ErrorOutOfRange
@@ -46,3 +46,13 @@ func TestGetSet(t *testing.T) {
 		t.Errorf("Expected value %d, but got %d", 453, value)
 	}
 }
+
+func TestUsed(t *testing.T) {
+	bitmap := NewBitmap(2, 4000)
+	bitmap.Setbit(2)
+	bitmap.Setbit(100)
+	bitmap.Setbit(4000)
+	if used := bitmap.Used(); used != 3 {
+		t.Errorf("Expected %d bits used, got %d", 3, used)
+	}
+}
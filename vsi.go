@@ -0,0 +1,118 @@
+package sapi
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-xorm/xorm"
+)
+
+type vsiKey struct {
+	tor   string
+	vxlan int
+}
+
+//acquireVsi takes a reference on the vsi of vxlan on a tor in the
+//transaction of s, the vsi is created by the first reference. It reports
+//whether the vsi is new.
+func acquireVsi(s *xorm.Session, tor string, vxlan int) (bool, error) {
+	for i := 0; i < 2; i++ {
+		affected, err := s.Where("tor_ip=? AND vxlan=?", tor, vxlan).Incr("refs").Update(new(SapiTorVsis))
+		if err != nil {
+			return false, err
+		}
+		if affected > 0 {
+			return false, nil
+		}
+		//lost against a concurrent first reference, take ours on the row
+		if _, err := s.Insert(&SapiTorVsis{TorIp: tor, Vxlan: vxlan, Refs: 1}); err == nil {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("vsi %d on %s: no reference taken", vxlan, tor)
+}
+
+//releaseVsi drops a reference on the vsi of vxlan on a tor in the
+//transaction of s, the vsi is removed with the last reference. It reports
+//whether the vsi is gone.
+func releaseVsi(s *xorm.Session, tor string, vxlan int) (bool, error) {
+	_, err := s.Where("tor_ip=? AND vxlan=? AND refs>0", tor, vxlan).Decr("refs").Update(new(SapiTorVsis))
+	if err != nil {
+		return false, err
+	}
+	removed, err := s.Where("tor_ip=? AND vxlan=? AND refs<=0", tor, vxlan).Delete(new(SapiTorVsis))
+	if err != nil {
+		return false, err
+	}
+	return removed > 0, nil
+}
+
+//vsiRefs counts the vxlan networks with ports on every tor vsi
+func vsiRefs(pvms []*SapiPortVlanMapping, nets map[string]*SapiProvisionedNets) map[vsiKey]int {
+	seen := make(map[vsiKey]map[string]bool)
+	for _, pvm := range pvms {
+		net, ok := nets[pvm.NetworkId]
+		if !ok || netType(net) != NetTypeVxlan {
+			continue
+		}
+		key := vsiKey{pvm.TorIp, net.SegmentationId}
+		if seen[key] == nil {
+			seen[key] = make(map[string]bool)
+		}
+		seen[key][pvm.NetworkId] = true
+	}
+	refs := make(map[vsiKey]int)
+	for key, networks := range seen {
+		refs[key] = len(networks)
+	}
+	return refs
+}
+
+//RecountVsis rebuilds the vsi references from the port mappings, fixing
+//counts and rows left by earlier versions.
+func RecountVsis() error {
+	pvms := make([]*SapiPortVlanMapping, 0)
+	if err := DB().Find(&pvms); err != nil {
+		return err
+	}
+	nets, err := provisionedNets()
+	if err != nil {
+		return err
+	}
+	refs := vsiRefs(pvms, nets)
+
+	vsis := make([]*SapiTorVsis, 0)
+	if err := DB().Find(&vsis); err != nil {
+		return err
+	}
+	for _, vsi := range vsis {
+		key := vsiKey{vsi.TorIp, vsi.Vxlan}
+		n, ok := refs[key]
+		delete(refs, key)
+		switch {
+		case !ok:
+			_, err := DB().Id(vsi.Id).Delete(new(SapiTorVsis))
+			if err != nil {
+				return err
+			}
+		case n != vsi.Refs:
+			_, err := DB().Id(vsi.Id).Cols("refs").Update(&SapiTorVsis{Refs: n})
+			if err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		Log().WithFields(logrus.Fields{
+			"Tor":  vsi.TorIp,
+			"Vsi":  vsi.Vxlan,
+			"Refs": n,
+		}).Info("RecountVsis: vsi references fixed")
+	}
+	for key, n := range refs {
+		if err := (&SapiTorVsis{TorIp: key.tor, Vxlan: key.vxlan, Refs: n}).insert(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package sapi
+
+import "testing"
+
+func TestVsiRefs(t *testing.T) {
+	nets := map[string]*SapiProvisionedNets{
+		"net1": {NetworkId: "net1", SegmentationId: 100},
+		//same vni, eg. a shared and an unshared network
+		"net2": {NetworkId: "net2", SegmentationId: 100, Shared: true},
+		"net3": {NetworkId: "net3", SegmentationType: "vlan", SegmentationId: 30},
+	}
+	pvms := []*SapiPortVlanMapping{
+		{PortId: "port1", NetworkId: "net1", TorIp: "tor1"},
+		{PortId: "port2", NetworkId: "net1", TorIp: "tor1"},
+		{PortId: "port3", NetworkId: "net2", TorIp: "tor1"},
+		{PortId: "port4", NetworkId: "net2", TorIp: "tor2"},
+		{PortId: "port5", NetworkId: "net3", TorIp: "tor1"},
+		{PortId: "port6", NetworkId: "gone", TorIp: "tor1"},
+	}
+	refs := vsiRefs(pvms, nets)
+	if len(refs) != 2 {
+		t.Errorf("Expected 2 vsis, got %v", refs)
+	}
+	if n := refs[vsiKey{"tor1", 100}]; n != 2 {
+		t.Errorf("Expected vsi 100 on tor1 referenced by %d networks, got %d", 2, n)
+	}
+	if n := refs[vsiKey{"tor2", 100}]; n != 1 {
+		t.Errorf("Expected vsi 100 on tor2 referenced by %d network, got %d", 1, n)
+	}
+}